@@ -13,6 +13,7 @@ write speed
 */
 
 import (
+	"strings"
 	"sync"
 	"sync/atomic"
 
@@ -22,19 +23,42 @@ import (
 	"github.com/treemana/godot/util"
 )
 
-type reply map[string]map[uint16]any
+const groupSeparator = "|"
+
+type reply map[Key]map[uint16]any
+
+// Key the cache key of the question name
+type Key struct {
+	Name string
+
+	// Scope the answers of the same name vary by scope, e.g. the client subnet,
+	// empty for the shared answers
+	Scope string
+}
+
+// answer the cached A/AAAA answers with the DNSSEC validation state
+type answer struct {
+	rrs    []dns.RR
+	secure bool // validated by DNSSEC, the response has AD
+}
 
 var (
 	rm     atomic.Pointer[reply]
 	enable atomic.Bool
 
 	wg sync.WaitGroup
-	uc chan *dns.Msg
+	uc chan entry
 )
 
+// entry the response to update in scope, nil response flushes the scope
+type entry struct {
+	response *dns.Msg
+	scope    string
+}
+
 func Start() {
 	rm.Store(&reply{})
-	uc = make(chan *dns.Msg)
+	uc = make(chan entry)
 	go update()
 	enable.Store(true)
 }
@@ -52,46 +76,52 @@ func Stop() {
 	log.Sugar.Info("cache stopped")
 }
 
-func Get(request *dns.Msg) *dns.Msg {
+// Get return the cached response of request in scope
+func Get(request *dns.Msg, scope string) *dns.Msg {
 	if request == nil || !enable.Load() {
 		return nil
 	}
 
 	var q = request.Question[0]
+	var k = Key{Name: q.Name, Scope: scope}
 	var m = *rm.Load()
-	if len(m) == 0 || len(m[q.Name]) == 0 || m[q.Name][q.Qtype] == nil {
+	if len(m) == 0 || len(m[k]) == 0 || m[k][q.Qtype] == nil {
 		return nil
 	}
 
 	switch request.Question[0].Qtype {
 	case dns.TypeA, dns.TypeAAAA:
-		return util.DNSNewResponseByAnswer(request, m[q.Name][q.Qtype].([]dns.RR))
+		a := m[k][q.Qtype].(answer)
+		response := util.DNSNewResponseByAnswer(request, a.rrs)
+		response.AuthenticatedData = a.secure
+		return response
 	default:
-		response := (m[q.Name][q.Qtype].(*dns.Msg)).Copy()
+		response := (m[k][q.Qtype].(*dns.Msg)).Copy()
 		response.Id = request.Id
 		return response
 	}
 }
 
 // GetAllQuestion return all cached request questions
-// map[question name][]uint16{question type}
-func GetAllQuestion() map[string][]uint16 {
+// map[question name and scope][]uint16{question type}
+func GetAllQuestion() map[Key][]uint16 {
 	var origin = *rm.Load()
-	var all = make(map[string][]uint16, len(origin))
-	for name, typeMap := range origin {
-		if len(name) == 0 || len(typeMap) == 0 {
+	var all = make(map[Key][]uint16, len(origin))
+	for k, typeMap := range origin {
+		if len(k.Name) == 0 || len(typeMap) == 0 {
 			continue
 		}
 		var types = make([]uint16, 0, len(typeMap))
 		for qType := range typeMap {
 			types = append(types, qType)
 		}
-		all[name] = types
+		all[k] = types
 	}
 	return all
 }
 
-func Update(response *dns.Msg) {
+// Update cache response in scope
+func Update(response *dns.Msg, scope string) {
 
 	if response == nil || response.Rcode != dns.RcodeSuccess || len(response.Answer) == 0 || !enable.Load() {
 		return
@@ -105,30 +135,79 @@ func Update(response *dns.Msg) {
 	}
 
 	go func() {
-		uc <- response
+		uc <- entry{response: response, scope: scope}
 		wg.Done()
 	}()
 
 }
 
+// GroupScope return the scope of the client group whose answers are cached
+// apart, group|scope
+func GroupScope(group, scope string) string {
+	return group + groupSeparator + scope
+}
+
+// SplitScope return the client group and the subnet scope of scope, the group
+// is empty for the shared answers
+func SplitScope(scope string) (string, string) {
+	if i := strings.Index(scope, groupSeparator); i >= 0 {
+		return scope[:i], scope[i+len(groupSeparator):]
+	}
+	return "", scope
+}
+
+// Flush remove all the cached answers in scope, and in the scopes of the client
+// groups with the same subnet scope
+func Flush(scope string) {
+	if !enable.Load() {
+		return
+	}
+
+	wg.Add(1)
+	if !enable.Load() {
+		log.Sugar.Info("cache flush after stopped")
+		wg.Done()
+		return
+	}
+
+	go func() {
+		uc <- entry{scope: scope}
+		wg.Done()
+	}()
+}
+
 func update() {
 	var q dns.Question
 	var m reply
-	for message := range uc {
-		q = message.Question[0]
+	for e := range uc {
+		if e.response == nil {
+			m = *rm.Load()
+			target := make(reply, len(m))
+			for k, v := range m {
+				if _, scope := SplitScope(k.Scope); scope != e.scope {
+					target[k] = v
+				}
+			}
+			rm.Store(&target)
+			log.Sugar.Infof("cache scope [%s] flushed, %d names removed", e.scope, len(m)-len(target))
+			continue
+		}
+
+		q = e.response.Question[0]
+		k := Key{Name: q.Name, Scope: e.scope}
 		m = *rm.Load()
-		target := duplicate(m, q.Name, q.Qtype)
+		target := duplicate(m, k, q.Qtype)
 		switch q.Qtype {
 		case dns.TypeA, dns.TypeAAAA:
-			target[q.Name][q.Qtype] = message.Answer
+			target[k][q.Qtype] = answer{rrs: e.response.Answer, secure: e.response.AuthenticatedData}
 		default:
-			target[q.Name][q.Qtype] = message
+			target[k][q.Qtype] = e.response
 		}
 		rm.Store(&target)
 	}
 }
 
-func duplicate(source reply, host string, qType uint16) reply {
+func duplicate(source reply, host Key, qType uint16) reply {
 
 	if len(source) == 0 {
 		return reply{host: {qType: nil}}
@@ -142,9 +221,9 @@ func duplicate(source reply, host string, qType uint16) reply {
 
 	if _, hb = source[host]; hb {
 		_, tb = source[host][qType]
-		target = make(map[string]map[uint16]any, len(source))
+		target = make(map[Key]map[uint16]any, len(source))
 	} else {
-		target = make(map[string]map[uint16]any, len(source)+1)
+		target = make(map[Key]map[uint16]any, len(source)+1)
 		target[host] = map[uint16]any{qType: nil}
 	}
 
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+)
+
+func TestMain(m *testing.M) {
+	_ = log.Init(log.Config{STDOUT: true, Level: 1})
+	os.Exit(m.Run())
+}
+
+func newRequest(name string) *dns.Msg {
+	var req = new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	return req
+}
+
+// store cache the answer ip of name in scope, and wait until it is cached
+func store(t *testing.T, name, ip, scope string) {
+	var resp = new(dns.Msg)
+	resp.SetReply(newRequest(name))
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(ip),
+	})
+	Update(resp, scope)
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cached(name, scope) == ip {
+			return
+		}
+	}
+	t.Fatalf("%s in scope [%s] is not cached", name, scope)
+}
+
+// cached return the cached answer ip of name in scope, empty when not cached
+func cached(name, scope string) string {
+	var resp = Get(newRequest(name), scope)
+	if resp == nil || len(resp.Answer) == 0 {
+		return ""
+	}
+	return resp.Answer[0].(*dns.A).A.String()
+}
+
+func TestScope(t *testing.T) {
+	var tests = []struct {
+		scope, group, subnet string
+	}{
+		{GroupScope("kids", "10.0.0.0/24"), "kids", "10.0.0.0/24"},
+		{GroupScope("kids", ""), "kids", ""},
+		{"10.0.0.0/24", "", "10.0.0.0/24"},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		if group, subnet := SplitScope(test.scope); group != test.group || subnet != test.subnet {
+			t.Errorf("SplitScope(%s) = %s, %s, want %s, %s", test.scope, group, subnet, test.group, test.subnet)
+		}
+	}
+}
+
+func TestGroupScope(t *testing.T) {
+	Start()
+	defer Stop()
+
+	store(t, "example.com.", "192.0.2.1", "")
+	store(t, "example.com.", "192.0.2.2", GroupScope("kids", ""))
+
+	for scope, want := range map[string]string{
+		"":                       "192.0.2.1",
+		GroupScope("kids", ""):   "192.0.2.2",
+		GroupScope("guests", ""): "",
+	} {
+		if got := cached("example.com.", scope); got != want {
+			t.Errorf("Get() in scope [%s] = %q, want %q", scope, got, want)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	Start()
+	defer Stop()
+
+	store(t, "example.com.", "192.0.2.1", "10.0.0.0/24")
+	store(t, "example.com.", "192.0.2.2", GroupScope("kids", "10.0.0.0/24"))
+	store(t, "example.com.", "192.0.2.3", "10.1.0.0/24")
+	store(t, "example.com.", "192.0.2.4", GroupScope("kids", "10.1.0.0/24"))
+
+	Flush("10.0.0.0/24")
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && cached("example.com.", "10.0.0.0/24") != ""; {
+		time.Sleep(time.Millisecond)
+	}
+
+	for scope, want := range map[string]string{
+		"10.0.0.0/24":                     "",
+		GroupScope("kids", "10.0.0.0/24"): "",
+		"10.1.0.0/24":                     "192.0.2.3",
+		GroupScope("kids", "10.1.0.0/24"): "192.0.2.4",
+	} {
+		if got := cached("example.com.", scope); got != want {
+			t.Errorf("Get() in scope [%s] after Flush() = %q, want %q", scope, got, want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package clients
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/metrics"
+	"github.com/treemana/godot/model"
+	"github.com/treemana/godot/upstream"
+)
+
+const (
+	metricRequests = "client_group_requests:" // + group name, number of the requests of the group
+)
+
+// GroupConfig represents a client group
+type GroupConfig struct {
+	// Name of the group in the logs, metrics and cache scopes
+	Name string `json:"name"`
+
+	// Clients the CIDRs of the clients in the group
+	Clients []string `json:"clients"`
+
+	// Upstream the name of the upstream group resolving the names not routed,
+	// the default resolvers when empty
+	Upstream string `json:"upstream"`
+
+	// Filter the names of the filter lists applied, all the lists when absent,
+	// none of them when empty
+	Filter []string `json:"filter"`
+
+	// ECS the client subnet mode, upstream.ECSStatic, upstream.ECSClient or
+	// upstream.ECSOff, the global one when empty
+	ECS string `json:"ecs"`
+
+	// SafeSearch enable or disable the safe search of the group, the global one
+	// when absent
+	SafeSearch *bool `json:"safe_search"`
+}
+
+// Config represents the client groups settings
+type Config struct {
+	// Groups the client groups, the longest matched client CIDR wins
+	Groups []GroupConfig `json:"groups"`
+}
+
+// entry the clients of a group
+type entry struct {
+	clients netip.Prefix
+	policy  *model.Policy
+}
+
+// Groups resolve the client group policy of the client address
+type Groups struct {
+	entries  []entry // sorted by the client prefix length descending
+	policies map[string]*model.Policy
+}
+
+// New return nil when there is no group
+func New(config Config) (*Groups, error) {
+	if len(config.Groups) == 0 {
+		return nil, nil
+	}
+
+	var g = &Groups{policies: make(map[string]*model.Policy, len(config.Groups))}
+	for _, c := range config.Groups {
+		if len(c.Name) == 0 || strings.ContainsAny(c.Name, "|") {
+			return nil, fmt.Errorf("invalid client group name [%s]", c.Name)
+		}
+		if _, ok := g.policies[c.Name]; ok {
+			return nil, fmt.Errorf("client group %s duplicated", c.Name)
+		}
+		if !upstream.ValidECS(c.ECS) {
+			return nil, fmt.Errorf("client group %s unknown ecs mode %s", c.Name, c.ECS)
+		}
+
+		var policy = &model.Policy{Group: c.Name, Upstream: c.Upstream, Lists: c.Filter, ECS: c.ECS, SafeSearch: c.SafeSearch}
+		g.policies[c.Name] = policy
+
+		for _, raw := range c.Clients {
+			prefix, err := netip.ParsePrefix(raw)
+			if err != nil {
+				return nil, fmt.Errorf("client group %s client %s error=[%+v]", c.Name, raw, err)
+			}
+			g.entries = append(g.entries, entry{clients: prefix.Masked(), policy: policy})
+		}
+		log.Sugar.Infof("client group %s clients %v upstream [%s] filter %v ecs [%s]", c.Name, c.Clients, c.Upstream, c.Filter, c.ECS)
+	}
+
+	slices.SortStableFunc(g.entries, func(a, b entry) int {
+		return b.clients.Bits() - a.clients.Bits()
+	})
+
+	return g, nil
+}
+
+// Check return error when a group refers to an unknown upstream group or filter
+// list, hasGroup and hasList report whether the name exists
+func (g *Groups) Check(hasGroup, hasList func(name string) bool) error {
+	if g == nil {
+		return nil
+	}
+
+	for _, p := range g.policies {
+		if len(p.Upstream) > 0 && !hasGroup(p.Upstream) {
+			return fmt.Errorf("client group %s unknown upstream group %s", p.Group, p.Upstream)
+		}
+		for _, name := range p.Lists {
+			if !hasList(name) {
+				return fmt.Errorf("client group %s unknown filter list %s", p.Group, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Match return the policy of the group of the client ip, nil when the client is
+// out of any group
+func (g *Groups) Match(ip net.IP) *model.Policy {
+	if g == nil || ip == nil {
+		return nil
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil
+	}
+	addr = addr.Unmap()
+
+	for _, e := range g.entries {
+		if e.clients.Contains(addr) {
+			metrics.Add(metricRequests+e.policy.Group, 1)
+			return e.policy
+		}
+	}
+	return nil
+}
+
+// Policy return the policy of the group name, nil when not found
+func (g *Groups) Policy(name string) *model.Policy {
+	if g == nil {
+		return nil
+	}
+	return g.policies[name]
+}
@@ -0,0 +1,84 @@
+package clients
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/treemana/godot/log"
+)
+
+func TestMain(m *testing.M) {
+	_ = log.Init(log.Config{STDOUT: true, Level: 1})
+	os.Exit(m.Run())
+}
+
+func TestMatch(t *testing.T) {
+	g, err := New(Config{Groups: []GroupConfig{
+		{Name: "lan", Clients: []string{"192.168.0.0/16", "fd00::/8"}},
+		{Name: "kids", Clients: []string{"192.168.2.0/24"}, Upstream: "family", Filter: []string{"ads"}, ECS: "off"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		ip    string
+		group string
+	}{
+		{"192.168.1.9", "lan"},
+		{"192.168.2.9", "kids"},
+		{"::ffff:192.168.2.9", "kids"},
+		{"fd00::9", "lan"},
+		{"10.0.0.9", ""},
+	}
+	for _, test := range tests {
+		var policy = g.Match(net.ParseIP(test.ip))
+		switch {
+		case len(test.group) == 0 && policy != nil:
+			t.Errorf("Match(%s) = %s, want nil", test.ip, policy.Group)
+		case len(test.group) > 0 && (policy == nil || policy.Group != test.group):
+			t.Errorf("Match(%s) = %v, want %s", test.ip, policy, test.group)
+		}
+	}
+
+	if p := g.Policy("kids"); p == nil || p.Upstream != "family" || len(p.FilterLists()) != 1 || p.ECS != "off" {
+		t.Errorf("Policy(kids) = %+v", p)
+	}
+	if p := g.Policy("lan"); p.FilterLists() != nil {
+		t.Errorf("Policy(lan) lists = %v, want nil for all", p.FilterLists())
+	}
+
+	var yes = func(string) bool { return true }
+	var no = func(string) bool { return false }
+	if err = g.Check(yes, yes); err != nil {
+		t.Errorf("Check() = %v", err)
+	}
+	if err = g.Check(no, yes); err == nil {
+		t.Error("Check() of the unknown upstream group succeeded")
+	}
+	if err = g.Check(yes, no); err == nil {
+		t.Error("Check() of the unknown filter list succeeded")
+	}
+}
+
+func TestNew(t *testing.T) {
+	if g, err := New(Config{}); g != nil || err != nil {
+		t.Errorf("New() without groups = %v, %v, want nil", g, err)
+	}
+
+	for _, c := range []GroupConfig{
+		{Name: ""},
+		{Name: "a|b"},
+		{Name: "x", ECS: "unknown"},
+		{Name: "x", Clients: []string{"10.0.0.0"}},
+	} {
+		if _, err := New(Config{Groups: []GroupConfig{c}}); err == nil {
+			t.Errorf("New(%+v) succeeded, want error", c)
+		}
+	}
+
+	if _, err := New(Config{Groups: []GroupConfig{{Name: "x"}, {Name: "x"}}}); err == nil {
+		t.Error("New() of the duplicated groups succeeded")
+	}
+}
@@ -0,0 +1,286 @@
+package dnssec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+)
+
+// rootAnchors the root KSK-2017 and KSK-2024 DS records,
+// https://data.iana.org/root-anchors/root-anchors.xml
+const rootAnchors = `
+. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+. IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+// holdDown the add hold-down time of the new trust anchor, RFC 5011 Section 2.4.1
+const holdDown = 30 * 24 * time.Hour
+
+// trust anchor states, RFC 5011 Section 4
+const (
+	stateAddPending = "add-pending" // the new key waiting for the hold-down time
+	stateValid      = "valid"       // trusted
+	stateMissing    = "missing"     // trusted but absent from the root DNSKEY RRset
+	stateRevoked    = "revoked"     // revoked by the key itself, never trusted again
+)
+
+// anchor a managed trust anchor, the DS is used before the key seen
+type anchor struct {
+	DS    string    `json:"ds,omitempty"`
+	Key   string    `json:"key,omitempty"`
+	State string    `json:"state"`
+	Since time.Time `json:"since"` // the time of entering the state
+
+	ds  *dns.DS
+	key *dns.DNSKEY
+}
+
+// match report whether key is the anchor, the REVOKE flag is ignored
+func (a *anchor) match(key *dns.DNSKEY) bool {
+	var k = *key
+	k.Flags &^= dns.REVOKE
+	if a.key != nil {
+		var x = *a.key
+		x.Flags &^= dns.REVOKE
+		return strings.EqualFold(k.PublicKey, x.PublicKey) && k.Algorithm == x.Algorithm && k.Flags == x.Flags
+	}
+	return matchDS(&k, a.ds)
+}
+
+func (a *anchor) trusted() bool {
+	return a.State == stateValid || a.State == stateMissing
+}
+
+func (a *anchor) header() *dns.RR_Header {
+	if a.key != nil {
+		return a.key.Header()
+	}
+	return a.ds.Header()
+}
+
+func (a *anchor) keyTag() uint16 {
+	if a.key != nil {
+		return a.key.KeyTag()
+	}
+	return a.ds.KeyTag
+}
+
+// anchors the root trust anchors managed by RFC 5011
+type anchors struct {
+	file  string // the state file, not persisted when empty
+	list  []*anchor
+	mutex sync.Mutex
+}
+
+// newAnchors load the anchors from the state file when it exists, otherwise
+// from the trust anchor zone file or the built-in root DS records
+func newAnchors(trustAnchor, state string, now time.Time) (*anchors, error) {
+	var as = &anchors{file: state}
+
+	if len(state) > 0 {
+		raw, err := os.ReadFile(state)
+		switch {
+		case err == nil:
+			if err = as.unmarshal(raw); err != nil {
+				return nil, fmt.Errorf("dnssec state %s error=[%+v]", state, err)
+			}
+			return as, nil
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, err
+		}
+	}
+
+	var reader io.Reader = strings.NewReader(rootAnchors)
+	if len(trustAnchor) > 0 {
+		f, err := os.Open(trustAnchor)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = f.Close() }()
+		reader = f
+	}
+
+	var parser = dns.NewZoneParser(reader, ".", trustAnchor)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		var a = &anchor{State: stateValid, Since: now}
+		switch rr := rr.(type) {
+		case *dns.DS:
+			a.ds, a.DS = rr, rr.String()
+		case *dns.DNSKEY:
+			a.key, a.Key = rr, rr.String()
+		default:
+			continue
+		}
+		if a.header().Name != "." {
+			return nil, fmt.Errorf("trust anchor of %s, the root only", a.header().Name)
+		}
+		as.list = append(as.list, a)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(as.list) == 0 {
+		return nil, errors.New("empty trust anchor")
+	}
+
+	as.persist()
+	return as, nil
+}
+
+// trusted return the keys matching the trusted anchors
+func (as *anchors) trusted(keys []*dns.DNSKEY) []*dns.DNSKEY {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		if key.Flags&dns.REVOKE != 0 {
+			continue
+		}
+		for _, a := range as.list {
+			if a.trusted() && a.match(key) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	return trusted
+}
+
+// update the anchors by the validated root DNSKEY RRset, RFC 5011 Section 4
+func (as *anchors) update(set *rrset, now time.Time) {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
+	var changed bool
+	var transit = func(a *anchor, state string) {
+		log.Sugar.Infof("dnssec trust anchor %d %s -> %s", a.keyTag(), a.State, state)
+		a.State, a.Since, changed = state, now, true
+	}
+
+	var seen = make(map[*anchor]bool)
+	for _, key := range dnskeys(set) {
+		if key.Flags&dns.SEP == 0 {
+			continue
+		}
+
+		var a *anchor
+		for _, x := range as.list {
+			if x.match(key) {
+				a = x
+				break
+			}
+		}
+
+		// the revoked key must sign the RRset itself
+		if key.Flags&dns.REVOKE != 0 {
+			if a != nil && a.State != stateRevoked && verify(set, []*dns.DNSKEY{key}, now) == nil {
+				transit(a, stateRevoked)
+			}
+			continue
+		}
+
+		if a == nil {
+			a = &anchor{key: key, Key: key.String()}
+			as.list = append(as.list, a)
+			transit(a, stateAddPending)
+		}
+		seen[a] = true
+
+		if a.key == nil {
+			a.key, a.Key, changed = key, key.String(), true
+		}
+
+		switch {
+		case a.State == stateAddPending && now.Sub(a.Since) >= holdDown:
+			transit(a, stateValid)
+		case a.State == stateMissing:
+			transit(a, stateValid)
+		}
+	}
+
+	var list = as.list[:0]
+	for _, a := range as.list {
+		switch {
+		case seen[a]:
+		case a.State == stateValid:
+			transit(a, stateMissing)
+		case a.State == stateAddPending:
+			// the hold-down restarts when it appears again
+			log.Sugar.Infof("dnssec trust anchor %d add-pending removed", a.keyTag())
+			changed = true
+			continue
+		}
+		list = append(list, a)
+	}
+	as.list = list
+
+	if changed {
+		as.persist()
+	}
+}
+
+// persist write the anchors to the state file, do nothing when it is empty
+func (as *anchors) persist() {
+	if len(as.file) == 0 {
+		return
+	}
+
+	raw, err := json.MarshalIndent(as.list, "", "  ")
+	if err != nil {
+		log.Sugar.Errorf("dnssec state marshal error=[%+v]", err)
+		return
+	}
+
+	var tmp = as.file + ".tmp"
+	if err = os.WriteFile(tmp, raw, 0o644); err == nil {
+		err = os.Rename(tmp, as.file)
+	}
+	if err != nil {
+		log.Sugar.Errorf("dnssec state %s write error=[%+v]", as.file, err)
+	}
+}
+
+func (as *anchors) unmarshal(raw []byte) error {
+	if err := json.Unmarshal(raw, &as.list); err != nil {
+		return err
+	}
+
+	for _, a := range as.list {
+		if len(a.Key) > 0 {
+			rr, err := dns.NewRR(a.Key)
+			if err != nil {
+				return err
+			}
+			var ok bool
+			if a.key, ok = rr.(*dns.DNSKEY); !ok {
+				return fmt.Errorf("not a DNSKEY %s", a.Key)
+			}
+			continue
+		}
+
+		rr, err := dns.NewRR(a.DS)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if a.ds, ok = rr.(*dns.DS); !ok {
+			return fmt.Errorf("not a DS %s", a.DS)
+		}
+	}
+
+	if len(as.list) == 0 {
+		return errors.New("empty trust anchor")
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package dnssec
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// the result of the DS denial of a name
+const (
+	cutUnknown  = iota // not proven
+	cutNone            // the name is not a zone cut
+	cutInsecure        // the name is an unsigned delegation
+)
+
+// denials return the NSEC and NSEC3 records of the sets
+func denials(sets []*rrset) ([]*dns.NSEC, []*dns.NSEC3) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, set := range sets {
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+	return nsecs, nsec3s
+}
+
+// denyName report whether name is proven not exist, RFC 4035 Section 5.4 and RFC 5155 Section 8.4
+// the wildcard of the closest encloser must be proven not exist too when nowildcard is true
+func denyName(name string, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3, nowildcard bool) bool {
+	name = dns.CanonicalName(name)
+
+	for _, nsec := range nsecs {
+		if !covers(nsec, name) {
+			continue
+		}
+		if !nowildcard {
+			return true
+		}
+
+		// the closest encloser is the longer common ancestor of name with the NSEC owner and next name
+		var encloser = ancestor(name, dns.CanonicalName(nsec.Hdr.Name))
+		if next := ancestor(name, dns.CanonicalName(nsec.NextDomain)); dns.CountLabel(next) > dns.CountLabel(encloser) {
+			encloser = next
+		}
+		return slices.ContainsFunc(nsecs, func(nsec *dns.NSEC) bool { return covers(nsec, wildcardOf(encloser)) })
+	}
+
+	encloser, next, ok := closestEncloser(name, nsec3s)
+	if !ok || !slices.ContainsFunc(nsec3s, func(rr *dns.NSEC3) bool { return rr.Cover(next) }) {
+		return false
+	}
+	if !nowildcard {
+		return true
+	}
+	return slices.ContainsFunc(nsec3s, func(rr *dns.NSEC3) bool { return rr.Cover(wildcardOf(encloser)) })
+}
+
+// denyType report whether name exists without qtype and CNAME, RFC 4035 Section 5.4 and RFC 5155 Section 8.5
+func denyType(name string, qtype uint16, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) bool {
+	name = dns.CanonicalName(name)
+
+	for _, nsec := range nsecs {
+		if dns.CanonicalName(nsec.Hdr.Name) == name {
+			return !slices.Contains(nsec.TypeBitMap, qtype) && !slices.Contains(nsec.TypeBitMap, dns.TypeCNAME)
+		}
+		// the empty non-terminal
+		if covers(nsec, name) && dns.IsSubDomain(name, dns.CanonicalName(nsec.NextDomain)) {
+			return true
+		}
+	}
+
+	for _, rr := range nsec3s {
+		if rr.Match(name) {
+			return !slices.Contains(rr.TypeBitMap, qtype) && !slices.Contains(rr.TypeBitMap, dns.TypeCNAME)
+		}
+	}
+
+	// the DS of an unsigned delegation in the opt-out span, RFC 5155 Section 8.6
+	if qtype == dns.TypeDS {
+		if _, next, ok := closestEncloser(name, nsec3s); ok {
+			return slices.ContainsFunc(nsec3s, func(rr *dns.NSEC3) bool { return rr.Cover(next) && rr.Flags&1 == 1 })
+		}
+	}
+	return false
+}
+
+// denyDS return whether name is a zone cut by the DS denial
+func denyDS(name string, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) int {
+	name = dns.CanonicalName(name)
+
+	var bitmap = func(types []uint16) int {
+		switch {
+		case slices.Contains(types, dns.TypeDS):
+			return cutUnknown
+		case slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA):
+			return cutInsecure
+		default:
+			return cutNone
+		}
+	}
+
+	for _, nsec := range nsecs {
+		if dns.CanonicalName(nsec.Hdr.Name) == name {
+			return bitmap(nsec.TypeBitMap)
+		}
+	}
+	for _, nsec := range nsecs {
+		if covers(nsec, name) {
+			return cutNone
+		}
+	}
+
+	for _, rr := range nsec3s {
+		if rr.Match(name) {
+			return bitmap(rr.TypeBitMap)
+		}
+	}
+	for _, rr := range nsec3s {
+		if rr.Cover(name) {
+			// an unsigned delegation may be in the opt-out span
+			if rr.Flags&1 == 1 {
+				return cutInsecure
+			}
+			return cutNone
+		}
+	}
+
+	return cutUnknown
+}
+
+// closestEncloser return the closest encloser of name matched by nsec3s and the next closer name
+func closestEncloser(name string, nsec3s []*dns.NSEC3) (string, string, bool) {
+	var labels = dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		var encloser = dns.Fqdn(strings.Join(labels[i:], "."))
+		if slices.ContainsFunc(nsec3s, func(rr *dns.NSEC3) bool { return rr.Match(encloser) }) {
+			return encloser, dns.Fqdn(strings.Join(labels[i-1:], ".")), true
+		}
+	}
+	return "", "", false
+}
+
+// covers report whether name is between the owner and the next name of nsec in canonical order
+func covers(nsec *dns.NSEC, name string) bool {
+	var owner, next = dns.CanonicalName(nsec.Hdr.Name), dns.CanonicalName(nsec.NextDomain)
+	if compare(owner, next) < 0 {
+		return compare(owner, name) < 0 && compare(name, next) < 0
+	}
+	// the last NSEC of the zone
+	return compare(owner, name) < 0 || compare(name, next) < 0
+}
+
+// compare the names in canonical order, RFC 4034 Section 6.1
+func compare(a, b string) int {
+	var la, lb = dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(strings.ToLower(la[i]), strings.ToLower(lb[j])); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// ancestor return the longest common ancestor of a and b
+func ancestor(a, b string) string {
+	var n = dns.CompareDomainName(a, b)
+	var labels = dns.SplitDomainName(a)
+	if n == 0 {
+		return "."
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+func wildcardOf(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
@@ -0,0 +1,450 @@
+package dnssec
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+)
+
+const (
+	maxZoneTTL     = time.Hour        // the max time of the zone keys cached
+	failureZoneTTL = 10 * time.Second // the time of the failed zone cached
+)
+
+// Security the validation result, RFC 4035 Section 4.3
+type Security uint8
+
+const (
+	Insecure Security = iota // no chain of trust to the data, answered as is
+	Secure                   // the chain of trust is validated, answered with AD
+	Bogus                    // the chain of trust is broken, answered SERVFAIL
+)
+
+func (s Security) String() string {
+	switch s {
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	default:
+		return "insecure"
+	}
+}
+
+// Config represents the DNSSEC validation settings
+type Config struct {
+	// Enable validate the upstream answers
+	Enable bool `json:"enable"`
+
+	// TrustAnchor the zone file of the root trust anchor DS or DNSKEY records,
+	// the built-in root KSK DS records when empty
+	TrustAnchor string `json:"trust_anchor"`
+
+	// State the file of the RFC 5011 managed trust anchors, the trust anchors are
+	// loaded from it instead of TrustAnchor when it exists, not persisted when empty
+	State string `json:"state"`
+}
+
+// Exchange send req to the upstream resolvers, return nil when failed
+type Exchange func(ctx context.Context, req *dns.Msg) *dns.Msg
+
+// Validator validate the responses from the root trust anchors,
+// the DS and DNSKEY records of the chain are queried by exchange
+type Validator struct {
+	exchange Exchange
+	anchors  *anchors
+	now      func() time.Time
+
+	// the validated zones, map[zone name]*zone
+	// the name which is not a zone cut maps to the zone containing it
+	zones map[string]*zone
+	mutex sync.Mutex
+}
+
+// zone the validated keys of a zone
+type zone struct {
+	name     string
+	security Security
+	keys     []*dns.DNSKEY  // the validated DNSKEY RRset when Secure
+	ede      *dns.EDNS0_EDE // the reason when Bogus
+	expire   time.Time
+}
+
+// New return nil when the validation is disabled
+func New(config Config, exchange Exchange) (*Validator, error) {
+	if !config.Enable {
+		return nil, nil
+	}
+
+	anchors, err := newAnchors(config.TrustAnchor, config.State, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Validator{exchange: exchange, anchors: anchors, now: time.Now, zones: make(map[string]*zone)}, nil
+}
+
+// Validate return the security of resp, and the reason when it is Bogus
+// the responses other than NOERROR and NXDOMAIN are Insecure
+func (v *Validator) Validate(ctx context.Context, resp *dns.Msg) (Security, *dns.EDNS0_EDE) {
+	if len(resp.Question) != 1 || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return Insecure, nil
+	}
+
+	var q = resp.Question[0]
+	var security = Secure
+	var wildcard []string // the names answered by wildcard expansion
+
+	var answers = rrsets(resp.Answer)
+	for _, set := range answers {
+		s, ede := v.validateSet(ctx, set)
+		if s == Bogus {
+			return s, ede
+		}
+		if s == Insecure {
+			security = Insecure
+			continue
+		}
+		if int(set.sigs[0].Labels) < dns.CountLabel(set.name) {
+			wildcard = append(wildcard, set.name)
+		}
+	}
+
+	// the name at the end of the CNAME chain is the one proven not exist or has no data
+	var target = dns.CanonicalName(q.Name)
+	for range answers {
+		var next = target
+		for _, set := range answers {
+			if set.name == target && set.rrtype == dns.TypeCNAME {
+				next = dns.CanonicalName(set.rrs[0].(*dns.CNAME).Target)
+			}
+		}
+		if next == target {
+			break
+		}
+		target = next
+	}
+
+	var negative = resp.Rcode == dns.RcodeNameError || !slices.ContainsFunc(answers, func(set *rrset) bool {
+		return set.name == target && (set.rrtype == q.Qtype || q.Qtype == dns.TypeANY)
+	})
+	if !negative && len(wildcard) == 0 {
+		return security, nil
+	}
+
+	// the denial of existence
+	var authority = rrsets(resp.Ns)
+	if len(authority) == 0 || !slices.ContainsFunc(authority, func(set *rrset) bool { return len(set.sigs) > 0 }) {
+		var z = v.chain(ctx, target)
+		if z.security == Insecure {
+			return Insecure, nil
+		}
+		if z.security == Bogus {
+			return Bogus, z.ede
+		}
+		return Bogus, newEDE(dns.ExtendedErrorCodeNSECMissing, "no signed denial of %s", target)
+	}
+
+	for _, set := range authority {
+		s, ede := v.validateSet(ctx, set)
+		if s == Bogus {
+			return s, ede
+		}
+		if s == Insecure {
+			security = Insecure
+		}
+	}
+	if security == Insecure {
+		return Insecure, nil
+	}
+
+	var nsecs, nsec3s = denials(authority)
+	for _, name := range wildcard {
+		if !denyName(name, nsecs, nsec3s, false) {
+			return Bogus, newEDE(dns.ExtendedErrorCodeNSECMissing, "no denial of %s for wildcard", name)
+		}
+	}
+
+	switch {
+	case !negative:
+	case resp.Rcode == dns.RcodeNameError:
+		if !denyName(target, nsecs, nsec3s, true) {
+			return Bogus, newEDE(dns.ExtendedErrorCodeNSECMissing, "no denial of %s", target)
+		}
+	default:
+		if !denyType(target, q.Qtype, nsecs, nsec3s) {
+			return Bogus, newEDE(dns.ExtendedErrorCodeNSECMissing, "no denial of %s %s", target, dns.TypeToString[q.Qtype])
+		}
+	}
+
+	return Secure, nil
+}
+
+// validateSet validate the signatures of set by the keys of its signer
+func (v *Validator) validateSet(ctx context.Context, set *rrset) (Security, *dns.EDNS0_EDE) {
+	if len(set.sigs) == 0 {
+		var z = v.chain(ctx, set.name)
+		switch z.security {
+		case Secure:
+			return Bogus, newEDE(dns.ExtendedErrorCodeRRSIGsMissing, "no RRSIG of %s %s", set.name, dns.TypeToString[set.rrtype])
+		case Bogus:
+			return Bogus, z.ede
+		default:
+			return Insecure, nil
+		}
+	}
+
+	var signer = dns.CanonicalName(set.sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, set.name) {
+		return Bogus, newEDE(dns.ExtendedErrorCodeDNSBogus, "signer %s of %s out of zone", signer, set.name)
+	}
+
+	var z = v.chain(ctx, signer)
+	if z.security != Secure {
+		return z.security, z.ede
+	}
+	if z.name != signer {
+		return Bogus, newEDE(dns.ExtendedErrorCodeDNSKEYMissing, "signer %s is not a zone", signer)
+	}
+
+	if ede := verify(set, z.keys, v.now()); ede != nil {
+		return Bogus, ede
+	}
+	return Secure, nil
+}
+
+// chain return the zone containing name, the delegations are validated
+// from the root to name until a Bogus or Insecure one
+func (v *Validator) chain(ctx context.Context, name string) *zone {
+	var z = v.root(ctx)
+	var labels = dns.SplitDomainName(dns.CanonicalName(name))
+	for i := len(labels) - 1; i >= 0 && z.security == Secure; i-- {
+		z = v.delegation(ctx, z, dns.Fqdn(strings.Join(labels[i:], ".")))
+	}
+	return z
+}
+
+// root return the root zone validated by the trust anchors,
+// the trust anchors are updated by the validated root DNSKEY RRset, RFC 5011
+func (v *Validator) root(ctx context.Context) *zone {
+	if z := v.load("."); z != nil {
+		return z
+	}
+
+	var now = v.now()
+	var set = find(v.query(ctx, ".", dns.TypeDNSKEY), ".", dns.TypeDNSKEY)
+	if set == nil {
+		return v.fail(ctx, ".", newEDE(dns.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY of the root"))
+	}
+
+	if ede := verify(set, v.anchors.trusted(dnskeys(set)), now); ede != nil {
+		log.Sugar.Errorf("dnssec root DNSKEY not trusted, %s", ede.ExtraText)
+		return v.fail(ctx, ".", ede)
+	}
+
+	v.anchors.update(set, now)
+
+	return v.store(".", &zone{name: ".", security: Secure, keys: dnskeys(set)}, set.ttl())
+}
+
+// delegation return the zone of child, parent is the secure zone containing it
+// return parent when child is not a zone cut
+func (v *Validator) delegation(ctx context.Context, parent *zone, child string) *zone {
+	if z := v.load(child); z != nil {
+		return z
+	}
+
+	var resp = v.query(ctx, child, dns.TypeDS)
+	if resp == nil || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return v.fail(ctx, child, newEDE(dns.ExtendedErrorCodeNetworkError, "no DS response of %s", child))
+	}
+
+	var now = v.now()
+	var answers = rrsets(resp.Answer)
+	if ds := find(resp, child, dns.TypeDS); ds != nil {
+		if ede := verify(ds, parent.keys, now); ede != nil {
+			return v.fail(ctx, child, ede)
+		}
+		return v.keys(ctx, child, ds)
+	}
+
+	// the alias is not a zone cut
+	for _, set := range answers {
+		if set.name == child && set.rrtype == dns.TypeCNAME {
+			if ede := verify(set, parent.keys, now); ede != nil {
+				return v.fail(ctx, child, ede)
+			}
+			return v.store(child, parent, 0)
+		}
+	}
+
+	// no DS, the parent must prove it
+	var authority = rrsets(resp.Ns)
+	for _, set := range authority {
+		if set.rrtype != dns.TypeNSEC && set.rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		if ede := verify(set, parent.keys, now); ede != nil {
+			return v.fail(ctx, child, ede)
+		}
+	}
+
+	var nsecs, nsec3s = denials(authority)
+	switch denyDS(child, nsecs, nsec3s) {
+	case cutInsecure:
+		return v.store(child, &zone{name: child, security: Insecure}, maxZoneTTL)
+	case cutNone:
+		return v.store(child, parent, 0)
+	default:
+		return v.fail(ctx, child, newEDE(dns.ExtendedErrorCodeNSECMissing, "no DS denial of %s", child))
+	}
+}
+
+// keys return the zone of name with the DNSKEY RRset validated by ds
+// the zone is Insecure when none of ds is supported, RFC 4035 Section 5.2
+func (v *Validator) keys(ctx context.Context, name string, ds *rrset) *zone {
+	var digests []*dns.DS
+	for _, rr := range ds.rrs {
+		if d := rr.(*dns.DS); supported(d.Algorithm, d.DigestType) {
+			digests = append(digests, d)
+		}
+	}
+	if len(digests) == 0 {
+		return v.store(name, &zone{name: name, security: Insecure}, ds.ttl())
+	}
+
+	var set = find(v.query(ctx, name, dns.TypeDNSKEY), name, dns.TypeDNSKEY)
+	if set == nil {
+		return v.fail(ctx, name, newEDE(dns.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY of %s", name))
+	}
+
+	var keys = dnskeys(set)
+	var anchored []*dns.DNSKEY
+	for _, key := range keys {
+		if slices.ContainsFunc(digests, func(d *dns.DS) bool { return matchDS(key, d) }) {
+			anchored = append(anchored, key)
+		}
+	}
+
+	if ede := verify(set, anchored, v.now()); ede != nil {
+		return v.fail(ctx, name, ede)
+	}
+
+	return v.store(name, &zone{name: name, security: Secure, keys: keys}, min(ds.ttl(), set.ttl()))
+}
+
+// query return the response of name and qtype with the DNSSEC records
+// the checking is disabled, the upstream validating resolvers return the bogus data
+func (v *Validator) query(ctx context.Context, name string, qtype uint16) *dns.Msg {
+	var req = new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	req.CheckingDisabled = true
+	return v.exchange(ctx, req)
+}
+
+func (v *Validator) load(name string) *zone {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if z, ok := v.zones[name]; ok && v.now().Before(z.expire) {
+		return z
+	}
+	return nil
+}
+
+// store cache z as the zone of name for ttl, maxZoneTTL at most
+// the name which is not a zone cut expires with the zone containing it
+func (v *Validator) store(name string, z *zone, ttl time.Duration) *zone {
+	var expire = v.now().Add(min(max(ttl, 0), maxZoneTTL))
+	if z.name == name {
+		z.expire = expire
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.zones[name] = z
+	return z
+}
+
+// fail return the Bogus zone of name, it is cached for failureZoneTTL
+// unless ctx is done, the failure may be caused by the deadline of the query
+func (v *Validator) fail(ctx context.Context, name string, ede *dns.EDNS0_EDE) *zone {
+	var z = &zone{name: name, security: Bogus, ede: ede}
+	if ctx.Err() != nil {
+		return z
+	}
+	return v.store(name, z, failureZoneTTL)
+}
+
+// verify return nil when one of the signatures of set is verified by keys and valid now,
+// otherwise the reason
+func verify(set *rrset, keys []*dns.DNSKEY, now time.Time) *dns.EDNS0_EDE {
+	if len(set.sigs) == 0 {
+		return newEDE(dns.ExtendedErrorCodeRRSIGsMissing, "no RRSIG of %s %s", set.name, dns.TypeToString[set.rrtype])
+	}
+
+	var ede = newEDE(dns.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY signed %s %s", set.name, dns.TypeToString[set.rrtype])
+	for _, sig := range set.sigs {
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+
+			if err := sig.Verify(key, set.rrs); err != nil {
+				ede = newEDE(dns.ExtendedErrorCodeDNSBogus, "RRSIG of %s %s by key %d, %s", set.name, dns.TypeToString[set.rrtype], sig.KeyTag, err)
+				continue
+			}
+
+			if !sig.ValidityPeriod(now) {
+				var code = dns.ExtendedErrorCodeSignatureExpired
+				if int64(sig.Inception) > now.Unix() {
+					code = dns.ExtendedErrorCodeSignatureNotYetValid
+				}
+				ede = newEDE(code, "RRSIG of %s %s by key %d", set.name, dns.TypeToString[set.rrtype], sig.KeyTag)
+				continue
+			}
+
+			return nil
+		}
+	}
+	return ede
+}
+
+// supported report whether the DNSKEY algorithm and DS digest type are supported
+func supported(algorithm, digestType uint8) bool {
+	switch algorithm {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+		dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+	default:
+		return false
+	}
+
+	switch digestType {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		return true
+	default:
+		return false
+	}
+}
+
+// matchDS report whether key is the one ds refers to
+func matchDS(key *dns.DNSKEY, ds *dns.DS) bool {
+	if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+		return false
+	}
+	var digest = key.ToDS(ds.DigestType)
+	return digest != nil && strings.EqualFold(digest.Digest, ds.Digest)
+}
+
+func newEDE(code uint16, format string, args ...any) *dns.EDNS0_EDE {
+	return &dns.EDNS0_EDE{InfoCode: code, ExtraText: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,205 @@
+package dnssec
+
+import (
+	"context"
+	"crypto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+)
+
+func TestMain(m *testing.M) {
+	_ = log.Init(log.Config{STDOUT: true, Level: 1})
+	os.Exit(m.Run())
+}
+
+// testZone a signed zone, the key signs everything
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	var key = &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign return rrs and their RRSIG valid in [inception, expiration)
+func (z *testZone) sign(t *testing.T, inception, expiration time.Time, rrs ...dns.RR) []dns.RR {
+	var sig = &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		TypeCovered: rrs[0].Header().Rrtype,
+		Algorithm:   z.key.Algorithm,
+		Labels:      uint8(dns.CountLabel(rrs[0].Header().Name)),
+		OrigTtl:     rrs[0].Header().Ttl,
+		Expiration:  uint32(expiration.Unix()),
+		Inception:   uint32(inception.Unix()),
+		KeyTag:      z.key.KeyTag(),
+		SignerName:  z.name,
+	}
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrs, sig)
+}
+
+func (z *testZone) valid(t *testing.T, rrs ...dns.RR) []dns.RR {
+	return z.sign(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), rrs...)
+}
+
+func newRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func newMsg(name string, qtype uint16, rcode int, answer, ns []dns.RR) *dns.Msg {
+	var msg = new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.Response, msg.Rcode, msg.Answer, msg.Ns = true, rcode, answer, ns
+	return msg
+}
+
+// newTestValidator return the validator of the hierarchy:
+// . signed, trust anchor
+// example. signed, delegated by DS
+// www.example. A 192.0.2.1, not a zone cut
+// insecure. unsigned delegation proven by NSEC
+func newTestValidator(t *testing.T) (*Validator, *testZone, *testZone) {
+	var root, example = newTestZone(t, "."), newTestZone(t, "example.")
+
+	var ds = example.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+
+	var responses = map[string]*dns.Msg{
+		". DNSKEY":        newMsg(".", dns.TypeDNSKEY, dns.RcodeSuccess, root.valid(t, root.key), nil),
+		"example. DS":     newMsg("example.", dns.TypeDS, dns.RcodeSuccess, root.valid(t, ds), nil),
+		"example. DNSKEY": newMsg("example.", dns.TypeDNSKEY, dns.RcodeSuccess, example.valid(t, example.key), nil),
+		"www.example. DS": newMsg("www.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+			example.valid(t, newRR(t, "www.example. 3600 IN NSEC example. A RRSIG NSEC"))),
+		"insecure. DS": newMsg("insecure.", dns.TypeDS, dns.RcodeSuccess, nil,
+			root.valid(t, newRR(t, "insecure. 3600 IN NSEC . NS RRSIG NSEC"))),
+	}
+
+	var anchor = filepath.Join(t.TempDir(), "root.key")
+	if err := os.WriteFile(anchor, []byte(root.key.ToDS(dns.SHA256).String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := New(Config{Enable: true, TrustAnchor: anchor}, func(_ context.Context, req *dns.Msg) *dns.Msg {
+		var q = req.Question[0]
+		return responses[q.Name+" "+dns.TypeToString[q.Qtype]]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, root, example
+}
+
+func TestValidate(t *testing.T) {
+	v, _, example := newTestValidator(t)
+
+	var a = newRR(t, "www.example. 300 IN A 192.0.2.1")
+	var forged = example.valid(t, dns.Copy(a))
+	forged[0].(*dns.A).A = []byte{192, 0, 2, 2}
+
+	var tests = []struct {
+		name     string
+		resp     *dns.Msg
+		security Security
+		code     uint16
+	}{
+		{"secure", newMsg("www.example.", dns.TypeA, dns.RcodeSuccess, example.valid(t, dns.Copy(a)), nil), Secure, 0},
+		{"forged", newMsg("www.example.", dns.TypeA, dns.RcodeSuccess, forged, nil), Bogus, dns.ExtendedErrorCodeDNSBogus},
+		{"unsigned", newMsg("www.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{dns.Copy(a)}, nil), Bogus, dns.ExtendedErrorCodeRRSIGsMissing},
+		{"expired", newMsg("www.example.", dns.TypeA, dns.RcodeSuccess,
+			example.sign(t, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour), dns.Copy(a)), nil), Bogus, dns.ExtendedErrorCodeSignatureExpired},
+		{"insecure", newMsg("www.insecure.", dns.TypeA, dns.RcodeSuccess, []dns.RR{newRR(t, "www.insecure. 300 IN A 192.0.2.3")}, nil), Insecure, 0},
+		{"nxdomain", newMsg("nope.example.", dns.TypeA, dns.RcodeNameError, nil,
+			example.valid(t, newRR(t, "example. 3600 IN NSEC www.example. NS SOA RRSIG NSEC DNSKEY"))), Secure, 0},
+		{"nxdomain without denial", newMsg("nope.example.", dns.TypeA, dns.RcodeNameError, nil,
+			example.valid(t, newRR(t, "example. 3600 IN SOA ns.example. admin.example. 1 3600 600 86400 300"))), Bogus, dns.ExtendedErrorCodeNSECMissing},
+		{"nodata", newMsg("www.example.", dns.TypeAAAA, dns.RcodeSuccess, nil,
+			example.valid(t, newRR(t, "www.example. 3600 IN NSEC example. A RRSIG NSEC"))), Secure, 0},
+		{"nodata denied type", newMsg("www.example.", dns.TypeA, dns.RcodeSuccess, nil,
+			example.valid(t, newRR(t, "www.example. 3600 IN NSEC example. A RRSIG NSEC"))), Bogus, dns.ExtendedErrorCodeNSECMissing},
+	}
+
+	for _, test := range tests {
+		security, ede := v.Validate(context.Background(), test.resp)
+		if security != test.security {
+			t.Errorf("%s: Validate() = %s %+v, want %s", test.name, security, ede, test.security)
+			continue
+		}
+		if test.security == Bogus && (ede == nil || ede.InfoCode != test.code) {
+			t.Errorf("%s: Validate() ede = %+v, want code %d", test.name, ede, test.code)
+		}
+	}
+}
+
+func TestAnchorsRollover(t *testing.T) {
+	var root, next = newTestZone(t, "."), newTestZone(t, ".")
+	var now = time.Now()
+	var state = filepath.Join(t.TempDir(), "dnssec.state")
+
+	var anchor = filepath.Join(t.TempDir(), "root.key")
+	if err := os.WriteFile(anchor, []byte(root.key.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	as, err := newAnchors(anchor, state, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys = rrsets(root.valid(t, root.key, next.key))[0]
+	if trusted := as.trusted(dnskeys(keys)); len(trusted) != 1 || trusted[0] != root.key {
+		t.Fatalf("trusted() = %v, want the root key only", trusted)
+	}
+
+	// the new key is trusted after the hold-down time
+	as.update(keys, now)
+	as.update(keys, now.Add(holdDown/2))
+	if trusted := as.trusted(dnskeys(keys)); len(trusted) != 1 {
+		t.Fatalf("trusted() in hold-down = %d keys, want 1", len(trusted))
+	}
+	as.update(keys, now.Add(holdDown))
+	if trusted := as.trusted(dnskeys(keys)); len(trusted) != 2 {
+		t.Fatalf("trusted() after hold-down = %d keys, want 2", len(trusted))
+	}
+
+	// the state survives the restart
+	if as, err = newAnchors(anchor, state, now); err != nil {
+		t.Fatal(err)
+	}
+	if trusted := as.trusted(dnskeys(keys)); len(trusted) != 2 {
+		t.Fatalf("trusted() after reload = %d keys, want 2", len(trusted))
+	}
+
+	// the old key is revoked by itself
+	var revoked = dns.Copy(root.key).(*dns.DNSKEY)
+	revoked.Flags |= dns.REVOKE
+	root.key = revoked
+	var set = rrsets(root.valid(t, revoked, next.key))[0]
+	as.update(set, now)
+	if trusted := as.trusted([]*dns.DNSKEY{keys.rrs[0].(*dns.DNSKEY), next.key}); len(trusted) != 1 || trusted[0] != next.key {
+		t.Fatalf("trusted() after revoked = %v, want the next key only", trusted)
+	}
+}
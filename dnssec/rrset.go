@@ -0,0 +1,86 @@
+package dnssec
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rrset the RRs of the same name and type with their signatures
+type rrset struct {
+	name   string // canonical
+	rrtype uint16
+	rrs    []dns.RR
+	sigs   []*dns.RRSIG
+}
+
+// ttl return the min ttl of the set
+func (set *rrset) ttl() time.Duration {
+	var ttl = set.rrs[0].Header().Ttl
+	for _, rr := range set.rrs {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// rrsets group the RRs of section by name and type, the RRSIGs are attached to
+// the set they covered, the RRSIGs cover nothing are dropped
+func rrsets(section []dns.RR) []*rrset {
+	var sets []*rrset
+	var index = func(name string, rrtype uint16) *rrset {
+		for _, set := range sets {
+			if set.name == name && set.rrtype == rrtype {
+				return set
+			}
+		}
+		return nil
+	}
+
+	for _, rr := range section {
+		if rr.Header().Rrtype == dns.TypeRRSIG || rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		var name = dns.CanonicalName(rr.Header().Name)
+		if set := index(name, rr.Header().Rrtype); set != nil {
+			set.rrs = append(set.rrs, rr)
+			continue
+		}
+		sets = append(sets, &rrset{name: name, rrtype: rr.Header().Rrtype, rrs: []dns.RR{rr}})
+	}
+
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if set := index(dns.CanonicalName(sig.Hdr.Name), sig.TypeCovered); set != nil {
+				set.sigs = append(set.sigs, sig)
+			}
+		}
+	}
+
+	return sets
+}
+
+// find return the set of name and rrtype in the answer section of resp, nil when not found
+func find(resp *dns.Msg, name string, rrtype uint16) *rrset {
+	if resp == nil {
+		return nil
+	}
+
+	name = dns.CanonicalName(name)
+	for _, set := range rrsets(resp.Answer) {
+		if set.name == name && set.rrtype == rrtype {
+			return set
+		}
+	}
+	return nil
+}
+
+func dnskeys(set *rrset) []*dns.DNSKEY {
+	var keys = make([]*dns.DNSKEY, 0, len(set.rrs))
+	for _, rr := range set.rrs {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,255 @@
+package filter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/metrics"
+	"github.com/treemana/godot/util"
+)
+
+const (
+	ttlDefault     = 60
+	refreshDefault = 24 * time.Hour
+
+	metricBlocked    = "filter_blocked"      // number of the requests blocked
+	metricRules      = "filter_rules"        // number of the rules of all the lists
+	metricListRules  = "filter_list_rules:"  // + list name, number of the rules of the list
+	metricListErrors = "filter_list_errors:" // + list name, number of the failed loads and downloads
+)
+
+// the answers of the blocked requests
+const (
+	ModeNXDomain = "nxdomain" // NXDOMAIN, the default
+	ModeNull     = "null"     // 0.0.0.0 for A, :: for AAAA, no answer for the others
+	ModeRefused  = "refused"  // REFUSED
+)
+
+// ListConfig represents a filter list
+type ListConfig struct {
+	// Name of the list in the logs and metrics, URL or File when empty
+	Name string `json:"name"`
+
+	// File the path of the list in hosts, domain or adblock format,
+	// the path of the last good copy downloaded when URL is set
+	File string `json:"file"`
+
+	// URL of the list downloaded every Config.Refresh, optional
+	URL string `json:"url"`
+}
+
+// Config represents the filter settings
+type Config struct {
+	// Mode the answer of the blocked requests, ModeNXDomain when empty
+	Mode string `json:"mode"`
+
+	// TTL of the ModeNull answers, second, 60 when zero
+	TTL uint32 `json:"ttl"`
+
+	// Refresh the interval(minute) of downloading the URL lists, 1440 when zero
+	Refresh int `json:"refresh"`
+
+	// Lists the filter lists, the filter is disabled when empty
+	Lists []ListConfig `json:"lists"`
+}
+
+// Filter answer the requests of the blocked names
+type Filter struct {
+	mode    string
+	ttl     uint32
+	refresh time.Duration
+	lists   []*list
+
+	// tries the compiled matchers of the lists in order, nil for the list not
+	// downloaded yet, swapped when a list changed
+	tries atomic.Pointer[[]*trie]
+	mutex sync.Mutex // serialize the compiling
+}
+
+// New return nil when there is no list, the URL lists are loaded from their
+// last good copies, and downloaded after Start
+func New(config Config) (*Filter, error) {
+	if len(config.Lists) == 0 {
+		return nil, nil
+	}
+
+	var f = &Filter{
+		mode:    config.Mode,
+		ttl:     config.TTL,
+		refresh: time.Minute * time.Duration(config.Refresh),
+	}
+	switch f.mode {
+	case "":
+		f.mode = ModeNXDomain
+	case ModeNXDomain, ModeNull, ModeRefused:
+	default:
+		return nil, fmt.Errorf("unknown filter mode %s", f.mode)
+	}
+	if f.ttl == 0 {
+		f.ttl = ttlDefault
+	}
+	if f.refresh <= 0 {
+		f.refresh = refreshDefault
+	}
+
+	for _, c := range config.Lists {
+		l, err := newList(c)
+		if err != nil {
+			return nil, err
+		}
+		f.lists = append(f.lists, l)
+	}
+
+	if err := f.compile(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// compile parse all the lists into a new matcher and swap it in,
+// the old one is kept when a local list failed, the URL list not downloaded
+// yet is skipped
+func (f *Filter) compile() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var tries = make([]*trie, len(f.lists))
+	var total int
+	for i, l := range f.lists {
+		var t = newTrie()
+		rules, err := l.load(t)
+		if err != nil {
+			if len(l.url) > 0 && errors.Is(err, os.ErrNotExist) {
+				log.Sugar.Warnf("filter list %s not downloaded yet", l.name)
+				continue
+			}
+			metrics.Add(metricListErrors+l.name, 1)
+			return fmt.Errorf("filter list %s error=[%+v]", l.name, err)
+		}
+		metrics.Set(metricListRules+l.name, int64(rules))
+		total += rules
+		tries[i] = t
+	}
+
+	f.tries.Store(&tries)
+	metrics.Set(metricRules, int64(total))
+	log.Sugar.Infof("filter compiled, rules %d", total)
+	return nil
+}
+
+// Start download the URL lists now and every refresh interval until ctx done,
+// the matcher is swapped when any of them changed
+func (f *Filter) Start(ctx context.Context) {
+	if f == nil || !slices.ContainsFunc(f.lists, func(l *list) bool { return len(l.url) > 0 }) {
+		return
+	}
+
+	go func() {
+		var ticker = time.NewTicker(f.refresh)
+		defer ticker.Stop()
+
+		for {
+			f.update(ctx)
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// update download the URL lists, compile them when any of them changed
+func (f *Filter) update(ctx context.Context) {
+	var changed bool
+	for _, l := range f.lists {
+		if len(l.url) == 0 {
+			continue
+		}
+
+		ok, err := l.download(ctx)
+		if err != nil {
+			metrics.Add(metricListErrors+l.name, 1)
+			log.Sugar.Errorf("filter list %s download error=[%+v], the last good copy is kept", l.name, err)
+			continue
+		}
+		changed = changed || ok
+	}
+
+	if !changed {
+		return
+	}
+
+	if err := f.compile(); err != nil {
+		log.Sugar.Errorf("filter compile error=[%+v], the old matcher is kept", err)
+	}
+}
+
+// HasList report whether the list name exists
+func (f *Filter) HasList(name string) bool {
+	return f != nil && slices.ContainsFunc(f.lists, func(l *list) bool { return l.name == name })
+}
+
+// match report whether name is blocked by the lists of names, all the lists
+// when names is nil, the allow rules of any of them win
+func (f *Filter) match(name string, names []string) bool {
+	var flags uint8
+	for i, t := range *f.tries.Load() {
+		if names == nil || slices.Contains(names, f.lists[i].name) {
+			flags |= t.lookup(name)
+		}
+	}
+	return blocked(flags)
+}
+
+// Answer return the response of req when its name is blocked by the lists of
+// names, otherwise nil, all the lists are applied when names is nil
+func (f *Filter) Answer(req *dns.Msg, names []string) *dns.Msg {
+	if f == nil || len(req.Question) == 0 {
+		return nil
+	}
+
+	var q = req.Question[0]
+	if !f.match(util.DomainNormalize(q.Name), names) {
+		return nil
+	}
+
+	metrics.Add(metricBlocked, 1)
+
+	var resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+
+	switch f.mode {
+	case ModeRefused:
+		resp.Rcode = dns.RcodeRefused
+	case ModeNull:
+		var hdr = dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: q.Qclass, Ttl: f.ttl}
+		switch q.Qtype {
+		case dns.TypeA:
+			resp.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+		case dns.TypeAAAA:
+			resp.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+		}
+	default:
+		resp.Rcode = dns.RcodeNameError
+	}
+
+	if req.IsEdns0() != nil {
+		util.DNSSetEDE(resp, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked})
+	}
+
+	return resp
+}
@@ -0,0 +1,258 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/metrics"
+)
+
+func TestMain(m *testing.M) {
+	_ = log.Init(log.Config{STDOUT: true, Level: 1})
+	os.Exit(m.Run())
+}
+
+const testList = `
+# hosts
+0.0.0.0 ads.example tracker.example # inline comment
+127.0.0.1 localhost
+::1 ip6-localhost
+
+! domains
+malware.example
+*.wild.example
+
+[Adblock Plus 2.0]
+||adblock.example^
+|exact.example^
+@@||good.ads.example^
+@@||ok.adblock.example^
+||modifier.example^$third-party
+||path.example/ads
+`
+
+func TestParse(t *testing.T) {
+	var tr = newTrie()
+	rules, ignored, err := parse(strings.NewReader(testList), tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules != 8 || ignored != 2 {
+		t.Errorf("parse() = %d rules, %d ignored, want 8, 2", rules, ignored)
+	}
+
+	var tests = []struct {
+		name    string
+		blocked bool
+	}{
+		{"ads.example", true},
+		{"sub.ads.example", false}, // hosts names only
+		{"good.ads.example", false},
+		{"tracker.example", true},
+		{"localhost", false},
+		{"malware.example", true},
+		{"a.b.malware.example", true},
+		{"wild.example", false},
+		{"x.wild.example", true},
+		{"adblock.example", true},
+		{"www.adblock.example", true},
+		{"ok.adblock.example", false},
+		{"www.ok.adblock.example", false},
+		{"exact.example", true},
+		{"www.exact.example", false},
+		{"modifier.example", false},
+		{"path.example", false},
+		{"example", false},
+	}
+	for _, test := range tests {
+		if got := tr.match(test.name); got != test.blocked {
+			t.Errorf("match(%s) = %t, want %t", test.name, got, test.blocked)
+		}
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	var file = filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(file, []byte(testList), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		mode   string
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{"", dns.TypeA, dns.RcodeNameError, ""},
+		{ModeRefused, dns.TypeA, dns.RcodeRefused, ""},
+		{ModeNull, dns.TypeA, dns.RcodeSuccess, "0.0.0.0"},
+		{ModeNull, dns.TypeAAAA, dns.RcodeSuccess, "::"},
+		{ModeNull, dns.TypeMX, dns.RcodeSuccess, ""},
+	}
+
+	for _, test := range tests {
+		f, err := New(Config{Mode: test.mode, Lists: []ListConfig{{File: file}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var req = new(dns.Msg)
+		req.SetQuestion("WWW.Adblock.Example.", test.qtype)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+
+		var resp = f.Answer(req, nil)
+		if resp == nil || resp.Rcode != test.rcode {
+			t.Errorf("%s %s: Answer() = %v, want rcode %s", test.mode, dns.TypeToString[test.qtype], resp, dns.RcodeToString[test.rcode])
+			continue
+		}
+		if ip := answer(resp); ip != test.answer {
+			t.Errorf("%s %s: Answer() answer = %s, want %s", test.mode, dns.TypeToString[test.qtype], ip, test.answer)
+		}
+		if opt := resp.IsEdns0(); opt == nil || len(opt.Option) != 1 {
+			t.Errorf("%s %s: Answer() without the extended DNS error", test.mode, dns.TypeToString[test.qtype])
+		}
+
+		req.SetQuestion("ok.adblock.example.", test.qtype)
+		if resp = f.Answer(req, nil); resp != nil {
+			t.Errorf("%s: Answer() of the allowed name = %v", test.mode, resp)
+		}
+	}
+
+	if f, err := New(Config{}); f != nil || err != nil {
+		t.Errorf("New() without list = %v, %v, want nil", f, err)
+	}
+}
+
+func TestLists(t *testing.T) {
+	var dir = t.TempDir()
+	var ads, social = filepath.Join(dir, "ads.txt"), filepath.Join(dir, "social.txt")
+	if err := os.WriteFile(ads, []byte("ads.example\n@@||ok.social.example^\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(social, []byte("social.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := New(Config{Lists: []ListConfig{{Name: "ads", File: ads}, {Name: "social", File: social}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.HasList("social") || f.HasList("unknown") {
+		t.Error("HasList() of the names configured is wrong")
+	}
+
+	var tests = []struct {
+		name    string
+		lists   []string
+		blocked bool
+	}{
+		{"ads.example.", nil, true},
+		{"social.example.", nil, true},
+		{"ok.social.example.", nil, false},
+		{"ads.example.", []string{"social"}, false},
+		{"social.example.", []string{"social"}, true},
+		{"ok.social.example.", []string{"social"}, true},
+		{"ads.example.", []string{}, false},
+	}
+
+	for _, test := range tests {
+		var req = new(dns.Msg)
+		req.SetQuestion(test.name, dns.TypeA)
+		if got := f.Answer(req, test.lists) != nil; got != test.blocked {
+			t.Errorf("Answer(%s, %v) blocked = %t, want %t", test.name, test.lists, got, test.blocked)
+		}
+	}
+}
+
+func answer(resp *dns.Msg) string {
+	if len(resp.Answer) == 0 {
+		return ""
+	}
+	switch rr := resp.Answer[0].(type) {
+	case *dns.A:
+		return rr.A.String()
+	case *dns.AAAA:
+		return rr.AAAA.String()
+	}
+	return resp.Answer[0].String()
+}
+
+func TestDownload(t *testing.T) {
+	var body = "||ads.example^\n"
+	var requests, notModified int
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		var etag = fmt.Sprintf("%q", body)
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	var file = filepath.Join(t.TempDir(), "list.txt")
+	var config = Config{Lists: []ListConfig{{Name: "ads", File: file, URL: server.URL}}}
+
+	// not downloaded yet, nothing blocked
+	f, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isBlocked(f, "ads.example") {
+		t.Fatal("blocked before downloaded")
+	}
+
+	f.update(context.Background())
+	if !isBlocked(f, "ads.example") || metrics.Get(metricListRules+"ads") != 1 {
+		t.Fatalf("not blocked after downloaded, rules %d", metrics.Get(metricListRules+"ads"))
+	}
+
+	// not modified
+	f.update(context.Background())
+	if notModified != 1 {
+		t.Errorf("conditional requests = %d not modified, want 1", notModified)
+	}
+
+	// the list without rule is not used
+	body = "<html>error</html>\n"
+	f.update(context.Background())
+	if !isBlocked(f, "ads.example") || metrics.Get(metricListErrors+"ads") != 1 {
+		t.Errorf("the last good copy is not kept, errors %d", metrics.Get(metricListErrors+"ads"))
+	}
+
+	body = "||tracker.example^\n"
+	f.update(context.Background())
+	if isBlocked(f, "ads.example") || !isBlocked(f, "tracker.example") {
+		t.Error("the updated list is not swapped in")
+	}
+
+	// restarted with the last good copy and its validators
+	server.Close()
+	if f, err = New(config); err != nil {
+		t.Fatal(err)
+	}
+	if !isBlocked(f, "tracker.example") || f.lists[0].meta.ETag != fmt.Sprintf("%q", body) {
+		t.Errorf("the last good copy is not loaded, etag %s", f.lists[0].meta.ETag)
+	}
+	if requests != 4 {
+		t.Errorf("requests = %d, want 4", requests)
+	}
+}
+
+func isBlocked(f *Filter, name string) bool {
+	var req = new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	return f.Answer(req, nil) != nil
+}
@@ -0,0 +1,160 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/treemana/godot/log"
+)
+
+const (
+	downloadTimeout = time.Minute
+	maxListSize     = 64 << 20 // the max size of a downloaded list
+	metaSuffix      = ".meta"  // the suffix of the validators file of the downloaded copy
+)
+
+var client = &http.Client{Timeout: downloadTimeout}
+
+// list a filter list, loaded from the file, downloaded to the file when url is set
+type list struct {
+	name string
+	file string
+	url  string
+
+	// the validators of the downloaded copy, persisted to file+metaSuffix
+	meta meta
+}
+
+// meta the HTTP validators of the downloaded copy
+type meta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func newList(c ListConfig) (*list, error) {
+	if len(c.File) == 0 {
+		return nil, fmt.Errorf("filter list %s%s without file", c.Name, c.URL)
+	}
+
+	var l = &list{name: c.Name, file: c.File, url: c.URL}
+	if len(l.name) == 0 {
+		l.name = l.url
+	}
+	if len(l.name) == 0 {
+		l.name = l.file
+	}
+
+	if len(l.url) > 0 {
+		if raw, err := os.ReadFile(l.file + metaSuffix); err == nil {
+			if err = json.Unmarshal(raw, &l.meta); err != nil {
+				log.Sugar.Warnf("filter list %s meta error=[%+v]", l.name, err)
+			}
+		}
+	}
+
+	return l, nil
+}
+
+// load parse the file into t, return the number of the rules
+func (l *list) load(t *trie) (int, error) {
+	r, err := os.Open(l.file)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = r.Close() }()
+
+	rules, ignored, err := parse(r, t)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Sugar.Infof("filter list %s rules %d, ignored %d", l.name, rules, ignored)
+	return rules, nil
+}
+
+// download the url to the file when it is modified, report whether the file changed,
+// the download without any rule is an error, the file is kept
+func (l *list) download(ctx context.Context) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.url, nil)
+	if err != nil {
+		return false, err
+	}
+
+	// the conditional request only when the copy exists
+	if _, err = os.Stat(l.file); err == nil {
+		if len(l.meta.ETag) > 0 {
+			req.Header.Set("If-None-Match", l.meta.ETag)
+		}
+		if len(l.meta.LastModified) > 0 {
+			req.Header.Set("If-Modified-Since", l.meta.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		log.Sugar.Debugf("filter list %s not modified", l.name)
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("http status %s", resp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxListSize+1))
+	if err != nil {
+		return false, err
+	}
+	if len(raw) > maxListSize {
+		return false, fmt.Errorf("larger than %d bytes", maxListSize)
+	}
+
+	rules, _, err := parse(bytes.NewReader(raw), newTrie())
+	if err != nil {
+		return false, err
+	}
+	if rules == 0 {
+		return false, errors.New("no rule")
+	}
+
+	if err = write(l.file, raw); err != nil {
+		return false, err
+	}
+
+	l.meta = meta{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	if err = l.saveMeta(); err != nil {
+		// the next download is not conditional
+		log.Sugar.Warnf("filter list %s meta error=[%+v]", l.name, err)
+	}
+
+	log.Sugar.Infof("filter list %s downloaded, %d bytes", l.name, len(raw))
+	return true, nil
+}
+
+func (l *list) saveMeta() error {
+	raw, err := json.Marshal(l.meta)
+	if err != nil {
+		return err
+	}
+	return write(l.file+metaSuffix, raw)
+}
+
+// write the file by renaming a temporary file, the readers never see a partial one
+func write(file string, raw []byte) error {
+	var tmp = file + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,135 @@
+package filter
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/util"
+)
+
+// hostsIgnored the names of the hosts file which are not blocked
+var hostsIgnored = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// rule a parsed rule, flags of name
+type rule struct {
+	name  string
+	flags uint8
+}
+
+// parse read the rules of the list into t, return the number of the rules
+// added and the lines ignored
+//
+//	0.0.0.0 ads.example       hosts, the names only
+//	ads.example               domain, the name and its subdomains
+//	*.ads.example             domain, the subdomains only
+//	||ads.example^            adblock, the name and its subdomains
+//	|ads.example^             adblock, the name only
+//	@@||ads.example^          adblock exception, the name and its subdomains allowed
+//
+// the comments start with '#' or '!', the adblock rules with modifiers '$' or
+// paths are not supported and ignored
+func parse(r io.Reader, t *trie) (rules, ignored int, err error) {
+	var scanner = bufio.NewScanner(r)
+	for scanner.Scan() {
+		var line = strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		parsed, ok := parseLine(line)
+		if !ok {
+			ignored++
+			continue
+		}
+
+		for _, r := range parsed {
+			t.add(r.name, r.flags)
+		}
+		rules += len(parsed)
+	}
+	return rules, ignored, scanner.Err()
+}
+
+func parseLine(line string) ([]rule, bool) {
+	// the inline comment
+	if i := strings.Index(line, " #"); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+
+	var fields = strings.Fields(line)
+	if len(fields) > 1 {
+		return parseHosts(fields)
+	}
+
+	line = fields[0]
+	var flags uint8 = block
+	if strings.HasPrefix(line, "@@") {
+		line, flags = line[2:], allow
+	}
+
+	switch {
+	case strings.HasPrefix(line, "||"):
+		line = strings.TrimSuffix(strings.TrimSuffix(line[2:], "|"), "^")
+	case strings.HasPrefix(line, "|"):
+		line = strings.TrimSuffix(strings.TrimSuffix(line[1:], "|"), "^")
+		flags &= blockExact | allowExact
+	case strings.HasPrefix(line, "*."):
+		line = line[2:]
+		flags &= blockSub | allowSub
+	}
+
+	name, ok := domain(line)
+	if !ok {
+		return nil, false
+	}
+	return []rule{{name: name, flags: flags}}, true
+}
+
+// parseHosts return the names of the hosts line "ip name [name...]"
+func parseHosts(fields []string) ([]rule, bool) {
+	if net.ParseIP(fields[0]) == nil {
+		return nil, false
+	}
+
+	var rules = make([]rule, 0, len(fields)-1)
+	for _, field := range fields[1:] {
+		name, ok := domain(field)
+		if !ok {
+			return nil, false
+		}
+		if hostsIgnored[name] {
+			continue
+		}
+		rules = append(rules, rule{name: name, flags: blockExact})
+	}
+	return rules, true
+}
+
+// domain return the normalized name, false when raw is not a domain name
+func domain(raw string) (string, bool) {
+	if len(raw) == 0 || strings.ContainsAny(raw, "/*^|$@:") || net.ParseIP(raw) != nil {
+		return "", false
+	}
+	if _, ok := dns.IsDomainName(raw); !ok {
+		return "", false
+	}
+
+	var name = util.DomainNormalize(raw)
+	return name, len(name) > 0
+}
@@ -0,0 +1,89 @@
+package filter
+
+import "strings"
+
+// rule flags of a trie node
+const (
+	blockExact uint8 = 1 << iota // the name itself is blocked
+	blockSub                     // the subdomains of the name are blocked
+	allowExact                   // the name itself is allowed
+	allowSub                     // the subdomains of the name are allowed
+
+	block = blockExact | blockSub
+	allow = allowExact | allowSub
+)
+
+// trie the domain suffix trie, the children are keyed by the labels from the
+// top level domain, "www.example.com" is root -> com -> example -> www
+type trie struct {
+	children map[string]*trie
+	flags    uint8
+}
+
+func newTrie() *trie { return &trie{} }
+
+// add the flags to name, name should be normalized
+func (t *trie) add(name string, flags uint8) {
+	var n = t
+	for rest := name; ; {
+		i := strings.LastIndexByte(rest, '.')
+
+		if n.children == nil {
+			n.children = make(map[string]*trie)
+		}
+		child, ok := n.children[rest[i+1:]]
+		if !ok {
+			child = &trie{}
+			n.children[rest[i+1:]] = child
+		}
+		n = child
+
+		if i < 0 {
+			break
+		}
+		rest = rest[:i]
+	}
+	n.flags |= flags
+}
+
+// match report whether name is blocked, the allow rules win,
+// name should be normalized
+func (t *trie) match(name string) bool {
+	return blocked(t.lookup(name))
+}
+
+// blocked report whether the matched flags block the name, the allow rules win
+func blocked(flags uint8) bool {
+	return flags&block != 0 && flags&allow == 0
+}
+
+// lookup return the flags of the rules matched name, name should be normalized
+func (t *trie) lookup(name string) uint8 {
+	if t == nil || len(name) == 0 {
+		return 0
+	}
+
+	var flags uint8
+	var n = t
+	for rest := name; ; {
+		i := strings.LastIndexByte(rest, '.')
+
+		child, ok := n.children[rest[i+1:]]
+		if !ok {
+			break
+		}
+		n = child
+
+		// the whole name matched
+		if i < 0 {
+			flags |= n.flags & (blockExact | allowExact)
+			break
+		}
+
+		// a parent domain of the name matched
+		flags |= n.flags & (blockSub | allowSub)
+		rest = rest[:i]
+	}
+
+	return flags
+}
@@ -6,6 +6,7 @@ require (
 	github.com/miekg/dns v1.1.63
 	github.com/natefinch/lumberjack v2.0.0+incompatible
 	go.uber.org/zap v1.27.0
+	golang.org/x/crypto v0.51.0
 	golang.org/x/net v0.55.0
 )
 
@@ -0,0 +1,221 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/metrics"
+)
+
+const (
+	ttlDefault   = 300
+	watchDefault = 5 * time.Second
+	maxChain     = 8 // the max length of the local CNAME chain
+
+	metricAnswered = "local_answered" // number of the requests answered by the local records
+)
+
+// Config represents the local records settings
+type Config struct {
+	// TTL of the records without one and the hosts file records, second, 300 when zero
+	TTL uint32 `json:"ttl"`
+
+	// Entries the A, AAAA, CNAME, TXT and PTR records in the zone file format,
+	// "nas.lan A 192.168.1.10", the relative names are in the root
+	Entries []string `json:"entries"`
+
+	// Hosts the path of the /etc/hosts style file, optional
+	Hosts string `json:"hosts"`
+
+	// Watch the interval(second) of checking the hosts file changes, 5 when zero
+	Watch int `json:"watch"`
+}
+
+// Records answer the requests of the local names
+type Records struct {
+	ttl     uint32
+	entries []dns.RR
+	hosts   string
+	watch   time.Duration
+
+	table atomic.Pointer[table]
+
+	// the modification time and size of the hosts file loaded
+	modTime time.Time
+	size    int64
+}
+
+// New return nil when there is no entry and no hosts file
+func New(config Config) (*Records, error) {
+	if len(config.Entries) == 0 && len(config.Hosts) == 0 {
+		return nil, nil
+	}
+
+	var r = &Records{
+		ttl:   config.TTL,
+		hosts: config.Hosts,
+		watch: time.Second * time.Duration(config.Watch),
+	}
+	if r.ttl == 0 {
+		r.ttl = ttlDefault
+	}
+	if r.watch <= 0 {
+		r.watch = watchDefault
+	}
+
+	var err error
+	if r.entries, err = parseRecords(config.Entries, r.ttl); err != nil {
+		return nil, fmt.Errorf("local records error=[%+v]", err)
+	}
+
+	if err = r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// load build the table of the entries and the hosts file, and swap it in
+func (r *Records) load() error {
+	var t = newTable()
+	for _, rr := range r.entries {
+		if err := t.add(dns.Copy(rr)); err != nil {
+			return fmt.Errorf("local records error=[%+v]", err)
+		}
+	}
+
+	if len(r.hosts) > 0 {
+		f, err := os.Open(r.hosts)
+		if err != nil {
+			return fmt.Errorf("local hosts %s error=[%+v]", r.hosts, err)
+		}
+		defer func() { _ = f.Close() }()
+
+		info, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("local hosts %s error=[%+v]", r.hosts, err)
+		}
+
+		rrs, ignored, err := parseHosts(f, r.ttl)
+		if err != nil {
+			return fmt.Errorf("local hosts %s error=[%+v]", r.hosts, err)
+		}
+
+		// the entries win
+		for _, rr := range rrs {
+			if err = t.add(rr); err != nil {
+				log.Sugar.Warnf("local hosts %s ignored, error=[%+v]", r.hosts, err)
+				ignored++
+			}
+		}
+
+		r.modTime, r.size = info.ModTime(), info.Size()
+		log.Sugar.Infof("local hosts %s records %d, ignored %d", r.hosts, len(rrs), ignored)
+	}
+
+	t.reverse()
+
+	r.table.Store(t)
+	return nil
+}
+
+// Start reload the hosts file when it changed until ctx done,
+// the old records are kept when the reloading failed
+func (r *Records) Start(ctx context.Context) {
+	if r == nil || len(r.hosts) == 0 {
+		return
+	}
+
+	go func() {
+		var ticker = time.NewTicker(r.watch)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				info, err := os.Stat(r.hosts)
+				if err != nil {
+					log.Sugar.Warnf("local hosts %s error=[%+v]", r.hosts, err)
+					continue
+				}
+				if info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+					continue
+				}
+
+				if err = r.load(); err != nil {
+					log.Sugar.Errorf("%+v, the old records are kept", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Answer return the response of req when its name is local, otherwise nil
+// return the CNAME chain when it ends at a name not local, the request should
+// be redirected to its target
+func (r *Records) Answer(req *dns.Msg) (*dns.Msg, []dns.RR) {
+	if r == nil || len(req.Question) == 0 || req.Question[0].Qclass != dns.ClassINET {
+		return nil, nil
+	}
+
+	var t = r.table.Load()
+	var q = req.Question[0]
+	var alias []dns.RR
+	for name := q.Name; len(alias) < maxChain; {
+		rrs, ok := t.lookup(name)
+		if !ok {
+			if len(alias) == 0 {
+				return nil, nil
+			}
+			return nil, alias
+		}
+
+		var answer = owned(rrs, name, q.Qtype)
+		if len(answer) > 0 || q.Qtype == dns.TypeCNAME {
+			return respond(req, append(alias, answer...)), nil
+		}
+
+		// NODATA, the name is local
+		var cname = owned(rrs, name, dns.TypeCNAME)
+		if len(cname) == 0 {
+			return respond(req, alias), nil
+		}
+
+		alias = append(alias, cname[0])
+		name = cname[0].(*dns.CNAME).Target
+	}
+
+	log.Sugar.Warnf("local CNAME chain of %s longer than %d", q.Name, maxChain)
+	return respond(req, alias), nil
+}
+
+// owned return the copies of the records of qtype, owned by name
+func owned(rrs []dns.RR, name string, qtype uint16) []dns.RR {
+	var answer []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			answer = append(answer, rr)
+		}
+	}
+	return answer
+}
+
+func respond(req *dns.Msg, answer []dns.RR) *dns.Msg {
+	metrics.Add(metricAnswered, 1)
+
+	var resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	resp.Answer = answer
+	return resp
+}
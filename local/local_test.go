@@ -0,0 +1,124 @@
+package local
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+)
+
+func TestMain(m *testing.M) {
+	_ = log.Init(log.Config{STDOUT: true, Level: 1})
+	os.Exit(m.Run())
+}
+
+func query(r *Records, name string, qtype uint16) (*dns.Msg, []dns.RR) {
+	var req = new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	return r.Answer(req)
+}
+
+// answers return the answers in the presentation format without the ttl
+func answers(rrs []dns.RR) string {
+	var list []string
+	for _, rr := range rrs {
+		var fields = strings.Fields(rr.String())
+		list = append(list, fields[0]+" "+strings.Join(fields[2:], " "))
+	}
+	return strings.Join(list, ", ")
+}
+
+func TestAnswer(t *testing.T) {
+	var hosts = filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(hosts, []byte("192.168.1.20 printer.lan printer # comment\n::1 localhost\nbad line\n192.168.1.10 other.lan\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(Config{Hosts: hosts, Entries: []string{
+		"nas.lan A 192.168.1.10",
+		"nas.lan 60 TXT \"hello\"",
+		"*.dev.lan A 192.168.1.30",
+		"www.lan CNAME nas.lan.",
+		"cdn.lan CNAME cdn.example.",
+		"20.1.168.192.in-addr.arpa PTR print-server.lan.",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name   string
+		qtype  uint16
+		answer string
+		alias  string
+	}{
+		{"NAS.lan.", dns.TypeA, "NAS.lan. IN A 192.168.1.10", ""},
+		{"nas.lan.", dns.TypeTXT, "nas.lan. IN TXT \"hello\"", ""},
+		{"nas.lan.", dns.TypeAAAA, "", ""},
+		{"a.b.dev.lan.", dns.TypeA, "a.b.dev.lan. IN A 192.168.1.30", ""},
+		{"dev.lan.", dns.TypeA, "", "none"},
+		{"www.lan.", dns.TypeA, "www.lan. IN CNAME nas.lan., nas.lan. IN A 192.168.1.10", ""},
+		{"www.lan.", dns.TypeCNAME, "www.lan. IN CNAME nas.lan.", ""},
+		{"cdn.lan.", dns.TypeA, "", "cdn.lan. IN CNAME cdn.example."},
+		{"printer.", dns.TypeA, "printer. IN A 192.168.1.20", ""},
+		{"localhost.", dns.TypeAAAA, "localhost. IN AAAA ::1", ""},
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, "10.1.168.192.in-addr.arpa. IN PTR nas.lan.", ""},
+		{"20.1.168.192.in-addr.arpa.", dns.TypePTR, "20.1.168.192.in-addr.arpa. IN PTR print-server.lan.", ""},
+		{"example.com.", dns.TypeA, "", "none"},
+	}
+
+	for _, test := range tests {
+		resp, alias := query(r, test.name, test.qtype)
+		switch {
+		case test.alias == "none":
+			if resp != nil || alias != nil {
+				t.Errorf("%s %s: Answer() = %v %v, want nil", test.name, dns.TypeToString[test.qtype], resp, alias)
+			}
+		case len(test.alias) > 0:
+			if resp != nil || answers(alias) != test.alias {
+				t.Errorf("%s %s: Answer() alias = [%s], want [%s]", test.name, dns.TypeToString[test.qtype], answers(alias), test.alias)
+			}
+		case resp == nil:
+			t.Errorf("%s %s: Answer() = nil, want [%s]", test.name, dns.TypeToString[test.qtype], test.answer)
+		case answers(resp.Answer) != test.answer:
+			t.Errorf("%s %s: Answer() = [%s], want [%s]", test.name, dns.TypeToString[test.qtype], answers(resp.Answer), test.answer)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	var hosts = filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(hosts, []byte("192.168.1.20 printer.lan\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(Config{Hosts: hosts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.watch = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Start(ctx)
+
+	if err = os.WriteFile(hosts, []byte("192.168.1.21 printer.lan\n192.168.1.22 scanner.lan\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if resp, _ := query(r, "scanner.lan.", dns.TypeA); resp != nil {
+			if resp, _ = query(r, "printer.lan.", dns.TypeA); answers(resp.Answer) != "printer.lan. IN A 192.168.1.21" {
+				t.Errorf("Answer() after reloaded = [%s]", answers(resp.Answer))
+			}
+			return
+		}
+	}
+	t.Error("the hosts file is not reloaded")
+}
@@ -0,0 +1,161 @@
+package local
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// types the record types answered locally
+var types = map[uint16]bool{
+	dns.TypeA:     true,
+	dns.TypeAAAA:  true,
+	dns.TypeCNAME: true,
+	dns.TypeTXT:   true,
+	dns.TypePTR:   true,
+}
+
+// table the local records by the canonical owner name,
+// the wildcard owner is "*.parent."
+type table struct {
+	names map[string][]dns.RR
+	ptrs  map[string]bool // the owners of the explicit PTR records
+	list  []dns.RR        // all the records in the order added
+}
+
+func newTable() *table {
+	return &table{names: make(map[string][]dns.RR), ptrs: make(map[string]bool)}
+}
+
+// add rr, return error when the type is not supported or a CNAME conflicts
+// with other records of the same name
+func (t *table) add(rr dns.RR) error {
+	var hdr = rr.Header()
+	if !types[hdr.Rrtype] || hdr.Class != dns.ClassINET {
+		return fmt.Errorf("%s unsupported type", rr)
+	}
+
+	hdr.Name = dns.CanonicalName(hdr.Name)
+	for _, x := range t.names[hdr.Name] {
+		if dns.IsDuplicate(x, rr) {
+			return nil
+		}
+		if x.Header().Rrtype == dns.TypeCNAME || hdr.Rrtype == dns.TypeCNAME {
+			return fmt.Errorf("%s conflicts with %s", rr, x)
+		}
+	}
+
+	t.names[hdr.Name] = append(t.names[hdr.Name], rr)
+	t.list = append(t.list, rr)
+	if hdr.Rrtype == dns.TypePTR {
+		t.ptrs[hdr.Name] = true
+	}
+	return nil
+}
+
+// reverse add the PTR records of the A and AAAA records except the wildcard ones,
+// unless the reverse name has an explicit PTR record, the first name of an address wins
+func (t *table) reverse() {
+	for _, rr := range t.list {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		var hdr = rr.Header()
+		if strings.HasPrefix(hdr.Name, "*.") {
+			continue
+		}
+
+		name, err := dns.ReverseAddr(ip.String())
+		if err != nil || t.ptrs[name] || len(t.names[name]) > 0 {
+			continue
+		}
+
+		t.names[name] = []dns.RR{&dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: hdr.Ttl},
+			Ptr: hdr.Name,
+		}}
+	}
+}
+
+// lookup return the records of name, the exact name first, then the most
+// specific wildcard, false when nothing matched
+func (t *table) lookup(name string) ([]dns.RR, bool) {
+	name = dns.CanonicalName(name)
+	if rrs, ok := t.names[name]; ok {
+		return rrs, true
+	}
+
+	for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+		if rrs, ok := t.names["*."+name[i:]]; ok {
+			return rrs, true
+		}
+	}
+	return nil, false
+}
+
+// parseRecords return the records of the zone file lines, the relative names
+// are in the root, ttl is used when a record has none
+func parseRecords(lines []string, ttl uint32) ([]dns.RR, error) {
+	var parser = dns.NewZoneParser(strings.NewReader(strings.Join(lines, "\n")), ".", "records")
+	parser.SetDefaultTTL(ttl)
+
+	var rrs []dns.RR
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		rrs = append(rrs, rr)
+	}
+	return rrs, parser.Err()
+}
+
+// parseHosts return the A and AAAA records of the hosts file lines "ip name [alias...]",
+// the invalid lines are ignored
+func parseHosts(r io.Reader, ttl uint32) ([]dns.RR, int, error) {
+	var rrs []dns.RR
+	var ignored int
+
+	var scanner = bufio.NewScanner(r)
+	for scanner.Scan() {
+		var line = scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		var fields = strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var ip = net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			ignored++
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			if _, ok := dns.IsDomainName(name); !ok {
+				ignored++
+				continue
+			}
+
+			var hdr = dns.RR_Header{Name: dns.CanonicalName(name), Class: dns.ClassINET, Ttl: ttl}
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+				continue
+			}
+			hdr.Rrtype = dns.TypeAAAA
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return rrs, ignored, scanner.Err()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -11,10 +12,20 @@ import (
 
 	"github.com/miekg/dns"
 
+	"github.com/treemana/godot/clients"
+	"github.com/treemana/godot/dnssec"
+	"github.com/treemana/godot/filter"
+	"github.com/treemana/godot/local"
 	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/metrics"
+	"github.com/treemana/godot/publicip"
+	"github.com/treemana/godot/rebind"
+	"github.com/treemana/godot/rewrite"
+	"github.com/treemana/godot/rpz"
 	"github.com/treemana/godot/udp"
 	"github.com/treemana/godot/upstream"
 	"github.com/treemana/godot/util"
+	"github.com/treemana/godot/zone"
 )
 
 // Option represents console arguments.  For further additions, please do not
@@ -28,10 +39,16 @@ type Option struct {
 	} `json:"log"`
 
 	Server struct {
-		Address string `json:"address"`
-		Port    int    `json:"port"`
+		Address  string `json:"address"`
+		Port     int    `json:"port"`
+		Queue    int    `json:"queue"`    // max number of pending requests
+		Deadline int    `json:"deadline"` // query deadline, millisecond
 	} `json:"server"`
 
+	Metrics struct {
+		Address string `json:"address"` // metrics http address, disabled if empty
+	} `json:"metrics"`
+
 	// CacheTTR cache time to refresh, number of minute
 	// cache will be disabled if zero
 	CacheTTR uint64 `json:"cache_ttr"`
@@ -39,15 +56,60 @@ type Option struct {
 	// upstream DNS resolvers
 	Resolvers [][]string `json:"resolvers"`
 
+	// Upstreams named upstream DNS resolver groups for conditional forwarding
+	Upstreams map[string][][]string `json:"upstreams"`
+
+	// Routes domain suffix => name of upstreams, the longest match wins
+	Routes map[string]string `json:"routes"`
+
+	// Fastest A/AAAA address selection settings
+	Fastest upstream.FastestConfig `json:"fastest"`
+
+	// Concurrency max number of requests resolving by upstream at the same time
+	Concurrency int `json:"concurrency"`
+
+	// Strategy upstream dispatch strategy settings
+	Strategy upstream.StrategyConfig `json:"strategy"`
+
+	// Consensus upstream answer verification settings
+	Consensus upstream.ConsensusConfig `json:"consensus"`
+
+	// DNSSEC validation settings
+	DNSSEC dnssec.Config `json:"dnssec"`
+
 	// ECS settings, ECS will disable when nil
-	ECS *struct {
-		IPV4       string `json:"ip_v4"`
-		IPV6       string `json:"ip_v6"`
-		MaskBitsV4 uint8  `json:"mask_bits_v4"`
-		MaskBitsV6 uint8  `json:"mask_bits_v6"`
-	} `json:"ecs"`
+	ECS *upstream.ECSConfig `json:"ecs"`
+
+	// Records the local records settings
+	Records local.Config `json:"records"`
+
+	// Authority the authoritative zones settings
+	Authority zone.Config `json:"authority"`
+
+	// RPZ the response policy zones settings
+	RPZ rpz.Config `json:"rpz"`
+
+	// Filter the blocklist settings
+	Filter filter.Config `json:"filter"`
+
+	// Clients the client groups settings
+	Clients clients.Config `json:"clients"`
+
+	// Rewrite the rewrite rules of the requests and the responses
+	Rewrite rewrite.Config `json:"rewrite"`
+
+	// Rebind the DNS rebinding protection settings
+	Rebind rebind.Config `json:"rebind"`
+
+	// PublicIP detection settings of the ECS subnets which address is empty
+	PublicIP publicip.Config `json:"public_ip"`
 }
 
+const (
+	subnetRetry    = time.Minute // the first retry interval of the public address failed to be detected
+	subnetRetryMax = time.Hour
+)
+
 var (
 	option Option
 )
@@ -80,19 +142,107 @@ func main() {
 		return
 	}
 
-	var subnets []*dns.EDNS0_SUBNET
-	if subnets, err = getSubnets(); err != nil {
+	var up *upstream.UpStream
+	req, resp := server.GetChan()
+	var config = upstream.Config{
+		Resolvers:   option.Resolvers,
+		Fastest:     option.Fastest,
+		Concurrency: option.Concurrency,
+		Strategy:    option.Strategy,
+		Groups:      option.Upstreams,
+		Routes:      option.Routes,
+		Consensus:   option.Consensus,
+		DNSSEC:      option.DNSSEC,
+		ECS:         option.ECS,
+	}
+	if up, err = upstream.New(config, nil, req, resp); err != nil {
 		log.Sugar.Error(err)
 		return
 	}
 
-	var up *upstream.UpStream
-	req, resp := server.GetChan()
-	if up, err = upstream.New(option.Resolvers, subnets, req, resp); err != nil {
+	server.SetScope(up.Scope)
+
+	var records *local.Records
+	if records, err = local.New(option.Records); err != nil {
+		log.Sugar.Error(err)
+		return
+	}
+	server.SetRecords(records)
+
+	var zones *zone.Zones
+	if zones, err = zone.New(option.Authority); err != nil {
+		log.Sugar.Error(err)
+		return
+	}
+	server.SetZones(zones)
+
+	var policy *rpz.RPZ
+	if policy, err = rpz.New(option.RPZ); err != nil {
+		log.Sugar.Error(err)
+		return
+	}
+	server.SetRPZ(policy)
+
+	var f *filter.Filter
+	if f, err = filter.New(option.Filter); err != nil {
+		log.Sugar.Error(err)
+		return
+	}
+	server.SetFilter(f)
+
+	var groups *clients.Groups
+	if groups, err = clients.New(option.Clients); err != nil {
+		log.Sugar.Error(err)
+		return
+	}
+	if err = groups.Check(up.HasGroup, f.HasList); err != nil {
+		log.Sugar.Error(err)
+		return
+	}
+	server.SetGroups(groups)
+
+	var rw *rewrite.Engine
+	if rw, err = rewrite.New(option.Rewrite); err != nil {
+		log.Sugar.Error(err)
+		return
+	}
+	server.SetRewrite(rw)
+
+	var guard *rebind.Guard
+	if guard, err = rebind.New(option.Rebind); err != nil {
+		log.Sugar.Error(err)
+		return
+	}
+	server.SetRebind(guard)
+
+	// the dns providers query through the upstream
+	var detector *publicip.Detector
+	if detector, err = publicip.New(option.PublicIP, up.Query); err != nil {
 		log.Sugar.Error(err)
 		return
 	}
 
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	// start without the static subnet of the family failed to be detected,
+	// it is retried in background
+	var subnets, missing = getSubnets(ctx, detector, nil)
+	up.SetSubnets(subnets)
+
+	go refreshSubnets(ctx, up, detector, subnets, missing)
+	records.Start(ctx)
+	if err = zones.Start(ctx); err != nil {
+		log.Sugar.Error(err)
+		return
+	}
+	policy.Start(ctx)
+	f.Start(ctx)
+	rw.Start(ctx)
+
+	metrics.Start(option.Metrics.Address)
+	defer metrics.Stop()
+
 	up.Start()     // start upstream
 	server.Start() // start server
 
@@ -131,40 +281,98 @@ func initLog() error {
 func InitServer() (*udp.Server, error) {
 	ip := net.ParseIP(option.Server.Address)
 	ttr := time.Minute * time.Duration(option.CacheTTR)
-	return udp.New(ip, option.Server.Port, ttr)
+	deadline := time.Millisecond * time.Duration(option.Server.Deadline)
+	return udp.New(ip, option.Server.Port, option.Server.Queue, deadline, ttr)
 }
 
-func getSubnets() ([]*dns.EDNS0_SUBNET, error) {
+// getSubnets return the static subnets of IPv4 and IPv6, the family failed to
+// be detected keeps its subnet of old, none at startup, missing report whether
+// any family failed
+func getSubnets(ctx context.Context, detector *publicip.Detector, old []*dns.EDNS0_SUBNET) (subnets []*dns.EDNS0_SUBNET, missing bool) {
 	if option.ECS == nil {
-		return nil, nil
+		return nil, false
 	}
 
-	var subnets = make([]*dns.EDNS0_SUBNET, 0, 2)
+	var families = []struct {
+		name string
+		raw  string
+		v6   bool
+		mask uint8
+	}{
+		{"ipv4", option.ECS.IPV4, false, option.ECS.MaskBitsV4},
+		{"ipv6", option.ECS.IPV6, true, option.ECS.MaskBitsV6},
+	}
 
-	subnetV4, err := getSubnet(option.ECS.IPV4, false, option.ECS.MaskBitsV4)
-	if err != nil {
-		return nil, err
+	subnets = make([]*dns.EDNS0_SUBNET, len(families))
+	for i, f := range families {
+		subnet, err := getSubnet(ctx, detector, f.raw, f.v6, f.mask)
+		if err != nil {
+			missing = true
+			if i < len(old) {
+				subnet = old[i]
+			}
+			if subnet == nil {
+				log.Sugar.Warnf("%s public address error=[%+v], no static subnet of the family", f.name, err)
+			} else {
+				log.Sugar.Warnf("%s public address error=[%+v], the old static subnet is kept", f.name, err)
+			}
+		}
+		subnets[i] = subnet
 	}
-	subnets = append(subnets, subnetV4)
 
-	var subnetV6 *dns.EDNS0_SUBNET
-	if subnetV6, err = getSubnet(option.ECS.IPV6, true, option.ECS.MaskBitsV6); err != nil {
-		return nil, err
+	return subnets, missing
+}
+
+// refreshSubnets detect the public address for the static subnets every
+// ECS.Refresh minutes until ctx done, the family failed to be detected is
+// retried sooner, from subnetRetry doubled up to subnetRetryMax, the subnets of
+// the configured address do not change
+func refreshSubnets(ctx context.Context, up *upstream.UpStream, detector *publicip.Detector, subnets []*dns.EDNS0_SUBNET, missing bool) {
+	if option.ECS == nil {
+		return
+	}
+
+	if len(option.ECS.IPV4) > 0 && len(option.ECS.IPV6) > 0 {
+		return
 	}
-	subnets = append(subnets, subnetV6)
 
-	return subnets, nil
+	var refresh = time.Minute * time.Duration(option.ECS.Refresh)
+	var retry = subnetRetry
+	for {
+		var interval = refresh
+		switch {
+		case missing:
+			interval, retry = retry, min(2*retry, subnetRetryMax)
+			if refresh > 0 {
+				interval = min(interval, refresh)
+			}
+		case refresh <= 0:
+			return
+		default:
+			retry = subnetRetry
+		}
+
+		var timer = time.NewTimer(interval)
+		select {
+		case <-timer.C:
+			subnets, missing = getSubnets(ctx, detector, subnets)
+			up.SetSubnets(subnets)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
 }
 
-func getSubnet(ipRAW string, v6 bool, mask uint8) (*dns.EDNS0_SUBNET, error) {
+func getSubnet(ctx context.Context, detector *publicip.Detector, ipRAW string, v6 bool, mask uint8) (*dns.EDNS0_SUBNET, error) {
 
 	var ip net.IP
 	if len(ipRAW) == 0 {
 		var err error
 		if v6 {
-			ip, err = util.GetPublicIPV6()
+			ip, err = detector.IPV6(ctx)
 		} else {
-			ip, err = util.GetPublicIPV4()
+			ip, err = detector.IPV4(ctx)
 		}
 		if err != nil {
 			return nil, err
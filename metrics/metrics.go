@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/treemana/godot/log"
+)
+
+const (
+	path = "/debug/vars"
+
+	eventsKept = 64 // number of the latest events kept for every key
+)
+
+var (
+	// registry all the godot metrics, published as expvar "godot"
+	registry = expvar.NewMap("godot")
+
+	server *http.Server
+
+	eventsMutex sync.Mutex
+)
+
+// Add add delta to the counter or gauge named key
+func Add(key string, delta int64) {
+	registry.Add(key, delta)
+}
+
+// Set set the gauge named key to value
+func Set(key string, value int64) {
+	var v = new(expvar.Int)
+	v.Set(value)
+	registry.Set(key, v)
+}
+
+// Get return the value of the counter or gauge named key, 0 when not exist
+func Get(key string) int64 {
+	if v, ok := registry.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// Record append event to the latest events named key,
+// the oldest one is dropped when there are eventsKept events already
+func Record(key string, event string) {
+	eventsMutex.Lock()
+	e, ok := registry.Get(key).(*events)
+	if !ok {
+		e = new(events)
+		registry.Set(key, e)
+	}
+	eventsMutex.Unlock()
+
+	e.append(event)
+}
+
+// events the latest events, published as a json array from the oldest
+type events struct {
+	mutex sync.Mutex
+	list  []string
+	index int // the next index of list to write
+}
+
+func (e *events) append(event string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if len(e.list) < eventsKept {
+		e.list = append(e.list, event)
+	} else {
+		e.list[e.index] = event
+	}
+	e.index = (e.index + 1) % eventsKept
+}
+
+func (e *events) String() string {
+	e.mutex.Lock()
+	var list = append(append([]string(nil), e.list[e.index:]...), e.list[:e.index]...)
+	e.mutex.Unlock()
+
+	raw, _ := json.Marshal(list)
+	return string(raw)
+}
+
+// Start serve the metrics at http://address/debug/vars
+// do nothing when address is empty
+func Start(address string) {
+	if len(address) == 0 {
+		return
+	}
+
+	var mux = http.NewServeMux()
+	mux.Handle(path, expvar.Handler())
+	server = &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: time.Second}
+
+	go func() {
+		log.Sugar.Infof("metrics serving at http://%s%s", address, path)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Sugar.Errorf("metrics serve error=[%+v]", err)
+		}
+	}()
+}
+
+func Stop() {
+	if server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Sugar.Errorf("metrics stop error=[%+v]", err)
+	}
+	log.Sugar.Info("metrics stopped")
+}
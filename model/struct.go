@@ -1,7 +1,9 @@
 package model
 
 import (
+	"context"
 	"net"
+	"slices"
 
 	"github.com/miekg/dns"
 )
@@ -17,8 +19,170 @@ type DT struct {
 
 	Answers []dns.RR
 
+	// Key the coalescing key of the upstream request,
+	// identical in-flight requests share one upstream resolution
+	Key string
+
 	Request  *dns.Msg
 	Response *dns.Msg
 
+	// Ctx the context of the query, it will be canceled when the deadline exceeded
+	// or the response is going to be written
+	Ctx    context.Context
+	Cancel context.CancelFunc
+
+	// Scope the cache scope of the query, see cache.Key
+	Scope string
+
+	// Policy the settings of the client group of RemoteAddr, nil for the
+	// clients out of any group and the cache refreshing
+	Policy *Policy
+
 	Cached bool // when response from the cache, true will be set
+
+	// Local the response is answered by godot itself, the filter or the local
+	// records, it will not be updated to the cache
+	Local bool
+
+	// Alias the CNAME chain from the question asked by the client to the name of
+	// Request, it is prepended to the response of Request, see Redirect
+	Alias []dns.RR
+
+	// Question the question asked by the client when Request is redirected
+	Question dns.Question
+
+	// Flatten the redirected response is answered without the CNAME chain,
+	// the answers of the target are owned by the name asked, see Restored
+	Flatten bool
+
+	// Passthru the response policy is not applied to the response, the name is
+	// exempted by rpz-passthru of the response policy zones
+	Passthru bool
+
+	// Secure the answers are validated by DNSSEC, the response will be answered with AD
+	Secure bool
+
+	// Provisional the response is answered before the fastest answer selected,
+	// it will not be updated to the cache
+	Provisional bool
+
+	// Background the fastest answer of dt will be updated to the cache only,
+	// nothing will be written to the udp connection
+	Background bool
+}
+
+// Policy represents the settings of a client group
+type Policy struct {
+	// Group the name of the client group
+	Group string
+
+	// Upstream the name of the upstream group resolving the names not routed,
+	// the default resolvers when empty
+	Upstream string
+
+	// Lists the names of the filter lists applied, all the lists when nil,
+	// none of them when empty
+	Lists []string
+
+	// ECS the client subnet mode, the global one when empty
+	ECS string
+
+	// SafeSearch enable or disable the safe search, the global one when nil
+	SafeSearch *bool
+}
+
+// FilterLists return the names of the filter lists applied, nil for all
+func (p *Policy) FilterLists() []string {
+	if p == nil {
+		return nil
+	}
+	return p.Lists
+}
+
+// SafeSearchOr return whether the safe search is enabled, global when the
+// policy is nil or does not set it
+func (p *Policy) SafeSearchOr(global bool) bool {
+	if p == nil || p.SafeSearch == nil {
+		return global
+	}
+	return *p.SafeSearch
+}
+
+// Context return dt.Ctx, or context.Background() when dt.Ctx is nil
+func (dt *DT) Context() context.Context {
+	if dt.Ctx == nil {
+		return context.Background()
+	}
+	return dt.Ctx
+}
+
+// Finish cancel the context of dt
+func (dt *DT) Finish() {
+	if dt.Cancel != nil {
+		dt.Cancel()
+	}
+}
+
+// Redirect change the name of Request to the target of the CNAME chain alias,
+// the response will be answered to the question asked with alias prepended
+func (dt *DT) Redirect(alias []dns.RR) {
+	if len(alias) == 0 {
+		return
+	}
+
+	cname, ok := alias[len(alias)-1].(*dns.CNAME)
+	if !ok {
+		return
+	}
+
+	if len(dt.Alias) == 0 {
+		dt.Question = dt.Request.Question[0]
+	}
+	dt.Alias = append(dt.Alias, alias...)
+	dt.Request.Question[0].Name = cname.Target
+}
+
+// Asked return the question asked by the client, dt.Question when Request is
+// redirected
+func (dt *DT) Asked() dns.Question {
+	if len(dt.Alias) > 0 {
+		return dt.Question
+	}
+	return dt.Request.Question[0]
+}
+
+// Restored return the response to the question asked by the client, a copy
+// with Alias prepended when Request is redirected, otherwise dt.Response itself
+func (dt *DT) Restored() *dns.Msg {
+	if len(dt.Alias) == 0 || dt.Response == nil {
+		return dt.Response
+	}
+
+	var resp = dt.Response.Copy()
+	resp.Question = []dns.Question{dt.Question}
+	if dt.Flatten {
+		resp.Answer = flatten(resp.Answer, dt.Question)
+	} else {
+		resp.Answer = append(slices.Clone(dt.Alias), resp.Answer...)
+	}
+	// the alias is not validated
+	resp.AuthenticatedData = false
+	return resp
+}
+
+// flatten return the answers of the type of q owned by the name of q, the CNAME
+// chain and the signatures are removed
+func flatten(answer []dns.RR, q dns.Question) []dns.RR {
+	var flattened []dns.RR
+	for _, rr := range answer {
+		var hdr = rr.Header()
+		if hdr.Rrtype == dns.TypeCNAME || hdr.Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		if hdr.Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+			hdr.Name = q.Name
+			flattened = append(flattened, rr)
+		}
+	}
+	return flattened
 }
@@ -0,0 +1,183 @@
+package publicip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxBody the max size of the HTTP response body read
+const maxBody = 256
+
+// httpProvider read the address from the body of the url
+type httpProvider struct {
+	url              string
+	client4, client6 *http.Client
+}
+
+func newHTTP(url string) *httpProvider {
+	return &httpProvider{url: url, client4: newClient("tcp4"), client6: newClient("tcp6")}
+}
+
+// newClient return the client dialing the network only,
+// the server sees the address of the family
+func newClient(network string) *http.Client {
+	var dialer net.Dialer
+	var transport = http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return &http.Client{Transport: transport}
+}
+
+func (p *httpProvider) String() string { return p.url }
+
+func (p *httpProvider) lookup(ctx context.Context, v6 bool) (net.IP, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var client = p.client4
+	if v6 {
+		client = p.client6
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status %s", resp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		return nil, err
+	}
+
+	var ip = net.ParseIP(strings.TrimSpace(string(raw)))
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", raw)
+	}
+	return ip, nil
+}
+
+// dnsProvider read the address from the answers of the query through the upstreams
+type dnsProvider struct {
+	name     string
+	qtype    uint16 // A or AAAA by the family when zero
+	qclass   uint16
+	exchange Exchange
+}
+
+func newDNS(c ProviderConfig, exchange Exchange) (*dnsProvider, error) {
+	if len(c.Name) == 0 {
+		return nil, errors.New("public ip dns provider without name")
+	}
+	if exchange == nil {
+		return nil, fmt.Errorf("public ip dns provider %s without upstream", c.Name)
+	}
+
+	var p = &dnsProvider{name: dns.Fqdn(c.Name), qclass: dns.ClassINET, exchange: exchange}
+
+	if len(c.QType) > 0 {
+		var ok bool
+		if p.qtype, ok = dns.StringToType[strings.ToUpper(c.QType)]; !ok {
+			return nil, fmt.Errorf("public ip dns provider %s unknown qtype %s", c.Name, c.QType)
+		}
+	}
+
+	if len(c.QClass) > 0 {
+		var ok bool
+		if p.qclass, ok = dns.StringToClass[strings.ToUpper(c.QClass)]; !ok {
+			return nil, fmt.Errorf("public ip dns provider %s unknown qclass %s", c.Name, c.QClass)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *dnsProvider) String() string {
+	return fmt.Sprintf("dns:%s/%s/%s", p.name, dns.ClassToString[p.qclass], dns.TypeToString[p.qtype])
+}
+
+func (p *dnsProvider) lookup(ctx context.Context, v6 bool) (net.IP, error) {
+	var qtype = p.qtype
+	if qtype == 0 {
+		qtype = dns.TypeA
+		if v6 {
+			qtype = dns.TypeAAAA
+		}
+	}
+
+	var req = new(dns.Msg)
+	req.SetQuestion(p.name, qtype)
+	req.Question[0].Qclass = p.qclass
+
+	var resp = p.exchange(ctx, req)
+	if resp == nil {
+		return nil, errors.New("no response")
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	// the first address of the family, TXT answers may have both families or other texts
+	for _, rr := range resp.Answer {
+		var ips []net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		case *dns.TXT:
+			for _, txt := range rr.Txt {
+				if ip := net.ParseIP(strings.TrimSpace(txt)); ip != nil {
+					ips = append(ips, ip)
+				}
+			}
+		}
+		for _, ip := range ips {
+			if (ip.To4() == nil) == v6 {
+				return ip, nil
+			}
+		}
+	}
+	return nil, errors.New("no address in the answers")
+}
+
+// iface read the public address of the local interface
+type iface struct {
+	name string
+}
+
+func (p *iface) String() string { return "interface:" + p.name }
+
+func (p *iface) lookup(_ context.Context, v6 bool) (net.IP, error) {
+	i, err := net.InterfaceByName(p.name)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := i.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		n, ok := addr.(*net.IPNet)
+		if ok && check(n.IP, v6) == nil {
+			return n.IP, nil
+		}
+	}
+	return nil, errors.New("no public address")
+}
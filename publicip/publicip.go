@@ -0,0 +1,241 @@
+package publicip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/util"
+)
+
+const (
+	timeoutDefault = 3 * time.Second
+
+	// ipify https://www.ipify.org/, both families, the family is selected by the dialer
+	ipify = "https://api64.ipify.org/"
+
+	// icanhazip https://icanhazip.com/, both families
+	icanhazip = "https://icanhazip.com/"
+
+	// cloudflareSTUN the STUN server of Cloudflare, both families
+	cloudflareSTUN = "stun.cloudflare.com:3478"
+)
+
+// defaultProviders the providers of the independent operators, one of them is
+// enough when the others are blocked
+var defaultProviders = []ProviderConfig{
+	{Type: TypeHTTP, URL: ipify},
+	{Type: TypeHTTP, URL: icanhazip},
+	{Type: TypeSTUN, Address: cloudflareSTUN},
+}
+
+// provider types
+const (
+	TypeHTTP      = "http"      // the address in the body of an HTTP GET
+	TypeDNS       = "dns"       // the address answered to a query through the upstreams
+	TypeSTUN      = "stun"      // the mapped address of a STUN binding request
+	TypeInterface = "interface" // the public address of a local interface
+)
+
+// ProviderConfig represents a public address provider
+type ProviderConfig struct {
+	// Type of the provider, TypeHTTP, TypeDNS, TypeSTUN or TypeInterface
+	Type string `json:"type"`
+
+	// URL of TypeHTTP, the body is the address
+	URL string `json:"url"`
+
+	// Name the query name of TypeDNS, the interface name of TypeInterface
+	Name string `json:"name"`
+
+	// QType and QClass of the TypeDNS query, A or AAAA by the family and IN when empty,
+	// the address is read from the A, AAAA and TXT answers
+	QType  string `json:"qtype"`
+	QClass string `json:"qclass"`
+
+	// Address host:port of the TypeSTUN server
+	Address string `json:"address"`
+}
+
+// Config represents the public address detection settings
+type Config struct {
+	// Providers asked at the same time, defaultProviders when empty
+	Providers []ProviderConfig `json:"providers"`
+
+	// Timeout of every provider, millisecond, 3000 when zero
+	Timeout int `json:"timeout"`
+
+	// Agree the minimum number of the providers answering the same address, 1 when zero,
+	// the address must also be answered by more providers than any other one
+	Agree int `json:"agree"`
+}
+
+// Exchange send req to the upstream resolvers, return nil when failed
+type Exchange func(ctx context.Context, req *dns.Msg) *dns.Msg
+
+// provider look up the public address of the family
+type provider interface {
+	lookup(ctx context.Context, v6 bool) (net.IP, error)
+	String() string
+}
+
+// Detector detect the public address by the providers
+type Detector struct {
+	providers []provider
+	timeout   time.Duration
+	agree     int
+}
+
+// New return the detector of config, the TypeDNS queries are sent by exchange
+func New(config Config, exchange Exchange) (*Detector, error) {
+	var d = &Detector{
+		timeout: time.Millisecond * time.Duration(config.Timeout),
+		agree:   config.Agree,
+	}
+	if d.timeout <= 0 {
+		d.timeout = timeoutDefault
+	}
+	if d.agree <= 0 {
+		d.agree = 1
+	}
+
+	var configs = config.Providers
+	if len(configs) == 0 {
+		configs = defaultProviders
+	}
+
+	for _, c := range configs {
+		p, err := newProvider(c, exchange)
+		if err != nil {
+			return nil, err
+		}
+		d.providers = append(d.providers, p)
+	}
+
+	if d.agree > len(d.providers) {
+		return nil, fmt.Errorf("public ip agree %d more than %d providers", d.agree, len(d.providers))
+	}
+
+	return d, nil
+}
+
+func newProvider(c ProviderConfig, exchange Exchange) (provider, error) {
+	switch c.Type {
+	case TypeHTTP:
+		if len(c.URL) == 0 {
+			return nil, errors.New("public ip http provider without url")
+		}
+		return newHTTP(c.URL), nil
+	case TypeDNS:
+		return newDNS(c, exchange)
+	case TypeSTUN:
+		if len(c.Address) == 0 {
+			return nil, errors.New("public ip stun provider without address")
+		}
+		return &stun{address: c.Address}, nil
+	case TypeInterface:
+		if len(c.Name) == 0 {
+			return nil, errors.New("public ip interface provider without name")
+		}
+		return &iface{name: c.Name}, nil
+	default:
+		return nil, fmt.Errorf("unknown public ip provider type %s", c.Type)
+	}
+}
+
+func (d *Detector) IPV4(ctx context.Context) (net.IP, error) { return d.detect(ctx, false) }
+func (d *Detector) IPV6(ctx context.Context) (net.IP, error) { return d.detect(ctx, true) }
+
+// detect ask all the providers at the same time, return the address answered
+// by at least agree providers and more than any other address
+func (d *Detector) detect(ctx context.Context, v6 bool) (net.IP, error) {
+	type answer struct {
+		p   provider
+		ip  net.IP
+		err error
+	}
+
+	var c = make(chan answer, len(d.providers))
+	for _, p := range d.providers {
+		go func() {
+			ctx, cancel := context.WithTimeout(ctx, d.timeout)
+			defer cancel()
+
+			ip, err := p.lookup(ctx, v6)
+			if err == nil {
+				err = check(ip, v6)
+			}
+			c <- answer{p: p, ip: ip, err: err}
+		}()
+	}
+
+	var votes = make(map[string][]string, len(d.providers))
+	var errs []error
+	for range d.providers {
+		a := <-c
+		if a.err != nil {
+			log.Sugar.Warnf("public ip %s error=[%+v]", a.p, a.err)
+			errs = append(errs, fmt.Errorf("%s: %w", a.p, a.err))
+			continue
+		}
+		log.Sugar.Debugf("public ip %s => %s", a.p, a.ip)
+		votes[a.ip.String()] = append(votes[a.ip.String()], a.p.String())
+	}
+
+	var best, second int
+	var ip string
+	for addr, providers := range votes {
+		switch n := len(providers); {
+		case n > best:
+			best, second, ip = n, best, addr
+		case n > second:
+			second = n
+		}
+	}
+
+	if best == 0 {
+		return nil, fmt.Errorf("public ip not detected error=[%+v]", errors.Join(errs...))
+	}
+
+	if best < d.agree || best == second {
+		return nil, fmt.Errorf("public ip disagreement %s", describe(votes))
+	}
+
+	if len(votes) > 1 {
+		log.Sugar.Warnf("public ip disagreement %s, %s is used", describe(votes), ip)
+	}
+
+	return net.ParseIP(ip), nil
+}
+
+// check return error when ip is not a public address of the family
+func check(ip net.IP, v6 bool) error {
+	if ip == nil {
+		return errors.New("no address")
+	}
+	if (ip.To4() == nil) != v6 {
+		return fmt.Errorf("%s of the other family", ip)
+	}
+	if !util.IPIsPublic(ip) {
+		return fmt.Errorf("%s not public", ip)
+	}
+	return nil
+}
+
+// describe return the addresses and their providers, "addr [p1 p2] addr [p3]"
+func describe(votes map[string][]string) string {
+	var b strings.Builder
+	for addr, providers := range votes {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		_, _ = fmt.Fprintf(&b, "%s %v", addr, providers)
+	}
+	return b.String()
+}
@@ -0,0 +1,152 @@
+package publicip
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+)
+
+func TestMain(m *testing.M) {
+	_ = log.Init(log.Config{STDOUT: true, Level: 1})
+	os.Exit(m.Run())
+}
+
+// fixed the provider answering ip or err
+type fixed struct {
+	name string
+	ip   string
+	err  error
+}
+
+func (p *fixed) String() string { return p.name }
+
+func (p *fixed) lookup(context.Context, bool) (net.IP, error) {
+	return net.ParseIP(p.ip), p.err
+}
+
+func TestDetect(t *testing.T) {
+	var failed = errors.New("failed")
+	var tests = []struct {
+		name      string
+		agree     int
+		providers []provider
+		want      string
+	}{
+		{"one", 1, []provider{&fixed{"a", "203.0.113.1", nil}}, "203.0.113.1"},
+		{"failures ignored", 1, []provider{&fixed{"a", "203.0.113.1", nil}, &fixed{"b", "", failed}}, "203.0.113.1"},
+		{"majority", 2, []provider{&fixed{"a", "203.0.113.1", nil}, &fixed{"b", "203.0.113.1", nil}, &fixed{"c", "198.51.100.1", nil}}, "203.0.113.1"},
+		{"tie", 1, []provider{&fixed{"a", "203.0.113.1", nil}, &fixed{"b", "198.51.100.1", nil}}, ""},
+		{"below agree", 2, []provider{&fixed{"a", "203.0.113.1", nil}, &fixed{"b", "", failed}}, ""},
+		{"private", 1, []provider{&fixed{"a", "192.168.1.1", nil}}, ""},
+		{"other family", 1, []provider{&fixed{"a", "2001:db8::1", nil}}, ""},
+	}
+
+	for _, test := range tests {
+		var d = &Detector{providers: test.providers, timeout: timeoutDefault, agree: test.agree}
+		ip, err := d.IPV4(context.Background())
+		if len(test.want) == 0 {
+			if err == nil {
+				t.Errorf("%s: detect() = %s, want error", test.name, ip)
+			}
+			continue
+		}
+		if err != nil || ip.String() != test.want {
+			t.Errorf("%s: detect() = %s, %v, want %s", test.name, ip, err, test.want)
+		}
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("203.0.113.7\n"))
+	}))
+	defer server.Close()
+
+	ip, err := newHTTP(server.URL).lookup(context.Background(), false)
+	if err != nil || ip.String() != "203.0.113.7" {
+		t.Errorf("lookup() = %s, %v, want 203.0.113.7", ip, err)
+	}
+}
+
+func TestDNS(t *testing.T) {
+	p, err := newDNS(ProviderConfig{Name: "whoami.example", QType: "txt", QClass: "ch"}, func(_ context.Context, req *dns.Msg) *dns.Msg {
+		var resp = new(dns.Msg)
+		resp.SetReply(req)
+		if req.Question[0].Qclass != dns.ClassCHAOS || req.Question[0].Qtype != dns.TypeTXT {
+			resp.Rcode = dns.RcodeRefused
+			return resp
+		}
+		var hdr = dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS}
+		resp.Answer = []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{"edns0-client-subnet 198.51.100.0/24"}}, &dns.TXT{Hdr: hdr, Txt: []string{"2001:db8::7", "203.0.113.7"}}}
+		return resp
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip, err := p.lookup(context.Background(), false); err != nil || ip.String() != "203.0.113.7" {
+		t.Errorf("lookup() v4 = %s, %v, want 203.0.113.7", ip, err)
+	}
+	if ip, err := p.lookup(context.Background(), true); err != nil || ip.String() != "2001:db8::7" {
+		t.Errorf("lookup() v6 = %s, %v, want 2001:db8::7", ip, err)
+	}
+}
+
+func TestSTUN(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// answer the binding request with XOR-MAPPED-ADDRESS 203.0.113.7:3478,
+	// after a response of another transaction
+	go func() {
+		var buf = make([]byte, 1500)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil || n < stunHeaderSize {
+			return
+		}
+
+		var resp = make([]byte, stunHeaderSize+12)
+		binary.BigEndian.PutUint16(resp[0:2], stunBindingResponse)
+		binary.BigEndian.PutUint16(resp[2:4], 12)
+		copy(resp[4:stunHeaderSize], buf[4:stunHeaderSize])
+		binary.BigEndian.PutUint16(resp[20:22], stunXORMappedAddress)
+		binary.BigEndian.PutUint16(resp[22:24], 8)
+		resp[25] = 0x01
+		binary.BigEndian.PutUint16(resp[26:28], 3478^(stunMagicCookie>>16))
+		for i, b := range []byte{203, 0, 113, 7} {
+			resp[28+i] = b ^ resp[4+i]
+		}
+
+		var other = append([]byte(nil), resp...)
+		other[19] ^= 0xff
+		_, _ = conn.WriteTo(other, addr)
+		_, _ = conn.WriteTo(resp, addr)
+	}()
+
+	ip, err := (&stun{address: conn.LocalAddr().String()}).lookup(context.Background(), false)
+	if err != nil || ip.String() != "203.0.113.7" {
+		t.Errorf("lookup() = %s, %v, want 203.0.113.7", ip, err)
+	}
+}
+
+func TestNewDefault(t *testing.T) {
+	d, err := New(Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.providers) < 2 {
+		t.Errorf("New() default providers = %v, want more than one", d.providers)
+	}
+}
@@ -0,0 +1,165 @@
+package publicip
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// STUN binding, RFC 8489
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunHeaderSize      = 20
+
+	stunMappedAddress    = 0x0001
+	stunXORMappedAddress = 0x0020
+
+	// stunRetransmit the interval of sending the request again, RFC 8489 Section 6.2.1
+	stunRetransmit = 500 * time.Millisecond
+)
+
+// stun read the mapped address of the binding request to the server
+type stun struct {
+	address string
+}
+
+func (p *stun) String() string { return "stun:" + p.address }
+
+func (p *stun) lookup(ctx context.Context, v6 bool) (net.IP, error) {
+	var network = "udp4"
+	if v6 {
+		network = "udp6"
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, p.address)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	var req = make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(req[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:8], stunMagicCookie)
+	if _, err = rand.Read(req[8:stunHeaderSize]); err != nil {
+		return nil, err
+	}
+
+	var buf = make([]byte, 1500)
+	for {
+		if _, err = conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		var deadline = time.Now().Add(stunRetransmit)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err = conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+
+		// drop the responses of other transactions until the deadline
+		for {
+			var n int
+			if n, err = conn.Read(buf); err != nil {
+				break
+			}
+			if ip, err := parseBinding(buf[:n], req[8:stunHeaderSize]); err == nil {
+				return ip, nil
+			}
+		}
+
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// parseBinding return the mapped address of the binding success response of the transaction,
+// XOR-MAPPED-ADDRESS is preferred to MAPPED-ADDRESS
+func parseBinding(msg, transaction []byte) (net.IP, error) {
+	if len(msg) < stunHeaderSize {
+		return nil, errors.New("stun message too short")
+	}
+	if binary.BigEndian.Uint16(msg[0:2]) != stunBindingResponse {
+		return nil, fmt.Errorf("stun message type %#04x", binary.BigEndian.Uint16(msg[0:2]))
+	}
+	if binary.BigEndian.Uint32(msg[4:8]) != stunMagicCookie || !bytes.Equal(msg[8:stunHeaderSize], transaction) {
+		return nil, errors.New("stun transaction mismatch")
+	}
+
+	var length = int(binary.BigEndian.Uint16(msg[2:4]))
+	if stunHeaderSize+length > len(msg) {
+		return nil, errors.New("stun message truncated")
+	}
+
+	var mapped net.IP
+	for attrs := msg[stunHeaderSize : stunHeaderSize+length]; len(attrs) >= 4; {
+		var typ, size = binary.BigEndian.Uint16(attrs[0:2]), int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+size > len(attrs) {
+			return nil, errors.New("stun attribute truncated")
+		}
+		var value = attrs[4 : 4+size]
+
+		switch typ {
+		case stunXORMappedAddress:
+			ip, err := parseAddress(value)
+			if err != nil {
+				return nil, err
+			}
+			// the address is XOR-ed with the magic cookie and the transaction ID
+			for i := range ip {
+				ip[i] ^= msg[4+i]
+			}
+			return ip, nil
+		case stunMappedAddress:
+			ip, err := parseAddress(value)
+			if err != nil {
+				return nil, err
+			}
+			mapped = ip
+		}
+
+		// the attributes are padded to 4 bytes
+		attrs = attrs[min(len(attrs), 4+(size+3)&^3):]
+	}
+
+	if mapped == nil {
+		return nil, errors.New("stun response without mapped address")
+	}
+	return mapped, nil
+}
+
+// parseAddress return a copy of the address of the (XOR-)MAPPED-ADDRESS value
+func parseAddress(value []byte) (net.IP, error) {
+	if len(value) < 4 {
+		return nil, errors.New("stun address too short")
+	}
+
+	var size int
+	switch value[1] {
+	case 0x01:
+		size = net.IPv4len
+	case 0x02:
+		size = net.IPv6len
+	default:
+		return nil, fmt.Errorf("stun address family %#02x", value[1])
+	}
+
+	if len(value) < 4+size {
+		return nil, errors.New("stun address too short")
+	}
+	return bytes.Clone(value[4 : 4+size]), nil
+}
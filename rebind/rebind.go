@@ -0,0 +1,133 @@
+package rebind
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/metrics"
+	"github.com/treemana/godot/model"
+	"github.com/treemana/godot/util"
+)
+
+// the actions on the inward answers
+const (
+	ActionStrip = "strip" // remove the inward addresses, the default
+	ActionBlock = "block" // answer REFUSED
+)
+
+const (
+	metricBlocked = "rebind_blocked" // number of the responses stripped or blocked
+)
+
+// localhost the names always pointing inward, RFC 6761
+const localhost = ".localhost"
+
+// Config represents the DNS rebinding protection settings
+type Config struct {
+	// Enabled check the upstream answers of the names not in the exceptions
+	Enabled bool `json:"enabled"`
+
+	// Action on the inward answers, ActionStrip or ActionBlock, ActionStrip when empty
+	Action string `json:"action"`
+
+	// Exceptions the names allowed to point inward, the same syntax as the
+	// fastest policies, ".plex.direct"
+	Exceptions []string `json:"exceptions"`
+}
+
+// Guard strip or block the upstream answers pointing inward
+type Guard struct {
+	block      bool
+	exceptions []*util.DomainRule
+}
+
+// New return nil when disabled
+func New(config Config) (*Guard, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	var g = new(Guard)
+	switch config.Action {
+	case "", ActionStrip:
+	case ActionBlock:
+		g.block = true
+	default:
+		return nil, fmt.Errorf("rebind unknown action %s", config.Action)
+	}
+
+	for _, raw := range append([]string{localhost}, config.Exceptions...) {
+		r, err := util.NewDomainRule(raw)
+		if err != nil {
+			return nil, fmt.Errorf("rebind exception error=[%+v]", err)
+		}
+		g.exceptions = append(g.exceptions, r)
+	}
+
+	return g, nil
+}
+
+// Inward report whether addr is a private, ULA, loopback, link-local or
+// unspecified address, which the LAN clients reach without the internet
+func Inward(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified()
+}
+
+// excepted report whether name is allowed to point inward
+func (g *Guard) excepted(name string) bool {
+	return slices.ContainsFunc(g.exceptions, func(r *util.DomainRule) bool { return r.Match(name) })
+}
+
+// Check strip the inward addresses of dt.Response in place or replace it by
+// REFUSED, return the inward addresses answered, the exception is decided once
+// by the name asked, the target of the redirected request and the owners of the
+// answers are never excepted
+func (g *Guard) Check(dt *model.DT) []netip.Addr {
+	var resp = dt.Response
+	if g == nil || resp == nil || len(resp.Question) == 0 || g.excepted(dt.Asked().Name) {
+		return nil
+	}
+
+	var inward []netip.Addr
+	for _, rr := range resp.Answer {
+		if addr, ok := netip.AddrFromSlice(util.DNSSplitAnswer(rr)); ok && Inward(addr) {
+			inward = append(inward, addr.Unmap())
+		}
+	}
+	if len(inward) == 0 {
+		return nil
+	}
+
+	metrics.Add(metricBlocked, 1)
+
+	if g.block {
+		var refused = new(dns.Msg)
+		refused.SetRcode(dt.Request, dns.RcodeRefused)
+		refused.RecursionAvailable = true
+		if dt.Request.IsEdns0() != nil {
+			util.DNSSetEDE(refused, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked, ExtraText: "DNS rebinding"})
+		}
+		dt.Response = refused
+		return inward
+	}
+
+	// the address sets are changed, their signatures are removed
+	resp.Answer = slices.DeleteFunc(resp.Answer, func(rr dns.RR) bool {
+		switch rr := rr.(type) {
+		case *dns.RRSIG:
+			return rr.TypeCovered == dns.TypeA || rr.TypeCovered == dns.TypeAAAA
+		case *dns.A, *dns.AAAA:
+			addr, _ := netip.AddrFromSlice(util.DNSSplitAnswer(rr))
+			return Inward(addr)
+		default:
+			return false
+		}
+	})
+	resp.AuthenticatedData = false
+
+	return inward
+}
@@ -0,0 +1,165 @@
+package rebind
+
+import (
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/model"
+)
+
+func TestMain(m *testing.M) {
+	_ = log.Init(log.Config{STDOUT: true, Level: 1})
+	os.Exit(m.Run())
+}
+
+// upstream return dt asked name with the upstream response of the answers rrs
+func upstream(t *testing.T, name string, rrs ...string) *model.DT {
+	var req = new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	var resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.AuthenticatedData = true
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return &model.DT{Request: req, Response: resp}
+}
+
+// redirect return dt asked name redirected to target with the upstream
+// response of target
+func redirect(t *testing.T, name, target string, rrs ...string) *model.DT {
+	var dt = upstream(t, name)
+	dt.Redirect([]dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+		Target: target,
+	}})
+	dt.Response = upstream(t, target, rrs...).Response
+	return dt
+}
+
+func TestInward(t *testing.T) {
+	for raw, want := range map[string]bool{
+		"10.1.2.3":         true,
+		"172.16.0.1":       true,
+		"192.168.1.1":      true,
+		"127.0.0.1":        true,
+		"169.254.1.1":      true,
+		"0.0.0.0":          true,
+		"::1":              true,
+		"fe80::1":          true,
+		"fd00::1":          true,
+		"::ffff:10.0.0.1":  true,
+		"8.8.8.8":          false,
+		"100.64.0.1":       false,
+		"2001:4860::8888":  false,
+		"::ffff:8.8.8.8":   false,
+		"172.32.0.1":       false,
+		"192.169.0.1":      false,
+		"fe00::1":          false,
+		"2001:db8::1":      false,
+		"203.0.113.200":    false,
+		"198.51.100.1":     false,
+		"224.0.0.1":        false,
+		"255.255.255.255":  false,
+		"2606:4700::1111":  false,
+		"::ffff:127.0.0.1": true,
+	} {
+		if got := Inward(netip.MustParseAddr(raw)); got != want {
+			t.Errorf("Inward(%s) = %t, want %t", raw, got, want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	g, err := New(Config{Enabled: true, Exceptions: []string{".plex.direct", ".corp.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dt = upstream(t, "evil.example.",
+		"evil.example. 60 IN A 192.168.1.1",
+		"evil.example. 60 IN A 192.0.2.1",
+		"evil.example. 60 IN RRSIG A 13 2 60 20300101000000 20200101000000 1 example. AAAA")
+	var resp = dt.Response
+	if inward := g.Check(dt); len(inward) != 1 || inward[0] != netip.MustParseAddr("192.168.1.1") {
+		t.Errorf("Check() inward = %v, want 192.168.1.1", inward)
+	}
+	if dt.Response != resp || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.1" || resp.AuthenticatedData {
+		t.Errorf("Check() strip = %v, want the public A only", resp)
+	}
+
+	var tests = []struct {
+		name     string
+		dt       *model.DT
+		stripped bool
+	}{
+		{"inward target of the CNAME", upstream(t, "www.evil.example.",
+			"www.evil.example. 60 IN CNAME x.evil.example.",
+			"x.evil.example. 60 IN A 10.0.0.1"), true},
+		// the owner of the inward answer is excepted, the name asked is not
+		{"CNAME to the exception", upstream(t, "evil.example.",
+			"evil.example. 60 IN CNAME 192-168-1-1.x.plex.direct.",
+			"192-168-1-1.x.plex.direct. 60 IN A 192.168.1.1"), true},
+		{"CNAME to the corp name", upstream(t, "app.example.",
+			"app.example. 60 IN CNAME nas.corp.example.",
+			"nas.corp.example. 60 IN A 10.0.0.6"), true},
+		{"redirected to the exception", redirect(t, "evil.example.", "192-168-1-1.x.plex.direct.",
+			"192-168-1-1.x.plex.direct. 60 IN A 192.168.1.1"), true},
+		{"exception", upstream(t, "10-0-0-5.abc.plex.direct.",
+			"10-0-0-5.abc.plex.direct. 60 IN A 10.0.0.5"), false},
+		{"exception CNAME", upstream(t, "nas.corp.example.",
+			"nas.corp.example. 60 IN CNAME nas.cdn.example.",
+			"nas.cdn.example. 60 IN A 10.0.0.6"), false},
+		{"exception redirected", redirect(t, "nas.corp.example.", "nas.cdn.example.",
+			"nas.cdn.example. 60 IN A 10.0.0.6"), false},
+		{"localhost", upstream(t, "localhost.", "localhost. 60 IN A 127.0.0.1"), false},
+		{"public", upstream(t, "public.example.", "public.example. 60 IN A 192.0.2.1"), false},
+	}
+	for _, test := range tests {
+		var n = len(test.dt.Response.Answer)
+		var inward = g.Check(test.dt)
+		if stripped := len(test.dt.Response.Answer) < n; stripped != test.stripped || (len(inward) > 0) != test.stripped {
+			t.Errorf("%s: Check() = %v %v, want stripped %t", test.name, inward, test.dt.Response.Answer, test.stripped)
+		}
+	}
+
+	if g, err = New(Config{Enabled: true, Action: ActionBlock}); err != nil {
+		t.Fatal(err)
+	}
+	dt = upstream(t, "evil.example.", "evil.example. 60 IN A 127.0.0.1")
+	resp = dt.Response
+	if inward := g.Check(dt); len(inward) != 1 || dt.Response == resp || dt.Response.Rcode != dns.RcodeRefused || len(dt.Response.Answer) != 0 || dt.Response.Id != dt.Request.Id {
+		t.Errorf("Check() block = %v %v, want REFUSED", inward, dt.Response)
+	}
+
+	// disabled
+	var none *Guard
+	dt = upstream(t, "evil.example.", "evil.example. 60 IN A 127.0.0.1")
+	if inward := none.Check(dt); inward != nil || len(dt.Response.Answer) != 1 {
+		t.Errorf("Check() disabled = %v %v, want unchanged", inward, dt.Response)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if g, err := New(Config{Exceptions: []string{"/[/"}}); g != nil || err != nil {
+		t.Errorf("New() disabled = %v, %v, want nil", g, err)
+	}
+
+	for _, c := range []Config{
+		{Enabled: true, Action: "unknown"},
+		{Enabled: true, Exceptions: []string{"/[/"}},
+	} {
+		if _, err := New(c); err == nil {
+			t.Errorf("New(%+v) succeeded, want error", c)
+		}
+	}
+}
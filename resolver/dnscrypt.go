@@ -0,0 +1,403 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+
+	"github.com/treemana/godot/log"
+)
+
+const (
+	dnscryptCertMagic   = "DNSC"
+	dnscryptCertSize    = 124 // without extensions
+	dnscryptESXSalsa20  = 1   // X25519-XSalsa20Poly1305
+	dnscryptQueryMin    = 256 // minimum size of the padded udp query
+	dnscryptPadBlock    = 64
+	dnscryptHalfNonce   = 12
+	dnscryptCertRefresh = time.Hour   // the certificate is fetched again after refresh at most
+	dnscryptCertRetry   = time.Minute // the failed refresh is retried after retry
+	defaultDNSCryptPort = "443"
+)
+
+var (
+	dnscryptResolverMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+)
+
+// dnscryptCert the verified resolver certificate and the client key pair of it
+type dnscryptCert struct {
+	serial      uint32
+	clientMagic [8]byte
+	clientPK    [32]byte
+	sharedKey   [32]byte
+	notAfter    time.Time
+}
+
+// DNSCrypt DNSCrypt version 2 resolver, https://dnscrypt.info/protocol
+// only the X25519-XSalsa20Poly1305 construction is supported
+type DNSCrypt struct {
+	u            *url.URL
+	address      string
+	providerName string
+	providerKey  ed25519.PublicKey
+
+	mutex      sync.Mutex
+	cert       *dnscryptCert
+	refreshAt  time.Time
+	refreshing bool
+}
+
+func newDNSCrypt(u *url.URL, st *Stamp) *DNSCrypt {
+	return &DNSCrypt{
+		u:            u,
+		address:      st.address(defaultDNSCryptPort),
+		providerName: dns.Fqdn(st.ProviderName),
+		providerKey:  ed25519.PublicKey(st.PublicKey),
+	}
+}
+
+func (r *DNSCrypt) Resolve(ctx context.Context, req *dns.Msg) *dns.Msg {
+	start := time.Now()
+
+	cert, err := r.certificate(ctx, false)
+	if err != nil {
+		log.Sugar.Errorf("%s certificate %s", r.providerName, err)
+		return nil
+	}
+
+	var resp *dns.Msg
+	if resp, err = r.exchange(ctx, cert, "udp", req); err == nil && resp.Truncated {
+		resp, err = r.exchange(ctx, cert, "tcp", req)
+	}
+	if err != nil {
+		log.Sugar.Errorf("%s %s [%s]", r.providerName, err, req.Question[0].String())
+		return nil
+	}
+
+	if req.Id != resp.Id {
+		log.Sugar.Info("unmatched request and response")
+		return nil
+	}
+
+	log.Sugar.Debugf("%s response success, cost %s", r.providerName, time.Since(start))
+	return resp
+}
+
+func (r *DNSCrypt) URL() *url.URL { return r.u }
+
+// Probe return the elapsed time of fetching the resolver certificate
+func (r *DNSCrypt) Probe(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeoutDial+timeoutHandshake)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := r.certificate(ctx, true); err != nil {
+		return math.MaxInt64, err
+	}
+	return time.Since(start), nil
+}
+
+// certificate return the current certificate, fetch a new one when it
+// expired, should be refreshed or force is true, the current certificate is
+// returned while another refresh is in flight and it is still usable
+func (r *DNSCrypt) certificate(ctx context.Context, force bool) (*dnscryptCert, error) {
+	r.mutex.Lock()
+	var now = time.Now()
+	if !force && r.cert != nil && (now.Before(r.refreshAt) || r.refreshing && now.Before(r.cert.notAfter)) {
+		defer r.mutex.Unlock()
+		return r.cert, nil
+	}
+	r.refreshing = true
+	r.mutex.Unlock()
+
+	cert, err := r.fetchCertificate(ctx)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.refreshing = false
+
+	if err != nil {
+		// the current certificate is still usable before it expired
+		if r.cert != nil && time.Now().Before(r.cert.notAfter) {
+			log.Sugar.Warnf("%s certificate refresh error=[%+v]", r.providerName, err)
+			r.refreshAt = time.Now().Add(dnscryptCertRetry)
+			if r.cert.notAfter.Before(r.refreshAt) {
+				r.refreshAt = r.cert.notAfter
+			}
+			return r.cert, nil
+		}
+		return nil, err
+	}
+
+	if r.cert == nil || r.cert.serial != cert.serial {
+		log.Sugar.Infof("%s certificate serial %d, not after %s", r.providerName, cert.serial, cert.notAfter)
+	}
+
+	r.cert = cert
+	r.refreshAt = time.Now().Add(dnscryptCertRefresh)
+	if cert.notAfter.Before(r.refreshAt) {
+		r.refreshAt = cert.notAfter
+	}
+	return cert, nil
+}
+
+// fetchCertificate query the certificates and return the valid one of the highest serial
+// with a new client key pair
+func (r *DNSCrypt) fetchCertificate(ctx context.Context) (*dnscryptCert, error) {
+	var req = new(dns.Msg)
+	req.SetQuestion(r.providerName, dns.TypeTXT)
+
+	var plain = &Plain{u: r.u, network: "udp", address: r.address}
+	resp, err := plain.exchange(ctx, "udp", req)
+	if err == nil && resp.Truncated {
+		resp, err = plain.exchange(ctx, "tcp", req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var best *dnscryptCert
+	var resolverPK [32]byte
+	for _, rr := range resp.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+
+		var bin []byte
+		for _, s := range txt.Txt {
+			bin = append(bin, txtBytes(s)...)
+		}
+
+		cert, pk, err := r.parseCertificate(bin)
+		if err != nil {
+			log.Sugar.Debugf("%s certificate %s", r.providerName, err)
+			continue
+		}
+
+		if best == nil || cert.serial > best.serial {
+			best, resolverPK = cert, pk
+		}
+	}
+
+	if best == nil {
+		return nil, errors.New("no valid certificate")
+	}
+
+	clientPK, clientSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	best.clientPK = *clientPK
+	box.Precompute(&best.sharedKey, &resolverPK, clientSK)
+
+	return best, nil
+}
+
+// parseCertificate verify the certificate and return it with the resolver public key
+//
+//	cert-magic(4) es-version(2) protocol-minor-version(2) signature(64)
+//	resolver-pk(32) client-magic(8) serial(4) ts-start(4) ts-end(4) extensions
+func (r *DNSCrypt) parseCertificate(bin []byte) (*dnscryptCert, [32]byte, error) {
+	var pk [32]byte
+	if len(bin) < dnscryptCertSize || string(bin[:4]) != dnscryptCertMagic {
+		return nil, pk, errors.New("invalid certificate")
+	}
+
+	if es := binary.BigEndian.Uint16(bin[4:6]); es != dnscryptESXSalsa20 {
+		return nil, pk, fmt.Errorf("unsupported es version %d", es)
+	}
+
+	if !ed25519.Verify(r.providerKey, bin[72:], bin[8:72]) {
+		return nil, pk, errors.New("invalid certificate signature")
+	}
+
+	var cert = &dnscryptCert{serial: binary.BigEndian.Uint32(bin[112:116])}
+	copy(pk[:], bin[72:104])
+	copy(cert.clientMagic[:], bin[104:112])
+
+	notBefore := time.Unix(int64(binary.BigEndian.Uint32(bin[116:120])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(bin[120:124])), 0)
+	if now := time.Now(); now.Before(notBefore) || now.After(cert.notAfter) {
+		return nil, pk, fmt.Errorf("certificate serial %d expired", cert.serial)
+	}
+
+	return cert, pk, nil
+}
+
+// exchange send the encrypted req over network and return the decrypted response
+//
+//	query:    client-magic(8) client-pk(32) client-nonce(12) encrypted-query
+//	response: resolver-magic(8) client-nonce(12) resolver-nonce(12) encrypted-response
+func (r *DNSCrypt) exchange(ctx context.Context, cert *dnscryptCert, network string, req *dns.Msg) (*dns.Msg, error) {
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var minSize = len(packed) + 1
+	if network == "udp" {
+		minSize = max(minSize, dnscryptQueryMin)
+	}
+
+	var nonce [24]byte
+	if _, err = rand.Read(nonce[:dnscryptHalfNonce]); err != nil {
+		return nil, err
+	}
+
+	var query = make([]byte, 0, 8+32+dnscryptHalfNonce+box.Overhead+minSize+dnscryptPadBlock)
+	query = append(query, cert.clientMagic[:]...)
+	query = append(query, cert.clientPK[:]...)
+	query = append(query, nonce[:dnscryptHalfNonce]...)
+	query = box.SealAfterPrecomputation(query, dnscryptPad(packed, minSize), &nonce, &cert.sharedKey)
+
+	raw, err := dnscryptRoundTrip(ctx, network, r.address, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) < 8+24+box.Overhead || !bytes.Equal(raw[:8], dnscryptResolverMagic) ||
+		!bytes.Equal(raw[8:8+dnscryptHalfNonce], nonce[:dnscryptHalfNonce]) {
+		return nil, errors.New("invalid response")
+	}
+
+	copy(nonce[:], raw[8:32])
+	plain, ok := box.OpenAfterPrecomputation(nil, raw[32:], &nonce, &cert.sharedKey)
+	if !ok {
+		return nil, errors.New("response decryption failed")
+	}
+
+	if plain, err = dnscryptUnpad(plain); err != nil {
+		return nil, err
+	}
+
+	var resp = new(dns.Msg)
+	if err = resp.Unpack(plain); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// dnscryptRoundTrip send query to address over network and return the response
+// tcp messages are prefixed with a two bytes length
+func dnscryptRoundTrip(ctx context.Context, network, address string, query []byte) ([]byte, error) {
+	var dialer = &net.Dialer{Timeout: timeoutDial}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	// the late response is useless, close the connection when ctx done
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	var deadline = time.Now().Add(timeoutPlain)
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if network == "udp" {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		var buf = make([]byte, dns.MaxMsgSize)
+		var n int
+		if n, err = conn.Read(buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	if _, err = conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err = io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+
+	var resp = make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// dnscryptPad pad packet with 0x80 and zeros to the multiple of 64, minSize at least
+func dnscryptPad(packet []byte, minSize int) []byte {
+	var size = (max(len(packet)+1, minSize) + dnscryptPadBlock - 1) / dnscryptPadBlock * dnscryptPadBlock
+	var padded = make([]byte, size)
+	copy(padded, packet)
+	padded[len(packet)] = 0x80
+	return padded
+}
+
+func dnscryptUnpad(padded []byte) ([]byte, error) {
+	var i = len(padded) - 1
+	for i >= 0 && padded[i] == 0 {
+		i--
+	}
+	if i < 0 || padded[i] != 0x80 {
+		return nil, errors.New("invalid padding")
+	}
+	return padded[:i], nil
+}
+
+// txtBytes decode the TXT character string in presentation format, \DDD and \X escaped
+func txtBytes(s string) []byte {
+	if !strings.Contains(s, `\`) {
+		return []byte(s)
+	}
+
+	var b = make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b = append(b, s[i])
+			continue
+		}
+
+		if i+3 < len(s) && isDigits(s[i+1:i+4]) {
+			n, _ := strconv.Atoi(s[i+1 : i+4])
+			b = append(b, byte(n))
+			i += 3
+			continue
+		}
+
+		b = append(b, s[i+1])
+		i++
+	}
+	return b
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
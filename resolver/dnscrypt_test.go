@@ -0,0 +1,240 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestParseStamp(t *testing.T) {
+	st, err := ParseStamp("sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Proto != StampDoH || st.Address != "1.0.0.1" || st.Hostname != "dns.cloudflare.com" || st.Path != "/dns-query" {
+		t.Errorf("ParseStamp() = %+v", st)
+	}
+
+	var dc = &Stamp{Proto: StampDNSCrypt, Address: "127.0.0.1:5443", PublicKey: make([]byte, 32), ProviderName: "2.dnscrypt-cert.example"}
+	if st, err = ParseStamp(dc.String()); err != nil {
+		t.Fatal(err)
+	}
+	if st.Address != dc.Address || st.ProviderName != dc.ProviderName || len(st.PublicKey) != 32 {
+		t.Errorf("ParseStamp(String()) = %+v", st)
+	}
+}
+
+// dnscryptServer the local DNSCrypt server answers every A query with 192.0.2.1
+type dnscryptServer struct {
+	conn        net.PacketConn
+	providerPK  ed25519.PublicKey
+	providerSK  ed25519.PrivateKey
+	resolverPK  *[32]byte
+	resolverSK  *[32]byte
+	clientMagic []byte
+}
+
+func startDNSCryptServer(t *testing.T) *dnscryptServer {
+	var s = new(dnscryptServer)
+	var err error
+	if s.providerPK, s.providerSK, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if s.resolverPK, s.resolverSK, err = box.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	s.clientMagic = s.resolverPK[:8]
+
+	if s.conn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.conn.Close() })
+
+	go s.serve()
+	return s
+}
+
+func (s *dnscryptServer) stamp() string {
+	var st = &Stamp{Proto: StampDNSCrypt, Address: s.conn.LocalAddr().String(), PublicKey: s.providerPK, ProviderName: "2.dnscrypt-cert.example"}
+	return st.String()
+}
+
+func (s *dnscryptServer) certificate() string {
+	var cert = []byte(dnscryptCertMagic)
+	cert = binary.BigEndian.AppendUint16(cert, dnscryptESXSalsa20)
+	cert = binary.BigEndian.AppendUint16(cert, 0)
+	cert = append(cert, make([]byte, ed25519.SignatureSize)...)
+	cert = append(cert, s.resolverPK[:]...)
+	cert = append(cert, s.clientMagic...)
+	cert = binary.BigEndian.AppendUint32(cert, 1)
+	cert = binary.BigEndian.AppendUint32(cert, uint32(time.Now().Add(-time.Hour).Unix()))
+	cert = binary.BigEndian.AppendUint32(cert, uint32(time.Now().Add(time.Hour).Unix()))
+	copy(cert[8:72], ed25519.Sign(s.providerSK, cert[72:]))
+
+	// presentation format of the character string
+	var b strings.Builder
+	for _, c := range cert {
+		if c >= 0x21 && c <= 0x7e && c != '\\' && c != '"' && c != ';' {
+			b.WriteByte(c)
+			continue
+		}
+		_, _ = fmt.Fprintf(&b, "\\%03d", c)
+	}
+	return b.String()
+}
+
+func (s *dnscryptServer) serve() {
+	var buf = make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var resp []byte
+		if n > 8 && bytes.Equal(buf[:8], s.clientMagic) {
+			resp = s.encrypted(buf[:n])
+		} else {
+			resp = s.plain(buf[:n])
+		}
+
+		if resp != nil {
+			_, _ = s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *dnscryptServer) plain(packet []byte) []byte {
+	var req = new(dns.Msg)
+	if err := req.Unpack(packet); err != nil {
+		return nil
+	}
+
+	var resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{s.certificate()},
+	})
+
+	packed, _ := resp.Pack()
+	return packed
+}
+
+func (s *dnscryptServer) encrypted(packet []byte) []byte {
+	var clientPK [32]byte
+	var nonce [24]byte
+	copy(clientPK[:], packet[8:40])
+	copy(nonce[:], packet[40:52])
+
+	padded, ok := box.Open(nil, packet[52:], &nonce, &clientPK, s.resolverSK)
+	if !ok {
+		return nil
+	}
+
+	query, err := dnscryptUnpad(padded)
+	if err != nil {
+		return nil
+	}
+
+	var req = new(dns.Msg)
+	if err = req.Unpack(query); err != nil {
+		return nil
+	}
+
+	var resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	})
+	packed, _ := resp.Pack()
+
+	_, _ = rand.Read(nonce[dnscryptHalfNonce:])
+	var out = append(append([]byte{}, dnscryptResolverMagic...), nonce[:]...)
+	return box.Seal(out, dnscryptPad(packed, len(packed)+1), &nonce, &clientPK, s.resolverSK)
+}
+
+func TestDNSCryptResolve(t *testing.T) {
+	var server = startDNSCryptServer(t)
+
+	u, err := url.Parse(server.stamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewResolver(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = r.Probe(context.Background()); err != nil {
+		t.Fatalf("Probe() error = %v", err)
+	}
+
+	var req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	resp := r.Resolve(context.Background(), req)
+	if resp == nil || len(resp.Answer) != 1 || resp.Id != req.Id {
+		t.Fatalf("Resolve() = %v", resp)
+	}
+	if a, ok := resp.Answer[0].(*dns.A); !ok || !a.A.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("Resolve() answer = %s", resp.Answer[0])
+	}
+}
+
+func TestDNSCryptPad(t *testing.T) {
+	for _, n := range []int{0, 1, 63, 64, 300} {
+		var packet = bytes.Repeat([]byte{0x80}, n)
+		padded := dnscryptPad(packet, dnscryptQueryMin)
+		if len(padded)%dnscryptPadBlock != 0 || len(padded) < dnscryptQueryMin {
+			t.Errorf("dnscryptPad(%d) len = %d", n, len(padded))
+		}
+		if got, err := dnscryptUnpad(padded); err != nil || !bytes.Equal(got, packet) {
+			t.Errorf("dnscryptUnpad(%d) = %d, %v", n, len(got), err)
+		}
+	}
+}
+
+func TestDNSCryptCertificateRetry(t *testing.T) {
+	// nothing is listening, the refresh fails
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var address = conn.LocalAddr().String()
+	_ = conn.Close()
+
+	var old = &dnscryptCert{serial: 1, notAfter: time.Now().Add(time.Hour)}
+	var r = &DNSCrypt{address: address, providerName: "2.dnscrypt-cert.example.", cert: old, refreshAt: time.Now().Add(-time.Second)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	cert, err := r.certificate(ctx, false)
+	if err != nil || cert != old {
+		t.Fatalf("certificate() = %v, %v, want the current one", cert, err)
+	}
+	if r.refreshing || !r.refreshAt.After(time.Now().Add(dnscryptCertRetry/2)) {
+		t.Errorf("certificate() refresh at %s, want retried after %s", r.refreshAt, dnscryptCertRetry)
+	}
+
+	// in flight refresh, the current one is returned without waiting
+	r.refreshAt, r.refreshing = time.Now().Add(-time.Second), true
+	if cert, err = r.certificate(ctx, false); err != nil || cert != old {
+		t.Errorf("certificate() refreshing = %v, %v, want the current one", cert, err)
+	}
+}
@@ -0,0 +1,138 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+)
+
+const (
+	mimeDNSMessage = "application/dns-message"
+)
+
+// DoH DNS over HTTPS resolver, RFC 8484
+type DoH struct {
+	u        *url.URL
+	endpoint string // https://host/path
+	client   *http.Client
+}
+
+func NewDoH(u *url.URL) *DoH {
+	return newDoH(u, (&url.URL{Scheme: "https", Host: u.Host, Path: u.Path}).String(), "", nil)
+}
+
+// newDoH return the DoH posting to endpoint, the connection is dialed to address
+// instead of the endpoint host when address is not empty
+func newDoH(u *url.URL, endpoint, address string, hashes [][]byte) *DoH {
+	var host = endpoint
+	if e, err := url.Parse(endpoint); err == nil {
+		host = e.Hostname()
+	}
+
+	var dialer = &net.Dialer{Timeout: timeoutDial}
+	var transport = &http.Transport{
+		TLSClientConfig:     newTLSConfig(host, hashes),
+		TLSHandshakeTimeout: timeoutHandshake,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        4,
+		IdleConnTimeout:     time.Minute,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if len(address) > 0 {
+				addr = address
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+
+	return &DoH{u: u, endpoint: endpoint, client: &http.Client{Transport: transport}}
+}
+
+func (r *DoH) Resolve(ctx context.Context, req *dns.Msg) *dns.Msg {
+	start := time.Now()
+	resp, err := r.exchange(ctx, req)
+	if err != nil {
+		log.Sugar.Errorf("%s %s [%s]", r.u.String(), err, req.Question[0].String())
+		return nil
+	}
+
+	log.Sugar.Debugf("%s response success, cost %s", r.u.String(), time.Since(start))
+	return resp
+}
+
+func (r *DoH) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 Section 4.1, the message id should be 0 for cache friendliness
+	var msg = req.Copy()
+	msg.Id = 0
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := postDNSMessage(ctx, r.client, r.endpoint, packed)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp = new(dns.Msg)
+	if err = resp.Unpack(raw); err != nil {
+		return nil, err
+	}
+
+	resp.Id = req.Id
+	return resp, nil
+}
+
+func (r *DoH) URL() *url.URL { return r.u }
+
+// Probe return the elapsed time of resolving the root NS records
+func (r *DoH) Probe(ctx context.Context) (time.Duration, error) {
+	var msg = new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+
+	ctx, cancel := context.WithTimeout(ctx, timeoutDial+timeoutHandshake)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := r.exchange(ctx, msg); err != nil {
+		return math.MaxInt64, err
+	}
+	return time.Since(start), nil
+}
+
+// postDNSMessage post body to endpoint and return the response body
+func postDNSMessage(ctx context.Context, client *http.Client, endpoint string, body []byte) ([]byte, error) {
+	return postHTTP(ctx, client, endpoint, mimeDNSMessage, body)
+}
+
+// postHTTP post body of contentType to endpoint and return the response body of the same type
+func postHTTP(ctx context.Context, client *http.Client, endpoint, contentType string, body []byte) ([]byte, error) {
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hr.Header.Set("Content-Type", contentType)
+	hr.Header.Set("Accept", contentType)
+
+	resp, err := client.Do(hr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+}
@@ -0,0 +1,158 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+)
+
+const (
+	timeoutDial      = time.Second
+	timeoutHandshake = time.Second
+)
+
+// DoT DNS over TLS resolver, RFC 7858
+type DoT struct {
+	u       *url.URL
+	address string // dial address, host:port
+	config  *tls.Config
+}
+
+func NewDoT(u *url.URL) *DoT {
+	return newDoT(u, u.Host, u.Hostname(), nil)
+}
+
+// newDoT return the DoT dialing address and verifying serverName,
+// the certificate chain must contain one of the hashes when hashes is not empty
+func newDoT(u *url.URL, address, serverName string, hashes [][]byte) *DoT {
+	var config = newTLSConfig(serverName, hashes)
+	config.MinVersion = tls.VersionTLS13
+	return &DoT{u: u, address: address, config: config}
+}
+
+func (r *DoT) Resolve(ctx context.Context, req *dns.Msg) *dns.Msg {
+	conn, _, err := r.getTLSConn(ctx)
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = conn.Close() }()
+
+	// the late response is useless, close the connection when ctx done
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			return nil
+		}
+	}
+
+	log.Sugar.Debugf("%s tls session resumed %t", r.u.Hostname(), conn.ConnectionState().DidResume)
+
+	var dnsConn = dns.Conn{Conn: conn}
+	start := time.Now()
+	if err = dnsConn.WriteMsg(req); err != nil {
+		log.Sugar.Errorf("sending request to %s error=[%+v]", r.u.String(), err)
+		return nil
+	}
+
+	var resp *dns.Msg
+	if resp, err = dnsConn.ReadMsg(); err != nil {
+		log.Sugar.Errorf("%s %s [%s]", r.u.String(), err, req.Question[0].String())
+		return nil
+	}
+	elapsed := time.Since(start)
+
+	if req.Id != resp.Id {
+		log.Sugar.Info("unmatched request and response")
+		return nil
+	}
+
+	log.Sugar.Debugf("%s response success, cost %s", r.u.String(), elapsed)
+
+	return resp
+}
+
+func (r *DoT) URL() *url.URL { return r.u }
+
+// Probe return the elapsed time of establishing tls connection
+func (r *DoT) Probe(ctx context.Context) (time.Duration, error) {
+	conn, elapse, err := r.getTLSConn(ctx)
+	if err != nil {
+		return elapse, err
+	}
+	_ = conn.Close()
+	return elapse, nil
+}
+
+func (r *DoT) getTLSConn(ctx context.Context) (*tls.Conn, time.Duration, error) {
+	ept := time.Now() // entry point time
+
+	// dial
+	dialer := &net.Dialer{Timeout: timeoutDial}
+	start := time.Now()
+	rawConn, err := dialer.DialContext(ctx, "tcp", r.address)
+	elapse := time.Since(start)
+	if err != nil {
+		return nil, math.MaxInt64, fmt.Errorf("dial [%+v], elapse %s", err, elapse)
+	}
+
+	// set deadline, the earlier one of handshake timeout and ctx deadline
+	conn := tls.Client(rawConn, r.config)
+	deadline := time.Now().Add(timeoutHandshake)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	start = time.Now()
+	err = conn.SetDeadline(deadline)
+	elapse = time.Since(start)
+	if err != nil {
+		_ = conn.Close()
+		return nil, math.MaxInt64, fmt.Errorf("set deadline [%+v], elapse %s", err, elapse)
+	}
+
+	// handshake
+	start = time.Now()
+	err = conn.HandshakeContext(ctx)
+	elapse = time.Since(start)
+	if err != nil {
+		_ = conn.Close()
+		return nil, math.MaxInt64, fmt.Errorf("handshake [%+v], elapse %s", err, elapse)
+	}
+
+	return conn, time.Since(ept), nil
+}
+
+// newTLSConfig return the tls config verifying serverName,
+// the certificate chain must contain one of the hashes when hashes is not empty
+// hash is the SHA256 digest of the TBS certificate, see Stamp.Hashes
+func newTLSConfig(serverName string, hashes [][]byte) *tls.Config {
+	var config = &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12, ClientSessionCache: tls.NewLRUClientSessionCache(0)}
+	if len(hashes) == 0 {
+		return config
+	}
+
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		for _, cert := range state.PeerCertificates {
+			digest := sha256.Sum256(cert.RawTBSCertificate)
+			for _, hash := range hashes {
+				if bytes.Equal(digest[:], hash) {
+					return nil
+				}
+			}
+		}
+		return errors.New("certificate hash unmatched")
+	}
+	return config
+}
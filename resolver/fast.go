@@ -2,19 +2,17 @@ package resolver
 
 import (
 	"context"
-	"crypto/tls"
 	"net/url"
 	"time"
 
 	"github.com/treemana/godot/log"
 )
 
-// GetFastFromURLs return the fastest(establish connection) *Resolver from raw urls string when the fastest exist
+// GetFastFromURLs return the fastest(establish connection) Resolver from raw urls string when the fastest exist
 // or return nil
-func GetFastFromURLs(rawURLs []string) *Resolver {
-	var fast *Resolver
+func GetFastFromURLs(rawURLs []string) Resolver {
+	var fast Resolver
 	var min, elapse time.Duration
-	var conn *tls.Conn
 	var hostMap = make(map[string]struct{}, len(rawURLs))
 
 	for _, rawURL := range rawURLs {
@@ -29,12 +27,16 @@ func GetFastFromURLs(rawURLs []string) *Resolver {
 		}
 		hostMap[u.Host] = struct{}{}
 
-		r := NewResolver(u)
-		if conn, elapse, err = r.getTLSConn(context.TODO()); err != nil {
-			log.Sugar.Warnf("%s tls connection [%+v]", u.Host, err)
+		var r Resolver
+		if r, err = NewResolver(u); err != nil {
+			log.Sugar.Warnf("%s resolver error=[%+v]", rawURL, err)
+			continue
+		}
+
+		if elapse, err = r.Probe(context.TODO()); err != nil {
+			log.Sugar.Warnf("%s probe [%+v]", u.Host, err)
 			continue
 		}
-		_ = conn.Close()
 
 		if fast != nil && elapse >= min {
 			continue
@@ -47,32 +49,28 @@ func GetFastFromURLs(rawURLs []string) *Resolver {
 	return fast
 }
 
-func GetFastFromURLGroups(groups [][]string) []*Resolver {
+// GetFastFromURLGroups return the fastest Resolver of every group, in the order of groups
+func GetFastFromURLGroups(groups [][]string) []Resolver {
 
 	if groups == nil {
-		return make([]*Resolver, 0)
+		return make([]Resolver, 0)
 	}
 
-	var hostMap = make(map[string]*Resolver)
+	var hostMap = make(map[string]struct{})
+	var resolvers = make([]Resolver, 0, len(groups))
 	for _, group := range groups {
 		r := GetFastFromURLs(group)
 		if r == nil {
 			continue
 		}
 
-		if _, ok := hostMap[r.u.Host]; ok {
+		if _, ok := hostMap[r.URL().Host]; ok {
 			continue
 		}
 
-		hostMap[r.u.Host] = r
-	}
-
-	var resolvers = make([]*Resolver, 0, len(hostMap))
-	var i int
-	for _, r := range hostMap {
+		hostMap[r.URL().Host] = struct{}{}
+		log.Sugar.Infof("upstream resolver %d %s", len(resolvers), r.URL().Host)
 		resolvers = append(resolvers, r)
-		log.Sugar.Infof("upstream resolver %d %s", i, r.u.Host)
-		i++
 	}
 
 	return resolvers
@@ -0,0 +1,142 @@
+package resolver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// HPKE RFC 9180 base mode with DHKEM(X25519, HKDF-SHA256), HKDF-SHA256 and AES-128-GCM,
+// the only suite required by Oblivious DoH
+const (
+	hpkeKEMX25519     uint16 = 0x0020
+	hpkeKDFSHA256     uint16 = 0x0001
+	hpkeAEADAES128GCM uint16 = 0x0001
+
+	hpkeNk = 16 // AEAD key size
+	hpkeNn = 12 // AEAD nonce size
+	hpkeNh = 32 // KDF output size
+)
+
+// hpkeContext the encryption context of one message, the sequence number is always zero
+type hpkeContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+}
+
+func hpkeLabeledExtract(suiteID []byte, salt []byte, label string, ikm []byte) []byte {
+	var labeled = append(append(append([]byte("HPKE-v1"), suiteID...), label...), ikm...)
+	prk, _ := hkdf.Extract(sha256.New, labeled, salt)
+	return prk
+}
+
+func hpkeLabeledExpand(suiteID []byte, prk []byte, label string, info []byte, length int) []byte {
+	var labeled = binary.BigEndian.AppendUint16(nil, uint16(length))
+	labeled = append(append(append(append(labeled, "HPKE-v1"...), suiteID...), label...), info...)
+	okm, _ := hkdf.Expand(sha256.New, prk, string(labeled), length)
+	return okm
+}
+
+// hpkeSharedSecret the DHKEM ExtractAndExpand of dh and enc || pkR
+func hpkeSharedSecret(dh, enc, pkR []byte) []byte {
+	var suiteID = binary.BigEndian.AppendUint16([]byte("KEM"), hpkeKEMX25519)
+	var prk = hpkeLabeledExtract(suiteID, nil, "eae_prk", dh)
+	return hpkeLabeledExpand(suiteID, prk, "shared_secret", append(append([]byte{}, enc...), pkR...), hpkeNh)
+}
+
+func hpkeSuiteID() []byte {
+	var suiteID = []byte("HPKE")
+	suiteID = binary.BigEndian.AppendUint16(suiteID, hpkeKEMX25519)
+	suiteID = binary.BigEndian.AppendUint16(suiteID, hpkeKDFSHA256)
+	return binary.BigEndian.AppendUint16(suiteID, hpkeAEADAES128GCM)
+}
+
+// hpkeKeySchedule the base mode key schedule without psk
+func hpkeKeySchedule(sharedSecret, info []byte) (*hpkeContext, error) {
+	var suiteID = hpkeSuiteID()
+
+	var ksc = []byte{0x00} // mode_base
+	ksc = append(ksc, hpkeLabeledExtract(suiteID, nil, "psk_id_hash", nil)...)
+	ksc = append(ksc, hpkeLabeledExtract(suiteID, nil, "info_hash", info)...)
+
+	var secret = hpkeLabeledExtract(suiteID, sharedSecret, "secret", nil)
+
+	block, err := aes.NewCipher(hpkeLabeledExpand(suiteID, secret, "key", ksc, hpkeNk))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hpkeContext{
+		aead:           aead,
+		baseNonce:      hpkeLabeledExpand(suiteID, secret, "base_nonce", ksc, hpkeNn),
+		exporterSecret: hpkeLabeledExpand(suiteID, secret, "exp", ksc, hpkeNh),
+	}, nil
+}
+
+// hpkeSetupBaseS return the encapsulated key and the sender context to pkR
+func hpkeSetupBaseS(pkR, info []byte) ([]byte, *hpkeContext, error) {
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hpkeSetupBaseSWithKey(pkR, info, skE)
+}
+
+// hpkeSetupBaseSWithKey the sender setup with the ephemeral key skE
+func hpkeSetupBaseSWithKey(pkR, info []byte, skE *ecdh.PrivateKey) ([]byte, *hpkeContext, error) {
+	pub, err := ecdh.X25519().NewPublicKey(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dh, err := skE.ECDH(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var enc = skE.PublicKey().Bytes()
+	ctx, err := hpkeKeySchedule(hpkeSharedSecret(dh, enc, pkR), info)
+	return enc, ctx, err
+}
+
+// hpkeSetupBaseR return the receiver context of enc
+func hpkeSetupBaseR(enc []byte, skR *ecdh.PrivateKey, info []byte) (*hpkeContext, error) {
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	dh, err := skR.ECDH(pkE)
+	if err != nil {
+		return nil, err
+	}
+
+	return hpkeKeySchedule(hpkeSharedSecret(dh, enc, skR.PublicKey().Bytes()), info)
+}
+
+func (c *hpkeContext) seal(aad, plaintext []byte) []byte {
+	return c.aead.Seal(nil, c.baseNonce, plaintext, aad)
+}
+
+func (c *hpkeContext) open(aad, ciphertext []byte) ([]byte, error) {
+	plaintext, err := c.aead.Open(nil, c.baseNonce, ciphertext, aad)
+	if err != nil {
+		return nil, errors.New("hpke open failed")
+	}
+	return plaintext, nil
+}
+
+func (c *hpkeContext) export(exporterContext []byte, length int) []byte {
+	return hpkeLabeledExpand(hpkeSuiteID(), c.exporterSecret, "sec", exporterContext, length)
+}
@@ -0,0 +1,80 @@
+package resolver
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestHPKEVectors RFC 9180 Appendix A.1.1, DHKEM(X25519, HKDF-SHA256),
+// HKDF-SHA256, AES-128-GCM, base mode
+func TestHPKEVectors(t *testing.T) {
+	var info = unhex(t, "4f6465206f6e2061204772656369616e2055726e")
+
+	skE, err := ecdh.X25519().NewPrivateKey(unhex(t, "52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	skR, err := ecdh.X25519().NewPrivateKey(unhex(t, "4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkR = unhex(t, "3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d")
+	if !bytes.Equal(skR.PublicKey().Bytes(), pkR) {
+		t.Fatalf("pkRm = %x", skR.PublicKey().Bytes())
+	}
+
+	enc, sender, err := hpkeSetupBaseSWithKey(pkR, info, skE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := unhex(t, "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431"); !bytes.Equal(enc, want) {
+		t.Errorf("enc = %x, want %x", enc, want)
+	}
+
+	dh, _ := skE.ECDH(skR.PublicKey())
+	if got, want := hpkeSharedSecret(dh, enc, pkR), unhex(t, "fe0e18c9f024ce43799ae393c7e8fe8fce9d218875e8227b0187c04e7d2ea1fc"); !bytes.Equal(got, want) {
+		t.Errorf("shared_secret = %x, want %x", got, want)
+	}
+	if want := unhex(t, "56d890e5accaaf011cff4b7d"); !bytes.Equal(sender.baseNonce, want) {
+		t.Errorf("base_nonce = %x, want %x", sender.baseNonce, want)
+	}
+	if want := unhex(t, "45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8"); !bytes.Equal(sender.exporterSecret, want) {
+		t.Errorf("exporter_secret = %x, want %x", sender.exporterSecret, want)
+	}
+
+	// sequence number 0
+	var pt = unhex(t, "4265617574792069732074727574682c20747275746820626561757479")
+	var aad = unhex(t, "436f756e742d30")
+	var ct = unhex(t, "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a")
+	if got := sender.seal(aad, pt); !bytes.Equal(got, ct) {
+		t.Errorf("seal() = %x, want %x", got, ct)
+	}
+
+	receiver, err := hpkeSetupBaseR(enc, skR, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := receiver.open(aad, ct); err != nil || !bytes.Equal(got, pt) {
+		t.Errorf("open() = %x, %v, want %x", got, err, pt)
+	}
+
+	for _, test := range []struct{ context, value string }{
+		{"", "3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee"},
+		{"00", "2e8f0b54673c7029649d4eb9d5e33bf1872cf76d623ff164ac185da9e88c21a5"},
+		{"54657374436f6e74657874", "e9e43065102c3836401bed8c3c3c75ae46be1639869391d62c61f1ec7af54931"},
+	} {
+		if got, want := receiver.export(unhex(t, test.context), 32), unhex(t, test.value); !bytes.Equal(got, want) {
+			t.Errorf("export(%s) = %x, want %x", test.context, got, want)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package resolver
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/util"
+)
+
+const (
+	mimeObliviousDNS = "application/oblivious-dns-message"
+
+	odohVersion       uint16 = 0x0001
+	odohQuery         byte   = 0x01
+	odohResponse      byte   = 0x02
+	odohConfigsPath          = "/.well-known/odohconfigs"
+	odohConfigRefresh        = time.Hour
+	odohPadBlock             = 128 // the plaintext dns message is padded to the multiple of it
+)
+
+// odohConfig the supported target config, RFC 9230 Section 6.1
+type odohConfig struct {
+	publicKey []byte
+	keyID     []byte
+}
+
+// ODoH Oblivious DNS over HTTPS resolver, RFC 9230
+// the query is encrypted to the target and sent through the proxy,
+// the proxy sees the client but not the query, the target sees the query but not the client
+//
+//	odoh://target.example/dns-query?proxy=https://proxy.example/proxy
+//
+// the target configs are pinned by "config", the base64url ObliviousDoHConfigs,
+// or fetched from "configs", the out-of-band url, or fetched through the proxy,
+// the target is never connected directly
+type ODoH struct {
+	u       *url.URL
+	target  *url.URL // https://target.example/dns-query
+	proxy   string
+	configs string // the url of the target configs
+	client  *http.Client
+	pinned  *odohConfig
+
+	mutex     sync.Mutex
+	config    *odohConfig
+	refreshAt time.Time
+}
+
+func NewODoH(u *url.URL) (*ODoH, error) {
+	var proxy = u.Query().Get("proxy")
+	if len(proxy) == 0 {
+		return nil, errors.New("odoh proxy missing")
+	}
+
+	if p, err := url.Parse(proxy); err != nil || p.Scheme != "https" {
+		return nil, fmt.Errorf("odoh invalid proxy %s", proxy)
+	}
+
+	var target = &url.URL{Scheme: "https", Host: u.Host, Path: u.Path}
+
+	var pinned *odohConfig
+	if raw := u.Query().Get("config"); len(raw) > 0 {
+		configs, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(raw, "="))
+		if err != nil {
+			return nil, fmt.Errorf("odoh invalid config error=[%+v]", err)
+		}
+		if pinned, err = odohParseConfigs(configs); err != nil {
+			return nil, err
+		}
+	}
+
+	// the well-known configs of the target through the proxy by default
+	var configs = u.Query().Get("configs")
+	if len(configs) == 0 {
+		configs = proxy + "?" + url.Values{"targethost": {target.Host}, "targetpath": {odohConfigsPath}}.Encode()
+	} else if c, err := url.Parse(configs); err != nil || c.Scheme != "https" {
+		return nil, fmt.Errorf("odoh invalid configs %s", configs)
+	}
+
+	var dialer = &net.Dialer{Timeout: timeoutDial}
+	var transport = &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: timeoutHandshake,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        4,
+		IdleConnTimeout:     time.Minute,
+	}
+
+	return &ODoH{
+		u:       u,
+		target:  target,
+		proxy:   proxy,
+		configs: configs,
+		client:  &http.Client{Transport: transport},
+		pinned:  pinned,
+	}, nil
+}
+
+func (r *ODoH) Resolve(ctx context.Context, req *dns.Msg) *dns.Msg {
+	start := time.Now()
+	resp, err := r.exchange(ctx, req)
+	if err != nil {
+		log.Sugar.Errorf("%s %s [%s]", r.target.Host, err, req.Question[0].String())
+		return nil
+	}
+
+	log.Sugar.Debugf("%s response success, cost %s", r.target.Host, time.Since(start))
+	return resp
+}
+
+func (r *ODoH) URL() *url.URL { return r.u }
+
+// Probe return the elapsed time of resolving the root NS records through the proxy
+func (r *ODoH) Probe(ctx context.Context) (time.Duration, error) {
+	var msg = new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+
+	ctx, cancel := context.WithTimeout(ctx, 2*(timeoutDial+timeoutHandshake))
+	defer cancel()
+
+	start := time.Now()
+	if _, err := r.exchange(ctx, msg); err != nil {
+		return math.MaxInt64, err
+	}
+	return time.Since(start), nil
+}
+
+func (r *ODoH) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	config, err := r.configuration(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the message id is useless for the target, and ECS reveals the client
+	var msg = req.Copy()
+	msg.Id = 0
+	util.DNSSubnetRemove(msg)
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var qPlain = odohPlaintext(packed)
+	enc, hctx, err := hpkeSetupBaseS(config.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, err
+	}
+
+	var query = odohMessage(odohQuery, config.keyID, append(enc, hctx.seal(odohAAD(odohQuery, config.keyID), qPlain)...))
+
+	var endpoint = r.proxy + "?" + url.Values{"targethost": {r.target.Host}, "targetpath": {r.target.Path}}.Encode()
+	raw, err := postHTTP(ctx, r.client, endpoint, mimeObliviousDNS, query)
+	if err != nil {
+		// the target config may be rotated
+		r.expire()
+		return nil, err
+	}
+
+	kind, nonce, encrypted, err := odohParseMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	if kind != odohResponse {
+		return nil, fmt.Errorf("unexpected message type %d", kind)
+	}
+
+	aead, aeadNonce, err := odohResponseKey(hctx, qPlain, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	rPlain, err := aead.Open(nil, aeadNonce, encrypted, odohAAD(odohResponse, nonce))
+	if err != nil {
+		r.expire()
+		return nil, errors.New("response decryption failed")
+	}
+
+	body, err := odohParsePlaintext(rPlain)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp = new(dns.Msg)
+	if err = resp.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	resp.Id = req.Id
+	return resp, nil
+}
+
+// configuration return the target config, fetch it again when it should be refreshed
+func (r *ODoH) configuration(ctx context.Context) (*odohConfig, error) {
+	if r.pinned != nil {
+		return r.pinned, nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.config != nil && time.Now().Before(r.refreshAt) {
+		return r.config, nil
+	}
+
+	config, err := r.fetchConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.config = config
+	r.refreshAt = time.Now().Add(odohConfigRefresh)
+	return config, nil
+}
+
+// expire let the target config fetched again by the next request
+func (r *ODoH) expire() {
+	r.mutex.Lock()
+	r.refreshAt = time.Time{}
+	r.mutex.Unlock()
+}
+
+// fetchConfig fetch the ObliviousDoHConfigs of the target from r.configs, the
+// target would see the address of godot if fetched directly, return the first
+// supported one
+func (r *ODoH) fetchConfig(ctx context.Context) (*odohConfig, error) {
+	hr, err := http.NewRequestWithContext(ctx, http.MethodGet, r.configs, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.client.Do(hr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("odoh configs http status %s", resp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, math.MaxUint16+2))
+	if err != nil {
+		return nil, err
+	}
+
+	return odohParseConfigs(raw)
+}
+
+// odohParseConfigs return the first supported config
+//
+//	ObliviousDoHConfigs: length(2) { version(2) length(2) contents }...
+//	contents: kem_id(2) kdf_id(2) aead_id(2) length(2) public_key
+func odohParseConfigs(raw []byte) (*odohConfig, error) {
+	if len(raw) < 2 || len(raw) < 2+int(binary.BigEndian.Uint16(raw)) {
+		return nil, errors.New("odoh configs truncated")
+	}
+
+	var configs = raw[2 : 2+int(binary.BigEndian.Uint16(raw))]
+	for len(configs) >= 4 {
+		version := binary.BigEndian.Uint16(configs)
+		length := int(binary.BigEndian.Uint16(configs[2:]))
+		if len(configs) < 4+length {
+			break
+		}
+
+		contents := configs[4 : 4+length]
+		configs = configs[4+length:]
+
+		if version != odohVersion || len(contents) < 8 {
+			continue
+		}
+
+		if binary.BigEndian.Uint16(contents) != hpkeKEMX25519 ||
+			binary.BigEndian.Uint16(contents[2:]) != hpkeKDFSHA256 ||
+			binary.BigEndian.Uint16(contents[4:]) != hpkeAEADAES128GCM {
+			continue
+		}
+
+		pkLen := int(binary.BigEndian.Uint16(contents[6:]))
+		if len(contents) != 8+pkLen {
+			continue
+		}
+
+		return &odohConfig{publicKey: contents[8:], keyID: odohKeyID(contents)}, nil
+	}
+
+	return nil, errors.New("odoh no supported config")
+}
+
+// odohKeyID Expand(Extract("", contents), "odoh key id", Nh)
+func odohKeyID(contents []byte) []byte {
+	prk, _ := hkdf.Extract(sha256.New, contents, nil)
+	keyID, _ := hkdf.Expand(sha256.New, prk, "odoh key id", hpkeNh)
+	return keyID
+}
+
+// odohPlaintext length(2) dns_message length(2) padding
+func odohPlaintext(packed []byte) []byte {
+	var padding = (odohPadBlock - (len(packed)+4)%odohPadBlock) % odohPadBlock
+	var plain = binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+	plain = append(plain, packed...)
+	plain = binary.BigEndian.AppendUint16(plain, uint16(padding))
+	return append(plain, make([]byte, padding)...)
+}
+
+func odohParsePlaintext(plain []byte) ([]byte, error) {
+	if len(plain) < 2 || len(plain) < 2+int(binary.BigEndian.Uint16(plain)) {
+		return nil, errors.New("odoh plaintext truncated")
+	}
+	return plain[2 : 2+int(binary.BigEndian.Uint16(plain))], nil
+}
+
+// odohMessage message_type(1) length(2) key_id length(2) encrypted_message
+// the key_id of response is the response nonce
+func odohMessage(kind byte, keyID, encrypted []byte) []byte {
+	var msg = []byte{kind}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(keyID)))
+	msg = append(msg, keyID...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(encrypted)))
+	return append(msg, encrypted...)
+}
+
+func odohParseMessage(raw []byte) (kind byte, keyID, encrypted []byte, err error) {
+	if len(raw) < 3 {
+		return 0, nil, nil, errors.New("odoh message truncated")
+	}
+
+	kind = raw[0]
+	n := int(binary.BigEndian.Uint16(raw[1:]))
+	if len(raw) < 3+n+2 {
+		return 0, nil, nil, errors.New("odoh message truncated")
+	}
+	keyID = raw[3 : 3+n]
+
+	raw = raw[3+n:]
+	n = int(binary.BigEndian.Uint16(raw))
+	if len(raw) < 2+n {
+		return 0, nil, nil, errors.New("odoh message truncated")
+	}
+
+	return kind, keyID, raw[2 : 2+n], nil
+}
+
+// odohAAD message_type(1) length(2) key_id
+func odohAAD(kind byte, keyID []byte) []byte {
+	return append(binary.BigEndian.AppendUint16([]byte{kind}, uint16(len(keyID))), keyID...)
+}
+
+// odohResponseKey derive the response AEAD and nonce, RFC 9230 Section 6.4
+//
+//	secret = context.Export("odoh response", Nk)
+//	salt = Q_plain || len(resp_nonce) || resp_nonce
+//	prk = Extract(salt, secret)
+//	key = Expand(prk, "odoh key", Nk)
+//	nonce = Expand(prk, "odoh nonce", Nn)
+func odohResponseKey(hctx *hpkeContext, qPlain, respNonce []byte) (cipher.AEAD, []byte, error) {
+	var secret = hctx.export([]byte("odoh response"), hpkeNk)
+
+	var salt = append([]byte{}, qPlain...)
+	salt = binary.BigEndian.AppendUint16(salt, uint16(len(respNonce)))
+	salt = append(salt, respNonce...)
+
+	prk, err := hkdf.Extract(sha256.New, secret, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := hkdf.Expand(sha256.New, prk, "odoh key", hpkeNk)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce, err := hkdf.Expand(sha256.New, prk, "odoh nonce", hpkeNn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	return aead, nonce, err
+}
@@ -0,0 +1,235 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// odohServer the local stand-in of both the proxy and the target
+type odohServer struct {
+	*httptest.Server
+	key      *ecdh.PrivateKey
+	contents []byte
+	proxied  atomic.Int32
+	leaked   atomic.Bool // the proxy saw the query name
+	fetched  atomic.Int32
+	direct   atomic.Bool // the target saw the configs fetched without the proxy
+}
+
+func startODoHServer(t *testing.T) *odohServer {
+	var s = new(odohServer)
+	var err error
+	if s.key, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	s.contents = binary.BigEndian.AppendUint16(nil, hpkeKEMX25519)
+	s.contents = binary.BigEndian.AppendUint16(s.contents, hpkeKDFSHA256)
+	s.contents = binary.BigEndian.AppendUint16(s.contents, hpkeAEADAES128GCM)
+	s.contents = binary.BigEndian.AppendUint16(s.contents, uint16(len(s.key.PublicKey().Bytes())))
+	s.contents = append(s.contents, s.key.PublicKey().Bytes()...)
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc("GET "+odohConfigsPath, s.configs)
+	mux.HandleFunc("POST /proxy", s.proxy)
+	mux.HandleFunc("GET /proxy", s.proxy)
+	mux.HandleFunc("POST /dns-query", s.target)
+
+	s.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// encoded return the ObliviousDoHConfigs of the target
+func (s *odohServer) encoded() []byte {
+	var config = binary.BigEndian.AppendUint16(nil, odohVersion)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(s.contents)))
+	config = append(config, s.contents...)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(config))), config...)
+}
+
+func (s *odohServer) configs(w http.ResponseWriter, r *http.Request) {
+	s.fetched.Add(1)
+	if len(r.Header.Get("Via")) == 0 {
+		s.direct.Store(true)
+	}
+	_, _ = w.Write(s.encoded())
+}
+
+func (s *odohServer) proxy(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if bytes.Contains(body, []byte("example")) {
+		s.leaked.Store(true)
+	}
+
+	var target = (&url.URL{Scheme: "https", Host: r.URL.Query().Get("targethost"), Path: r.URL.Query().Get("targetpath")}).String()
+	forward, err := http.NewRequest(r.Method, target, bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	forward.Header.Set("Via", "1.1 proxy")
+	if r.Method == http.MethodPost {
+		s.proxied.Add(1)
+		forward.Header.Set("Content-Type", mimeObliviousDNS)
+	}
+
+	resp, err := s.Client().Do(forward)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func (s *odohServer) target(w http.ResponseWriter, r *http.Request) {
+	raw, _ := io.ReadAll(r.Body)
+	kind, keyID, encrypted, err := odohParseMessage(raw)
+	if err != nil || kind != odohQuery || !bytes.Equal(keyID, odohKeyID(s.contents)) || len(encrypted) < 32 {
+		http.Error(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+
+	hctx, err := hpkeSetupBaseR(encrypted[:32], s.key, []byte("odoh query"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	qPlain, err := hctx.open(odohAAD(odohQuery, keyID), encrypted[32:])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	body, _ := odohParsePlaintext(qPlain)
+	var req = new(dns.Msg)
+	if err = req.Unpack(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	})
+	packed, _ := resp.Pack()
+
+	var nonce = make([]byte, max(hpkeNn, hpkeNk))
+	_, _ = rand.Read(nonce)
+	aead, aeadNonce, err := odohResponseKey(hctx, qPlain, nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", mimeObliviousDNS)
+	_, _ = w.Write(odohMessage(odohResponse, nonce, aead.Seal(nil, aeadNonce, odohPlaintext(packed), odohAAD(odohResponse, nonce))))
+}
+
+func TestODoHResolve(t *testing.T) {
+	var server = startODoHServer(t)
+	var host = server.Listener.Addr().String()
+
+	u, err := url.Parse("odoh://" + host + "/dns-query?proxy=" + url.QueryEscape("https://"+host+"/proxy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewODoH(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.client = server.Client()
+
+	var req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	resp := r.Resolve(context.Background(), req)
+	if resp == nil || len(resp.Answer) != 1 || resp.Id != req.Id {
+		t.Fatalf("Resolve() = %v", resp)
+	}
+	if a, ok := resp.Answer[0].(*dns.A); !ok || !a.A.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("Resolve() answer = %s", resp.Answer[0])
+	}
+
+	if server.proxied.Load() != 1 {
+		t.Errorf("proxied = %d, want 1", server.proxied.Load())
+	}
+	if server.leaked.Load() {
+		t.Error("the proxy saw the query name")
+	}
+	if server.fetched.Load() != 1 || server.direct.Load() {
+		t.Errorf("configs fetched %d, directly %t, want once through the proxy", server.fetched.Load(), server.direct.Load())
+	}
+}
+
+func TestODoHConfigs(t *testing.T) {
+	var server = startODoHServer(t)
+	var host = server.Listener.Addr().String()
+	var proxy = url.QueryEscape("https://" + host + "/proxy")
+
+	var req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	// pinned, never fetched
+	var pinned = base64.RawURLEncoding.EncodeToString(server.encoded())
+	u, _ := url.Parse("odoh://" + host + "/dns-query?proxy=" + proxy + "&config=" + pinned)
+	r, err := NewODoH(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.client = server.Client()
+	if resp := r.Resolve(context.Background(), req); resp == nil || len(resp.Answer) != 1 {
+		t.Errorf("Resolve() pinned = %v", resp)
+	}
+	if server.fetched.Load() != 0 {
+		t.Errorf("configs fetched %d with the pinned config, want 0", server.fetched.Load())
+	}
+
+	// the out-of-band source
+	var mirror = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(server.encoded())
+	}))
+	defer mirror.Close()
+
+	u, _ = url.Parse("odoh://" + host + "/dns-query?proxy=" + proxy + "&configs=" + url.QueryEscape(mirror.URL+"/odohconfigs"))
+	if r, err = NewODoH(u); err != nil {
+		t.Fatal(err)
+	}
+	r.client = mirror.Client()
+	if _, err = r.configuration(context.Background()); err != nil || server.fetched.Load() != 0 {
+		t.Errorf("configuration() out-of-band = %v, target fetched %d", err, server.fetched.Load())
+	}
+
+	for _, query := range []string{"&config=!!", "&config=AAAA", "&configs=http%3A%2F%2Fmirror.example"} {
+		u, _ = url.Parse("odoh://target.example/dns-query?proxy=" + proxy + query)
+		if _, err = NewODoH(u); err == nil {
+			t.Errorf("NewODoH(%s) error = nil", query)
+		}
+	}
+}
+
+func TestNewODoHWithoutProxy(t *testing.T) {
+	if _, err := NewODoH(&url.URL{Scheme: "odoh", Host: "target.example", Path: "/dns-query"}); err == nil {
+		t.Error("NewODoH() without proxy error = nil")
+	}
+}
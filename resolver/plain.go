@@ -0,0 +1,104 @@
+package resolver
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+)
+
+const (
+	defaultPlainPort = "53"
+	timeoutPlain     = 2 * time.Second // read and write timeout without ctx deadline
+)
+
+// Plain DNS over UDP or TCP resolver, RFC 1035
+// UDP request is retried over TCP when the response truncated
+type Plain struct {
+	u       *url.URL
+	network string // udp or tcp
+	address string
+}
+
+func NewPlain(u *url.URL) *Plain {
+	var address = u.Host
+	if len(u.Port()) == 0 {
+		address = net.JoinHostPort(u.Hostname(), defaultPlainPort)
+	}
+
+	return &Plain{u: u, network: u.Scheme, address: address}
+}
+
+func (r *Plain) Resolve(ctx context.Context, req *dns.Msg) *dns.Msg {
+	// randomised message id, the source port is randomised by every new udp socket
+	var msg = req.Copy()
+	msg.Id = dns.Id()
+
+	resp, err := r.exchange(ctx, r.network, msg)
+	if err == nil && resp.Truncated && r.network == "udp" {
+		log.Sugar.Debugf("%s truncated, retry over tcp [%s]", r.u.String(), req.Question[0].String())
+		resp, err = r.exchange(ctx, "tcp", msg)
+	}
+
+	if err != nil {
+		log.Sugar.Errorf("%s %s [%s]", r.u.String(), err, req.Question[0].String())
+		return nil
+	}
+
+	if resp.Id != msg.Id || len(resp.Question) != 1 || !questionEqual(resp.Question[0], msg.Question[0]) {
+		log.Sugar.Info("unmatched request and response")
+		return nil
+	}
+
+	resp.Id = req.Id
+	return resp
+}
+
+func (r *Plain) exchange(ctx context.Context, network string, msg *dns.Msg) (*dns.Msg, error) {
+	var client = &dns.Client{Net: network, DialTimeout: timeoutDial, ReadTimeout: timeoutPlain, WriteTimeout: timeoutPlain}
+
+	conn, err := client.DialContext(ctx, r.address)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	// the late response is useless, close the connection when ctx done
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	start := time.Now()
+	resp, _, err := client.ExchangeWithConnContext(ctx, msg, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Sugar.Debugf("%s response success, cost %s", r.u.String(), time.Since(start))
+	return resp, nil
+}
+
+func (r *Plain) URL() *url.URL { return r.u }
+
+// Probe return the elapsed time of resolving the root NS records
+func (r *Plain) Probe(ctx context.Context) (time.Duration, error) {
+	var msg = new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+
+	ctx, cancel := context.WithTimeout(ctx, timeoutDial+timeoutHandshake)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := r.exchange(ctx, r.network, msg); err != nil {
+		return math.MaxInt64, err
+	}
+	return time.Since(start), nil
+}
+
+func questionEqual(a, b dns.Question) bool {
+	return a.Qtype == b.Qtype && a.Qclass == b.Qclass && dns.CanonicalName(a.Name) == dns.CanonicalName(b.Name)
+}
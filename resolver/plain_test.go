@@ -0,0 +1,91 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+)
+
+func TestMain(m *testing.M) {
+	_ = log.Init(log.Config{STDOUT: true, Level: 1})
+	os.Exit(m.Run())
+}
+
+// startPlainServer serve udp and tcp on the same local port
+// the udp response is truncated when truncate is true
+func startPlainServer(t *testing.T, truncate bool) string {
+	var handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		var resp = new(dns.Msg)
+		resp.SetReply(req)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok && truncate {
+			resp.Truncated = true
+		} else {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, 1),
+			})
+		}
+		_ = w.WriteMsg(resp)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var udp = &dns.Server{PacketConn: pc, Handler: handler}
+	var tcp = &dns.Server{Listener: l, Handler: handler}
+	go func() { _ = udp.ActivateAndServe() }()
+	go func() { _ = tcp.ActivateAndServe() }()
+	t.Cleanup(func() {
+		_ = udp.Shutdown()
+		_ = tcp.Shutdown()
+	})
+
+	return pc.LocalAddr().String()
+}
+
+func TestPlainResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		scheme   string
+		truncate bool
+	}{
+		{name: "udp", scheme: "udp"},
+		{name: "tcp", scheme: "tcp"},
+		{name: "udp truncated retry over tcp", scheme: "udp", truncate: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewResolver(&url.URL{Scheme: tt.scheme, Host: startPlainServer(t, tt.truncate)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var req = new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			req.Id = 1234
+
+			resp := r.Resolve(context.Background(), req)
+			if resp == nil {
+				t.Fatal("Resolve() = nil")
+			}
+			if resp.Id != req.Id {
+				t.Errorf("Resolve() id = %d, want %d", resp.Id, req.Id)
+			}
+			if resp.Truncated || len(resp.Answer) != 1 {
+				t.Errorf("Resolve() truncated = %t, answer = %d", resp.Truncated, len(resp.Answer))
+			}
+		})
+	}
+}
@@ -2,98 +2,77 @@ package resolver
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
-	"math"
 	"net"
 	"net/url"
 	"time"
 
 	"github.com/miekg/dns"
-
-	"github.com/treemana/godot/log"
 )
 
-const (
-	timeoutDial      = time.Second
-	timeoutHandshake = time.Second
-)
+// Resolver resolve the dns request by the upstream server
+type Resolver interface {
+	// Resolve return the response of req, nil when failed
+	Resolve(ctx context.Context, req *dns.Msg) *dns.Msg
 
-type Resolver struct {
-	u      *url.URL
-	config *tls.Config
-}
+	// Probe return the elapsed time of establishing connection with the server
+	Probe(ctx context.Context) (time.Duration, error)
 
-func NewResolver(u *url.URL) *Resolver {
-	return &Resolver{
-		u:      u,
-		config: &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS13, ClientSessionCache: tls.NewLRUClientSessionCache(0)},
-	}
+	// URL return the url of the server
+	URL() *url.URL
 }
 
-func (r *Resolver) Resolve(ctx context.Context, req *dns.Msg) *dns.Msg {
-	conn, _, err := r.getTLSConn(ctx)
-	if err != nil {
-		return nil
-	}
-	defer func() { _ = conn.Close() }()
-
-	fmt.Println(r.u.Hostname(), conn.ConnectionState().DidResume)
-
-	var dnsConn = dns.Conn{Conn: conn}
-	start := time.Now()
-	if err = dnsConn.WriteMsg(req); err != nil {
-		log.Sugar.Errorf("sending request to %s error=[%+v]", r.u.String(), err)
-		return nil
-	}
-
-	var resp *dns.Msg
-	if resp, err = dnsConn.ReadMsg(); err != nil {
-		log.Sugar.Errorf("%s %s [%s]", r.u.String(), err, req.Question[0].String())
-		return nil
+// NewResolver return the Resolver of u by the scheme
+//
+//	tls://host:port DNS over TLS
+//	udp://host:port DNS over UDP, port 53 by default
+//	tcp://host:port DNS over TCP, port 53 by default
+//	https://host/path DNS over HTTPS
+//	sdns://... DNS stamp of DNSCrypt, DoH, DoT or plain DNS
+//	odoh://target/path?proxy=https://proxy/path Oblivious DNS over HTTPS
+func NewResolver(u *url.URL) (Resolver, error) {
+	switch u.Scheme {
+	case "tls":
+		return NewDoT(u), nil
+	case "udp", "tcp":
+		return NewPlain(u), nil
+	case "https":
+		return NewDoH(u), nil
+	case "sdns":
+		return newStampResolver(u)
+	case "odoh":
+		return NewODoH(u)
+	default:
+		return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
 	}
-	elapsed := time.Since(start)
-
-	if req.Id != resp.Id {
-		log.Sugar.Info("unmatched request and response")
-		return nil
-	}
-
-	log.Sugar.Debugf("%s response success, cost %s", r.u.String(), elapsed)
-
-	return resp
 }
 
-func (r *Resolver) getTLSConn(ctx context.Context) (*tls.Conn, time.Duration, error) {
-	ept := time.Now() // entry point time
-
-	// dial
-	dialer := &net.Dialer{Timeout: timeoutDial}
-	start := time.Now()
-	rawConn, err := dialer.DialContext(ctx, "tcp", r.u.Host)
-	elapse := time.Since(start)
+// newStampResolver return the Resolver of the DNS stamp u
+func newStampResolver(u *url.URL) (Resolver, error) {
+	st, err := ParseStamp(u.String())
 	if err != nil {
-		return nil, math.MaxInt64, fmt.Errorf("dial [%+v], elapse %s", err, elapse)
+		return nil, err
 	}
 
-	// set deadline
-	conn := tls.Client(rawConn, r.config)
-	start = time.Now()
-	err = conn.SetDeadline(time.Now().Add(timeoutHandshake))
-	elapse = time.Since(start)
-	if err != nil {
-		_ = conn.Close()
-		return nil, math.MaxInt64, fmt.Errorf("set deadline [%+v], elapse %s", err, elapse)
+	switch st.Proto {
+	case StampPlain:
+		return &Plain{u: u, network: "udp", address: st.address(defaultPlainPort)}, nil
+	case StampDNSCrypt:
+		return newDNSCrypt(u, st), nil
+	case StampDoH:
+		var endpoint = (&url.URL{Scheme: "https", Host: st.Hostname, Path: st.Path}).String()
+		var address string
+		if len(st.Address) > 0 {
+			address = st.address("443")
+		}
+		return newDoH(u, endpoint, address, st.Hashes), nil
+	case StampDoT:
+		var host = st.Hostname
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return newDoT(u, st.address("853"), host, st.Hashes), nil
+	default:
+		return nil, fmt.Errorf("unsupported stamp protocol 0x%02x", st.Proto)
 	}
-
-	// handshake
-	start = time.Now()
-	err = conn.Handshake()
-	elapse = time.Since(start)
-	if err != nil {
-		_ = conn.Close()
-		return nil, math.MaxInt64, fmt.Errorf("handshake [%+v], elapse %s", err, elapse)
-	}
-
-	return conn, time.Since(ept), nil
 }
@@ -0,0 +1,204 @@
+package resolver
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DNS stamp protocols, https://dnscrypt.info/stamps-specifications
+const (
+	StampPlain    byte = 0x00
+	StampDNSCrypt byte = 0x01
+	StampDoH      byte = 0x02
+	StampDoT      byte = 0x03
+)
+
+// Stamp the decoded DNS stamp, sdns://...
+type Stamp struct {
+	Proto byte
+	Props uint64 // informal properties, dnssec, no logs and no filter
+
+	Address string // ip[:port], may be empty for DoH and DoT
+
+	// DNSCrypt
+	PublicKey    []byte // the provider ed25519 public key
+	ProviderName string // the provider name, 2.dnscrypt-cert.example.com
+
+	// DoH and DoT
+	Hashes    [][]byte // SHA256 digests of the TBS certificates in the chain
+	Hostname  string   // the server name, host[:port]
+	Path      string   // the DoH path
+	Bootstrap []string // the bootstrap resolvers
+}
+
+// ParseStamp decode the DNS stamp sdns://...
+func ParseStamp(raw string) (*Stamp, error) {
+	if !strings.HasPrefix(raw, "sdns://") {
+		return nil, errors.New("stamp without sdns:// scheme")
+	}
+
+	bin, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(raw[len("sdns://"):], "="))
+	if err != nil {
+		return nil, fmt.Errorf("stamp decode error=[%+v]", err)
+	}
+
+	if len(bin) < 9 {
+		return nil, errors.New("stamp too short")
+	}
+
+	var st = &Stamp{Proto: bin[0], Props: binary.LittleEndian.Uint64(bin[1:9])}
+	var d = stampDecoder{bin: bin[9:]}
+
+	switch st.Proto {
+	case StampPlain:
+		st.Address = string(d.lp())
+	case StampDNSCrypt:
+		st.Address = string(d.lp())
+		st.PublicKey = d.lp()
+		st.ProviderName = string(d.lp())
+		if d.err == nil && len(st.PublicKey) != 32 {
+			return nil, fmt.Errorf("stamp invalid public key length %d", len(st.PublicKey))
+		}
+	case StampDoH, StampDoT:
+		st.Address = string(d.lp())
+		st.Hashes = d.vlp()
+		st.Hostname = string(d.lp())
+		if st.Proto == StampDoH {
+			st.Path = string(d.lp())
+		}
+		if len(d.bin) > 0 {
+			for _, b := range d.vlp() {
+				st.Bootstrap = append(st.Bootstrap, string(b))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("stamp unsupported protocol 0x%02x", st.Proto)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return st, nil
+}
+
+// String encode the stamp as sdns://...
+func (st *Stamp) String() string {
+	var bin = []byte{st.Proto}
+	bin = binary.LittleEndian.AppendUint64(bin, st.Props)
+
+	switch st.Proto {
+	case StampPlain:
+		bin = appendLP(bin, []byte(st.Address))
+	case StampDNSCrypt:
+		bin = appendLP(bin, []byte(st.Address))
+		bin = appendLP(bin, st.PublicKey)
+		bin = appendLP(bin, []byte(st.ProviderName))
+	case StampDoH, StampDoT:
+		bin = appendLP(bin, []byte(st.Address))
+		bin = appendVLP(bin, st.Hashes)
+		bin = appendLP(bin, []byte(st.Hostname))
+		if st.Proto == StampDoH {
+			bin = appendLP(bin, []byte(st.Path))
+		}
+		if len(st.Bootstrap) > 0 {
+			var bootstrap = make([][]byte, 0, len(st.Bootstrap))
+			for _, b := range st.Bootstrap {
+				bootstrap = append(bootstrap, []byte(b))
+			}
+			bin = appendVLP(bin, bootstrap)
+		}
+	}
+
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(bin)
+}
+
+// address return the address with the default port when port missing
+// return the host of hostname when address is empty
+func (st *Stamp) address(port string) string {
+	var address = st.Address
+	if len(address) == 0 {
+		address = st.Hostname
+	}
+
+	if len(address) == 0 {
+		return ""
+	}
+
+	if strings.HasPrefix(address, "[") && strings.HasSuffix(address, "]") {
+		return net.JoinHostPort(address[1:len(address)-1], port)
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, port)
+	}
+
+	return address
+}
+
+type stampDecoder struct {
+	bin []byte
+	err error
+}
+
+// lp read a length-prefixed string
+func (d *stampDecoder) lp() []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if len(d.bin) == 0 || len(d.bin) < 1+int(d.bin[0]) {
+		d.err = errors.New("stamp truncated")
+		return nil
+	}
+
+	var n = int(d.bin[0])
+	var b = d.bin[1 : 1+n]
+	d.bin = d.bin[1+n:]
+	return b
+}
+
+// vlp read a variable length-prefixed set, the 0x80 bit of length means more follows
+func (d *stampDecoder) vlp() [][]byte {
+	var set [][]byte
+	for d.err == nil {
+		if len(d.bin) == 0 {
+			d.err = errors.New("stamp truncated")
+			return nil
+		}
+
+		var more = d.bin[0]&0x80 != 0
+		d.bin[0] &^= 0x80
+		if b := d.lp(); len(b) > 0 {
+			set = append(set, b)
+		}
+
+		if !more {
+			break
+		}
+	}
+	return set
+}
+
+func appendLP(bin, b []byte) []byte {
+	return append(append(bin, byte(len(b))), b...)
+}
+
+func appendVLP(bin []byte, set [][]byte) []byte {
+	if len(set) == 0 {
+		return append(bin, 0)
+	}
+
+	for i, b := range set {
+		var n = byte(len(b))
+		if i < len(set)-1 {
+			n |= 0x80
+		}
+		bin = append(append(bin, n), b...)
+	}
+	return bin
+}
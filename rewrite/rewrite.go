@@ -0,0 +1,317 @@
+package rewrite
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/metrics"
+	"github.com/treemana/godot/model"
+	"github.com/treemana/godot/util"
+)
+
+const (
+	ttlDefault = 300
+
+	metricApplied = "rewrite_applied" // number of the rules applied
+)
+
+// rewrite actions
+const (
+	ActionCNAME    = "cname"    // resolve target instead, answered with the CNAME or flattened
+	ActionAnswer   = "answer"   // replace the A and AAAA answers with ips
+	ActionStrip    = "strip"    // remove the answers of types
+	ActionNXDomain = "nxdomain" // NXDOMAIN when any A or AAAA answer is in cidrs
+)
+
+// RuleConfig represents a rewrite rule
+type RuleConfig struct {
+	// Domain the names matched, see util.DomainRule, all the names when empty
+	Domain string `json:"domain"`
+
+	// Action of the rule, ActionCNAME, ActionAnswer, ActionStrip or ActionNXDomain
+	Action string `json:"action"`
+
+	// Target the name resolved instead of ActionCNAME
+	Target string `json:"target"`
+
+	// Flatten the ActionCNAME answers are the records of the target owned by
+	// the name asked, without the CNAME
+	Flatten bool `json:"flatten"`
+
+	// IPs the answers of ActionAnswer, the A answers are the IPv4 ones and the
+	// AAAA answers are the IPv6 ones
+	IPs []string `json:"ips"`
+
+	// Types the record types removed by ActionStrip, ["AAAA"]
+	Types []string `json:"types"`
+
+	// CIDRs the networks of the addresses answered NXDOMAIN by ActionNXDomain
+	CIDRs []string `json:"cidrs"`
+}
+
+// Config represents the rewrite settings
+type Config struct {
+	// TTL of the CNAME and the fixed answers, second, 300 when zero
+	TTL uint32 `json:"ttl"`
+
+	// Rules applied in order
+	Rules []RuleConfig `json:"rules"`
+
+	// SafeSearch the built-in rules of the search engines, applied before Rules
+	SafeSearch SafeSearchConfig `json:"safe_search"`
+}
+
+// rule a compiled rewrite rule
+type rule struct {
+	domain  *util.DomainRule // nil matches all
+	action  string
+	target  string
+	flatten bool
+	v4, v6  []net.IP
+	types   []uint16
+	cidrs   []netip.Prefix
+}
+
+func (r *rule) match(name string) bool {
+	return r.domain == nil || r.domain.Match(name)
+}
+
+func (r *rule) String() string {
+	if r.domain == nil {
+		return "* " + r.action
+	}
+	return r.domain.String() + " " + r.action
+}
+
+// Engine rewrite the requests and the responses by the rules in order
+type Engine struct {
+	ttl   uint32
+	rules []*rule
+	safe  *safeSearch
+}
+
+// New return the engine even without rule, the safe search may be enabled by
+// the client groups
+func New(config Config) (*Engine, error) {
+	var e = &Engine{ttl: config.TTL}
+	if e.ttl == 0 {
+		e.ttl = ttlDefault
+	}
+
+	var err error
+	if e.safe, err = newSafeSearch(config.SafeSearch); err != nil {
+		return nil, fmt.Errorf("rewrite safe search error=[%+v]", err)
+	}
+
+	for i, c := range config.Rules {
+		r, err := newRule(c)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite rule %d error=[%+v]", i, err)
+		}
+		e.rules = append(e.rules, r)
+	}
+
+	return e, nil
+}
+
+// Rewrites report whether any rule rewrites the responses
+func (e *Engine) Rewrites() bool {
+	return e != nil && slices.ContainsFunc(e.rules, func(r *rule) bool { return r.action != ActionCNAME })
+}
+
+func newRule(c RuleConfig) (*rule, error) {
+	var r = &rule{action: c.Action, flatten: c.Flatten}
+	if len(c.Domain) > 0 {
+		var err error
+		if r.domain, err = util.NewDomainRule(c.Domain); err != nil {
+			return nil, err
+		}
+	}
+
+	switch r.action {
+	case ActionCNAME:
+		if _, ok := dns.IsDomainName(c.Target); !ok || len(c.Target) == 0 {
+			return nil, fmt.Errorf("invalid target %s", c.Target)
+		}
+		r.target = dns.Fqdn(c.Target)
+	case ActionAnswer:
+		for _, raw := range c.IPs {
+			var ip = net.ParseIP(raw)
+			switch {
+			case ip == nil:
+				return nil, fmt.Errorf("invalid ip %s", raw)
+			case ip.To4() != nil:
+				r.v4 = append(r.v4, ip.To4())
+			default:
+				r.v6 = append(r.v6, ip)
+			}
+		}
+	case ActionStrip:
+		for _, raw := range c.Types {
+			t, ok := dns.StringToType[strings.ToUpper(raw)]
+			if !ok {
+				return nil, fmt.Errorf("unknown type %s", raw)
+			}
+			r.types = append(r.types, t)
+		}
+	case ActionNXDomain:
+		for _, raw := range c.CIDRs {
+			prefix, err := netip.ParsePrefix(raw)
+			if err != nil {
+				return nil, err
+			}
+			r.cidrs = append(r.cidrs, prefix.Masked())
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %s", r.action)
+	}
+
+	return r, nil
+}
+
+// Start download the Google search domains of the safe search until ctx done
+func (e *Engine) Start(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	e.safe.start(ctx)
+}
+
+// Request redirect dt to the safe search target of the search engine when it is
+// enabled, otherwise to the target of the first matched ActionCNAME rule
+func (e *Engine) Request(dt *model.DT) {
+	if e == nil || len(dt.Request.Question) == 0 {
+		return
+	}
+
+	if e.redirect(dt) {
+		return
+	}
+
+	var q = dt.Request.Question[0]
+	for _, r := range e.rules {
+		if r.action != ActionCNAME || !r.match(q.Name) {
+			continue
+		}
+
+		metrics.Add(metricApplied, 1)
+		log.Sugar.Debugf("sn=%d, id=%d, rewrite [%s] by [%s] to [%s]", dt.SN, dt.Request.Id, q.Name, r, r.target)
+
+		dt.Redirect([]dns.RR{&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: q.Qclass, Ttl: e.ttl},
+			Target: r.target,
+		}})
+		dt.Flatten = dt.Flatten || r.flatten
+		return
+	}
+}
+
+// Response rewrite dt.Response by all the rules matched the name asked except
+// ActionCNAME in order, the rules after ActionNXDomain applied are skipped,
+// the redirected response is matched by the name asked, not the target
+func (e *Engine) Response(dt *model.DT) {
+	var resp = dt.Response
+	if e == nil || resp == nil || len(resp.Question) == 0 {
+		return
+	}
+
+	var q = dt.Asked()
+	for _, r := range e.rules {
+		if r.action == ActionCNAME || !r.match(q.Name) {
+			continue
+		}
+
+		var applied bool
+		switch r.action {
+		case ActionAnswer:
+			applied = e.answer(resp, r)
+		case ActionStrip:
+			applied = strip(resp, r.types)
+		case ActionNXDomain:
+			applied = nxdomain(resp, r.cidrs)
+		}
+		if !applied {
+			continue
+		}
+
+		metrics.Add(metricApplied, 1)
+		log.Sugar.Debugf("sn=%d, id=%d, rewrite [%s] by [%s]", dt.SN, dt.Request.Id, q.Name, r)
+
+		// the answers are changed, not validated any more
+		resp.AuthenticatedData = false
+		if r.action == ActionNXDomain {
+			return
+		}
+	}
+}
+
+// answer replace the answers of the A and AAAA question with the ips of r
+func (e *Engine) answer(resp *dns.Msg, r *rule) bool {
+	var q = resp.Question[0]
+	var ips []net.IP
+	switch q.Qtype {
+	case dns.TypeA:
+		ips = r.v4
+	case dns.TypeAAAA:
+		ips = r.v6
+	default:
+		return false
+	}
+
+	var hdr = dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: q.Qclass, Ttl: e.ttl}
+	resp.Rcode = dns.RcodeSuccess
+	resp.Answer, resp.Ns = nil, nil
+	for _, ip := range ips {
+		if q.Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip})
+			continue
+		}
+		resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+	}
+	return true
+}
+
+// strip remove the answers of types and their signatures
+func strip(resp *dns.Msg, types []uint16) bool {
+	var n = len(resp.Answer)
+	resp.Answer = slices.DeleteFunc(resp.Answer, func(rr dns.RR) bool {
+		var t = rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			t = sig.TypeCovered
+		}
+		return slices.Contains(types, t)
+	})
+	return len(resp.Answer) < n
+}
+
+// nxdomain answer NXDOMAIN when any A or AAAA answer is in cidrs
+func nxdomain(resp *dns.Msg, cidrs []netip.Prefix) bool {
+	for _, rr := range resp.Answer {
+		var ip = util.DNSSplitAnswer(rr)
+		if ip == nil {
+			continue
+		}
+
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+
+		if slices.ContainsFunc(cidrs, func(prefix netip.Prefix) bool { return prefix.Contains(addr) }) {
+			resp.Rcode = dns.RcodeNameError
+			resp.Answer, resp.Ns, resp.Extra = nil, nil, slices.DeleteFunc(resp.Extra, func(rr dns.RR) bool {
+				return rr.Header().Rrtype != dns.TypeOPT
+			})
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,250 @@
+package rewrite
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/model"
+)
+
+func TestMain(m *testing.M) {
+	_ = log.Init(log.Config{STDOUT: true, Level: 1})
+	os.Exit(m.Run())
+}
+
+func newTestEngine(t *testing.T) *Engine {
+	e, err := New(Config{Rules: []RuleConfig{
+		{Domain: "app.example", Action: ActionCNAME, Target: "app.cdn.example"},
+		{Domain: "flat.example", Action: ActionCNAME, Target: "app.cdn.example", Flatten: true},
+		{Domain: ".corp.example", Action: ActionAnswer, IPs: []string{"10.0.0.10"}},
+		{Domain: ".v4only.example", Action: ActionStrip, Types: []string{"aaaa"}},
+		{Action: ActionNXDomain, CIDRs: []string{"198.51.100.0/24"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// upstream return dt asked name with the upstream response of the answers rrs
+func upstream(t *testing.T, name string, qtype uint16, rrs ...string) *model.DT {
+	var req = new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	var resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.AuthenticatedData = true
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return &model.DT{Request: req, Response: resp}
+}
+
+func TestNew(t *testing.T) {
+	// the safe search may be enabled by the client groups
+	if e, err := New(Config{}); e == nil || err != nil {
+		t.Errorf("New() without rules = %v, %v, want the engine", e, err)
+	}
+
+	for _, c := range []RuleConfig{
+		{Action: "unknown"},
+		{Action: ActionCNAME},
+		{Action: ActionAnswer, IPs: []string{"10.0.0"}},
+		{Action: ActionStrip, Types: []string{"NOPE"}},
+		{Action: ActionNXDomain, CIDRs: []string{"10.0.0.0"}},
+		{Domain: "/[/", Action: ActionStrip},
+	} {
+		if _, err := New(Config{Rules: []RuleConfig{c}}); err == nil {
+			t.Errorf("New(%+v) succeeded, want error", c)
+		}
+	}
+}
+
+func TestRequest(t *testing.T) {
+	var e = newTestEngine(t)
+
+	var req = new(dns.Msg)
+	req.SetQuestion("app.example.", dns.TypeA)
+	var dt = &model.DT{Request: req}
+	e.Request(dt)
+	if req.Question[0].Name != "app.cdn.example." || dt.Flatten {
+		t.Fatalf("Request() = %s flatten %t, want app.cdn.example.", req.Question[0].Name, dt.Flatten)
+	}
+
+	dt.Response = upstream(t, "app.cdn.example.", dns.TypeA, "app.cdn.example. 60 IN A 192.0.2.1").Response
+	if resp := dt.Restored(); len(resp.Answer) != 2 || resp.Answer[0].Header().Rrtype != dns.TypeCNAME || resp.Question[0].Name != "app.example." {
+		t.Errorf("Restored() = %v, want the CNAME prepended", resp)
+	}
+
+	req = new(dns.Msg)
+	req.SetQuestion("flat.example.", dns.TypeA)
+	dt = &model.DT{Request: req}
+	e.Request(dt)
+	dt.Response = upstream(t, "app.cdn.example.", dns.TypeA, "app.cdn.example. 60 IN CNAME edge.cdn.example.", "edge.cdn.example. 60 IN A 192.0.2.1").Response
+	if resp := dt.Restored(); len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "flat.example." {
+		t.Errorf("Restored() flatten = %v, want the A owned by flat.example.", resp.Answer)
+	}
+
+	req = new(dns.Msg)
+	req.SetQuestion("other.example.", dns.TypeA)
+	dt = &model.DT{Request: req}
+	if e.Request(dt); len(dt.Alias) != 0 || req.Question[0].Name != "other.example." {
+		t.Errorf("Request() not matched = %s, want unchanged", req.Question[0].Name)
+	}
+}
+
+func TestResponse(t *testing.T) {
+	var e = newTestEngine(t)
+
+	var dt = upstream(t, "www.corp.example.", dns.TypeA, "www.corp.example. 60 IN A 192.0.2.1")
+	dt.Response.Rcode = dns.RcodeNameError
+	e.Response(dt)
+	if resp := dt.Response; resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.10")) || resp.AuthenticatedData {
+		t.Errorf("Response() answer = %v, want 10.0.0.10", resp)
+	}
+
+	dt = upstream(t, "www.corp.example.", dns.TypeAAAA, "www.corp.example. 60 IN AAAA 2001:db8::1")
+	if e.Response(dt); len(dt.Response.Answer) != 0 {
+		t.Errorf("Response() answer AAAA = %v, want NODATA", dt.Response.Answer)
+	}
+
+	dt = upstream(t, "x.v4only.example.", dns.TypeANY, "x.v4only.example. 60 IN A 192.0.2.1", "x.v4only.example. 60 IN AAAA 2001:db8::1")
+	if e.Response(dt); len(dt.Response.Answer) != 1 || dt.Response.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("Response() strip = %v, want the A only", dt.Response.Answer)
+	}
+
+	dt = upstream(t, "typo.example.", dns.TypeA, "typo.example. 60 IN A 198.51.100.7")
+	if e.Response(dt); dt.Response.Rcode != dns.RcodeNameError || len(dt.Response.Answer) != 0 {
+		t.Errorf("Response() nxdomain = %s %v, want NXDOMAIN", dns.RcodeToString[dt.Response.Rcode], dt.Response.Answer)
+	}
+
+	dt = upstream(t, "good.example.", dns.TypeA, "good.example. 60 IN A 192.0.2.1")
+	if e.Response(dt); dt.Response.Rcode != dns.RcodeSuccess || len(dt.Response.Answer) != 1 || !dt.Response.AuthenticatedData {
+		t.Errorf("Response() not matched = %v, want unchanged", dt.Response)
+	}
+}
+
+func TestResponseRedirected(t *testing.T) {
+	var e = newTestEngine(t)
+
+	// the name asked matches the strip rule, the target does not
+	var dt = upstream(t, "x.v4only.example.", dns.TypeANY)
+	dt.Redirect([]dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "x.v4only.example.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+		Target: "x.cdn.example.",
+	}})
+	dt.Response = upstream(t, "x.cdn.example.", dns.TypeANY, "x.cdn.example. 60 IN A 192.0.2.1", "x.cdn.example. 60 IN AAAA 2001:db8::1").Response
+	if e.Response(dt); len(dt.Response.Answer) != 1 || dt.Response.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("Response() redirected strip = %v, want the A only", dt.Response.Answer)
+	}
+
+	// the target matches the strip rule, the name asked does not
+	dt = upstream(t, "y.example.", dns.TypeANY)
+	dt.Redirect([]dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "y.example.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+		Target: "y.v4only.example.",
+	}})
+	dt.Response = upstream(t, "y.v4only.example.", dns.TypeANY, "y.v4only.example. 60 IN A 192.0.2.1", "y.v4only.example. 60 IN AAAA 2001:db8::1").Response
+	if e.Response(dt); len(dt.Response.Answer) != 2 {
+		t.Errorf("Response() redirected target = %v, want unchanged", dt.Response.Answer)
+	}
+
+	if !e.Rewrites() {
+		t.Error("Rewrites() = false, want true")
+	}
+	if e, _ = New(Config{Rules: []RuleConfig{{Domain: "app.example", Action: ActionCNAME, Target: "app.cdn.example"}}}); e.Rewrites() {
+		t.Error("Rewrites() of the cname rule only = true, want false")
+	}
+}
+
+func TestSafeSearch(t *testing.T) {
+	e, err := New(Config{SafeSearch: SafeSearchConfig{YouTube: YouTubeModerate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var on, off = true, false
+	var tests = []struct {
+		name   string
+		policy *model.Policy
+		target string
+	}{
+		{"www.google.com.", nil, ""},
+		{"www.google.com.", &model.Policy{SafeSearch: &on}, "forcesafesearch.google.com."},
+		{"WWW.Google.Co.UK.", &model.Policy{SafeSearch: &on}, "forcesafesearch.google.com."},
+		{"google.de.", &model.Policy{SafeSearch: &on}, "forcesafesearch.google.com."},
+		{"www.bing.com.", &model.Policy{SafeSearch: &on}, "strict.bing.com."},
+		{"duckduckgo.com.", &model.Policy{SafeSearch: &on}, "safe.duckduckgo.com."},
+		{"m.youtube.com.", &model.Policy{SafeSearch: &on}, "restrictmoderate.youtube.com."},
+		{"mail.google.com.", &model.Policy{SafeSearch: &on}, ""},
+		{"www.google.com.", &model.Policy{SafeSearch: &off}, ""},
+	}
+
+	for _, test := range tests {
+		var req = new(dns.Msg)
+		req.SetQuestion(test.name, dns.TypeA)
+		var dt = &model.DT{Request: req, Policy: test.policy}
+		e.Request(dt)
+
+		var target string
+		if len(dt.Alias) > 0 {
+			target = req.Question[0].Name
+		}
+		if target != test.target {
+			t.Errorf("Request(%s, %v) = [%s], want [%s]", test.name, test.policy.SafeSearchOr(false), target, test.target)
+		}
+	}
+
+	// enabled globally, disabled by the client group
+	if e, err = New(Config{SafeSearch: SafeSearchConfig{Enabled: true}}); err != nil {
+		t.Fatal(err)
+	}
+	for policy, redirected := range map[*model.Policy]bool{nil: true, {SafeSearch: &off}: false} {
+		var req = new(dns.Msg)
+		req.SetQuestion("www.youtube.com.", dns.TypeAAAA)
+		var dt = &model.DT{Request: req, Policy: policy}
+		if e.Request(dt); (len(dt.Alias) > 0) != redirected || (redirected && req.Question[0].Name != "restrict.youtube.com.") {
+			t.Errorf("Request(www.youtube.com., %v) = %s, want redirected %t", policy, req.Question[0].Name, redirected)
+		}
+	}
+
+	if _, err = New(Config{SafeSearch: SafeSearchConfig{YouTube: "unknown"}}); err == nil {
+		t.Error("New() of the unknown youtube mode succeeded")
+	}
+}
+
+func TestGoogleDomains(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(".google.com\n.google.new\n"))
+	}))
+	defer server.Close()
+
+	e, err := New(Config{SafeSearch: SafeSearchConfig{GoogleDomains: server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.safe.target("www.google.new.") != "" {
+		t.Fatal("target() of the domain not downloaded yet is not empty")
+	}
+	if err = e.safe.update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if e.safe.target("www.google.new.") != targetGoogle || e.safe.target("www.google.de.") != "" {
+		t.Error("the downloaded google domains are not swapped in")
+	}
+
+	if _, err = parseGoogleDomains(strings.NewReader("<html>\n")); err == nil {
+		t.Error("parseGoogleDomains() of the html succeeded")
+	}
+}
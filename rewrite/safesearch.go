@@ -0,0 +1,222 @@
+package rewrite
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/metrics"
+	"github.com/treemana/godot/model"
+)
+
+// the restricted modes of YouTube
+const (
+	YouTubeStrict   = "strict"   // restrict.youtube.com, the default
+	YouTubeModerate = "moderate" // restrictmoderate.youtube.com
+)
+
+const (
+	targetGoogle          = "forcesafesearch.google.com."
+	targetBing            = "strict.bing.com."
+	targetDuckDuckGo      = "safe.duckduckgo.com."
+	targetYouTubeStrict   = "restrict.youtube.com."
+	targetYouTubeModerate = "restrictmoderate.youtube.com."
+
+	googleRefresh = 24 * time.Hour
+	maxGoogleSize = 1 << 20
+
+	metricSafeSearch = "rewrite_safe_search" // number of the requests redirected by the safe search
+)
+
+// googleDomains the Google search domains, the format of
+// https://www.google.com/supported_domains, ".google.com" per line
+//
+//go:embed google_domains.txt
+var googleDomains string
+
+var (
+	bingNames       = []string{"bing.com.", "www.bing.com."}
+	duckDuckGoNames = []string{"duckduckgo.com.", "www.duckduckgo.com.", "start.duckduckgo.com."}
+	youTubeNames    = []string{
+		"www.youtube.com.", "m.youtube.com.", "youtubei.googleapis.com.",
+		"youtube.googleapis.com.", "www.youtube-nocookie.com.",
+	}
+)
+
+// SafeSearchConfig represents the safe search settings
+type SafeSearchConfig struct {
+	// Enabled for all the clients, the client groups may enable or disable it
+	Enabled bool `json:"enabled"`
+
+	// YouTube the restricted mode, YouTubeStrict when empty
+	YouTube string `json:"youtube"`
+
+	// GoogleDomains the URL of the Google search domains list downloaded every
+	// day, "https://www.google.com/supported_domains", the embedded list is
+	// used until downloaded
+	GoogleDomains string `json:"google_domains"`
+}
+
+// safeSearch the search engine names and their safe search targets
+type safeSearch struct {
+	enabled bool
+	youTube string
+	url     string
+
+	// targets by the canonical name, swapped when the Google domains updated
+	targets atomic.Pointer[map[string]string]
+}
+
+func newSafeSearch(config SafeSearchConfig) (*safeSearch, error) {
+	var s = &safeSearch{enabled: config.Enabled, url: config.GoogleDomains}
+	switch config.YouTube {
+	case "", YouTubeStrict:
+		s.youTube = targetYouTubeStrict
+	case YouTubeModerate:
+		s.youTube = targetYouTubeModerate
+	default:
+		return nil, fmt.Errorf("unknown youtube mode %s", config.YouTube)
+	}
+
+	google, err := parseGoogleDomains(strings.NewReader(googleDomains))
+	if err != nil {
+		return nil, fmt.Errorf("embedded google domains error=[%+v]", err)
+	}
+	s.build(google)
+
+	return s, nil
+}
+
+// build the targets of the google domains and the other search engines
+func (s *safeSearch) build(google []string) {
+	var targets = make(map[string]string, 2*len(google)+len(bingNames)+len(duckDuckGoNames)+len(youTubeNames))
+	for _, domain := range google {
+		targets[domain], targets["www."+domain] = targetGoogle, targetGoogle
+	}
+	for _, name := range bingNames {
+		targets[name] = targetBing
+	}
+	for _, name := range duckDuckGoNames {
+		targets[name] = targetDuckDuckGo
+	}
+	for _, name := range youTubeNames {
+		targets[name] = s.youTube
+	}
+	s.targets.Store(&targets)
+}
+
+// parseGoogleDomains return the canonical domains of the list, ".google.com" is
+// "google.com.", the list without any google domain is an error
+func parseGoogleDomains(r io.Reader) ([]string, error) {
+	var domains []string
+	var scanner = bufio.NewScanner(r)
+	for scanner.Scan() {
+		var line = strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var domain = dns.CanonicalName(strings.TrimPrefix(line, "."))
+		if _, ok := dns.IsDomainName(domain); !ok || !strings.HasPrefix(domain, "google.") {
+			return nil, fmt.Errorf("invalid google domain %s", line)
+		}
+		domains = append(domains, domain)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(domains) == 0 {
+		return nil, errors.New("no google domain")
+	}
+	return domains, nil
+}
+
+// target return the safe search target of name, empty when not a search engine
+func (s *safeSearch) target(name string) string {
+	return (*s.targets.Load())[dns.CanonicalName(name)]
+}
+
+// start download the Google domains now and every day until ctx done
+func (s *safeSearch) start(ctx context.Context) {
+	if len(s.url) == 0 {
+		return
+	}
+
+	go func() {
+		var ticker = time.NewTicker(googleRefresh)
+		defer ticker.Stop()
+
+		for {
+			if err := s.update(ctx); err != nil {
+				log.Sugar.Errorf("safe search google domains download error=[%+v], the old list is kept", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// update download the Google domains and swap the targets in
+func (s *safeSearch) update(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http status %s", resp.Status)
+	}
+
+	google, err := parseGoogleDomains(io.LimitReader(resp.Body, maxGoogleSize))
+	if err != nil {
+		return err
+	}
+
+	s.build(google)
+	log.Sugar.Infof("safe search google domains %d", len(google))
+	return nil
+}
+
+// redirect report whether the safe search is enabled for the client group of
+// dt and its name is a search engine, dt is redirected to the target
+func (e *Engine) redirect(dt *model.DT) bool {
+	if !dt.Policy.SafeSearchOr(e.safe.enabled) {
+		return false
+	}
+
+	var q = dt.Request.Question[0]
+	var target = e.safe.target(q.Name)
+	if len(target) == 0 {
+		return false
+	}
+
+	metrics.Add(metricSafeSearch, 1)
+	log.Sugar.Debugf("sn=%d, id=%d, safe search [%s] to [%s]", dt.SN, dt.Request.Id, q.Name, target)
+
+	dt.Redirect([]dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: q.Qclass, Ttl: e.ttl},
+		Target: target,
+	}})
+	return true
+}
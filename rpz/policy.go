@@ -0,0 +1,243 @@
+package rpz
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// the policy actions
+const (
+	ActionNXDomain  = "nxdomain"   // CNAME .
+	ActionNoData    = "nodata"     // CNAME *.
+	ActionPassthru  = "passthru"   // CNAME rpz-passthru.
+	ActionDrop      = "drop"       // CNAME rpz-drop.
+	ActionLocalData = "local-data" // any other records
+)
+
+const (
+	labelIP = "rpz-ip"
+)
+
+// the triggers ignored, the name servers and the client triggers
+var unsupported = []string{"rpz-nsdname", "rpz-nsip", "rpz-client-ip"}
+
+// trigger a trigger of the policy zone and its action
+type trigger struct {
+	name   string // the owner name in the zone
+	action string
+	data   []dns.RR // the records of ActionLocalData
+}
+
+// policy a compiled response policy zone
+type policy struct {
+	origin  string
+	serial  uint32
+	refresh uint32 // the SOA refresh and retry, second
+	retry   uint32
+
+	qnames map[string]*trigger // the QNAME triggers by the canonical name
+	wilds  map[string]*trigger // the wildcard QNAME triggers by the parent name
+	ips    map[int]map[netip.Prefix]*trigger
+	bits   []int // the prefix lengths of ips, longest first
+
+	triggers, skipped int
+}
+
+// compile return the policy of the records of the zone origin, the first record
+// must be the SOA, the unsupported triggers are skipped and counted
+func compile(origin string, rrs []dns.RR) (*policy, error) {
+	var p = &policy{
+		origin: dns.CanonicalName(origin),
+		qnames: make(map[string]*trigger),
+		wilds:  make(map[string]*trigger),
+		ips:    make(map[int]map[netip.Prefix]*trigger),
+	}
+
+	if len(rrs) == 0 {
+		return nil, errors.New("no SOA")
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok || dns.CanonicalName(soa.Hdr.Name) != p.origin {
+		return nil, errors.New("the first record is not SOA")
+	}
+	p.serial, p.refresh, p.retry = soa.Serial, soa.Refresh, soa.Retry
+
+	// the records by the owner name in the zone order
+	var owners []string
+	var names = make(map[string][]dns.RR)
+	for _, rr := range rrs[1:] {
+		var name = dns.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(p.origin, name) {
+			return nil, fmt.Errorf("%s out of zone %s", name, p.origin)
+		}
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			continue
+		}
+		if name == p.origin {
+			// the NS of the apex
+			continue
+		}
+		if _, ok := names[name]; !ok {
+			owners = append(owners, name)
+		}
+		names[name] = append(names[name], rr)
+	}
+
+	for _, owner := range owners {
+		if err := p.add(owner, names[owner]); err != nil {
+			return nil, fmt.Errorf("trigger %s error=[%+v]", owner, err)
+		}
+	}
+
+	slices.SortFunc(p.bits, func(a, b int) int { return b - a })
+	return p, nil
+}
+
+// add the trigger of owner with its records
+func (p *policy) add(owner string, rrs []dns.RR) error {
+	var rel = strings.TrimSuffix(owner, "."+p.origin)
+	if p.origin == "." {
+		rel = strings.TrimSuffix(owner, ".")
+	}
+
+	var labels = dns.SplitDomainName(rel)
+	if slices.Contains(unsupported, labels[len(labels)-1]) {
+		p.skipped++
+		return nil
+	}
+
+	var t = &trigger{name: owner, action: p.action(rrs)}
+	if len(t.action) == 0 {
+		p.skipped++
+		return nil
+	}
+	if t.action == ActionLocalData {
+		t.data = rrs
+	}
+
+	if labels[len(labels)-1] == labelIP {
+		prefix, err := parseIP(labels[:len(labels)-1])
+		if err != nil {
+			return err
+		}
+		if p.ips[prefix.Bits()] == nil {
+			p.ips[prefix.Bits()] = make(map[netip.Prefix]*trigger)
+			p.bits = append(p.bits, prefix.Bits())
+		}
+		p.ips[prefix.Bits()][prefix] = t
+		p.triggers++
+		return nil
+	}
+
+	if labels[0] == "*" {
+		p.wilds[dns.Fqdn(strings.Join(labels[1:], "."))] = t
+	} else {
+		p.qnames[dns.Fqdn(rel)] = t
+	}
+	p.triggers++
+	return nil
+}
+
+// action return the action of the records of a trigger, empty when unsupported
+func (p *policy) action(rrs []dns.RR) string {
+	cname, ok := rrs[0].(*dns.CNAME)
+	if len(rrs) != 1 || !ok {
+		return ActionLocalData
+	}
+
+	var target = dns.CanonicalName(cname.Target)
+	if target != p.origin && dns.IsSubDomain(p.origin, target) && p.origin != "." {
+		// the relative target, "rpz-passthru" without the trailing dot
+		target = strings.TrimSuffix(target, p.origin)
+	}
+
+	switch target {
+	case ".":
+		return ActionNXDomain
+	case "*.":
+		return ActionNoData
+	case "rpz-passthru.":
+		return ActionPassthru
+	case "rpz-drop.":
+		return ActionDrop
+	case "rpz-tcp-only.":
+		return ""
+	default:
+		return ActionLocalData
+	}
+}
+
+// parseIP return the prefix of the response IP trigger labels, the prefix length
+// first and the address labels reversed, "zz" is "::" of IPv6,
+// "32.1.2.0.192" is 192.0.2.1/32 and "128.1.zz.db8.2001" is 2001:db8::1/128
+func parseIP(labels []string) (netip.Prefix, error) {
+	if len(labels) < 2 {
+		return netip.Prefix{}, errors.New("invalid address")
+	}
+
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	var address = slices.Clone(labels[1:])
+	slices.Reverse(address)
+
+	var raw string
+	if len(address) == 4 && !slices.Contains(address, "zz") {
+		raw = strings.Join(address, ".")
+	} else {
+		raw = strings.Replace(strings.Join(address, ":"), "zz", "", 1)
+		if strings.HasPrefix(raw, ":") || strings.HasSuffix(raw, ":") {
+			// zz at the ends, "::1" or "2001:db8::"
+			raw = strings.Replace(strings.Join(address, ":"), "zz", ":", 1)
+		}
+	}
+
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix, nil
+}
+
+// qname return the trigger of name, the exact one or the most specific wildcard
+func (p *policy) qname(name string) *trigger {
+	if t, ok := p.qnames[name]; ok {
+		return t
+	}
+	for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+		if t, ok := p.wilds[name[i:]]; ok {
+			return t
+		}
+	}
+	if t, ok := p.wilds["."]; ok {
+		return t
+	}
+	return nil
+}
+
+// ip return the trigger of the longest prefix contains addr
+func (p *policy) ip(addr netip.Addr) *trigger {
+	for _, bits := range p.bits {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if t, ok := p.ips[bits][prefix]; ok {
+			return t
+		}
+	}
+	return nil
+}
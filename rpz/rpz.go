@@ -0,0 +1,446 @@
+package rpz
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/metrics"
+	"github.com/treemana/godot/util"
+)
+
+const (
+	watchDefault    = 5 * time.Second
+	refreshDefault  = 3600 // second, the SOA refresh of the transferred zone without one
+	transferTimeout = 10 * time.Second
+
+	metricHits     = "rpz_hits"      // number of the policy hits
+	metricTriggers = "rpz_triggers:" // the triggers of the zone
+	metricErrors   = "rpz_errors:"   // the failed loads and transfers of the zone
+)
+
+// ZoneConfig represents a response policy zone
+type ZoneConfig struct {
+	// Name the origin of the zone
+	Name string `json:"name"`
+
+	// File the path of the RFC 1035 master file, loaded when Primary is empty
+	File string `json:"file"`
+
+	// Primary the address of the primary server transferring the zone by AXFR,
+	// "127.0.0.1:53"
+	Primary string `json:"primary"`
+
+	// Refresh the interval(second) of checking the serial of the primary,
+	// the SOA refresh when zero
+	Refresh int `json:"refresh"`
+}
+
+// Config represents the response policy zones settings
+type Config struct {
+	// Zones the policy zones, the first one matched wins, disabled when empty
+	Zones []ZoneConfig `json:"zones"`
+
+	// Watch the interval(second) of checking the zone files changes, 5 when zero
+	Watch int `json:"watch"`
+}
+
+// Hit represents a matched trigger of a policy zone
+type Hit struct {
+	Zone    string // the origin of the policy zone
+	Trigger string // the owner name of the trigger
+	Action  string
+	Match   string // the name or the address triggered
+
+	data []dns.RR
+}
+
+func (h *Hit) String() string {
+	return fmt.Sprintf("zone %s trigger %s match %s action %s", h.Zone, h.Trigger, h.Match, h.Action)
+}
+
+// Alias return the CNAME of the local data renamed to name, nil when none,
+// the request should be redirected to the target
+func (h *Hit) Alias(name string) []dns.RR {
+	if h.Action != ActionLocalData {
+		return nil
+	}
+	for _, rr := range h.data {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			return []dns.RR{expand(cname, name)}
+		}
+	}
+	return nil
+}
+
+// Reply return the policy response to req, nil for ActionPassthru and ActionDrop
+func (h *Hit) Reply(req *dns.Msg) *dns.Msg {
+	if h.Action == ActionPassthru || h.Action == ActionDrop {
+		return nil
+	}
+
+	var q = req.Question[0]
+	var resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+
+	switch h.Action {
+	case ActionNXDomain:
+		resp.Rcode = dns.RcodeNameError
+	case ActionLocalData:
+		for _, rr := range h.data {
+			var t = rr.Header().Rrtype
+			if cname, ok := rr.(*dns.CNAME); ok && q.Qtype != dns.TypeCNAME {
+				// the CNAME is answered alone
+				resp.Answer = []dns.RR{expand(cname, q.Name)}
+				break
+			}
+			if t == q.Qtype || q.Qtype == dns.TypeANY {
+				rr = dns.Copy(rr)
+				rr.Header().Name = q.Name
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+	}
+
+	if req.IsEdns0() != nil {
+		util.DNSSetEDE(resp, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked})
+	}
+	return resp
+}
+
+// expand return the CNAME owned by name, the wildcard target "*.garden." is
+// expanded to the name prepended, "www.example.com.garden."
+func expand(cname *dns.CNAME, name string) dns.RR {
+	var rr = dns.Copy(cname).(*dns.CNAME)
+	rr.Hdr.Name = name
+	if strings.HasPrefix(rr.Target, "*.") {
+		rr.Target = name + rr.Target[2:]
+	}
+	return rr
+}
+
+// source the state of loading a zone
+type source struct {
+	config ZoneConfig
+	info   os.FileInfo // the zone file loaded
+	next   time.Time   // the next check of the primary
+}
+
+// RPZ answer the requests and the responses by the response policy zones
+type RPZ struct {
+	sources []*source
+	watch   time.Duration
+
+	// the policies in the zones order, nil when the zone is not loaded yet
+	policies atomic.Pointer[[]*policy]
+}
+
+// New return nil when there is no zone, the zone files are loaded, and the
+// zones of the primaries are transferred after Start
+func New(config Config) (*RPZ, error) {
+	if len(config.Zones) == 0 {
+		return nil, nil
+	}
+
+	var r = &RPZ{watch: time.Second * time.Duration(config.Watch)}
+	if r.watch <= 0 {
+		r.watch = watchDefault
+	}
+
+	var policies = make([]*policy, len(config.Zones))
+	for i, c := range config.Zones {
+		if _, ok := dns.IsDomainName(c.Name); !ok || len(c.Name) == 0 {
+			return nil, fmt.Errorf("rpz invalid zone name %s", c.Name)
+		}
+		if len(c.File) == 0 && len(c.Primary) == 0 {
+			return nil, fmt.Errorf("rpz %s without file and primary", c.Name)
+		}
+
+		var s = &source{config: c}
+		r.sources = append(r.sources, s)
+		if len(c.Primary) > 0 {
+			continue
+		}
+
+		p, info, err := loadFile(c)
+		if err != nil {
+			return nil, err
+		}
+		policies[i], s.info = p, info
+	}
+	r.policies.Store(&policies)
+
+	return r, nil
+}
+
+// loadFile return the policy of the zone file of c, and the file info loaded
+func loadFile(c ZoneConfig) (*policy, os.FileInfo, error) {
+	f, err := os.Open(c.File)
+	if err != nil {
+		return nil, nil, fmt.Errorf("rpz %s error=[%+v]", c.Name, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("rpz %s error=[%+v]", c.Name, err)
+	}
+
+	var rrs []dns.RR
+	var parser = dns.NewZoneParser(f, dns.Fqdn(c.Name), c.File)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err = parser.Err(); err != nil {
+		return nil, nil, fmt.Errorf("rpz %s file %s error=[%+v]", c.Name, c.File, err)
+	}
+
+	p, err := compile(c.Name, rrs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("rpz %s file %s error=[%+v]", c.Name, c.File, err)
+	}
+	logLoaded(p)
+	return p, info, nil
+}
+
+// transfer return the policy of the zone transferred from the primary of c by AXFR
+func transfer(c ZoneConfig) (*policy, error) {
+	var req = new(dns.Msg)
+	req.SetAxfr(dns.Fqdn(c.Name))
+
+	var t = &dns.Transfer{DialTimeout: transferTimeout, ReadTimeout: transferTimeout}
+	envelopes, err := t.In(req, c.Primary)
+	if err != nil {
+		return nil, fmt.Errorf("rpz %s transfer from %s error=[%+v]", c.Name, c.Primary, err)
+	}
+
+	var rrs []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, fmt.Errorf("rpz %s transfer from %s error=[%+v]", c.Name, c.Primary, envelope.Error)
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+
+	// the zone ends with the SOA again
+	if len(rrs) > 1 && rrs[len(rrs)-1].Header().Rrtype == dns.TypeSOA {
+		rrs = rrs[:len(rrs)-1]
+	}
+
+	p, err := compile(c.Name, rrs)
+	if err != nil {
+		return nil, fmt.Errorf("rpz %s transfer from %s error=[%+v]", c.Name, c.Primary, err)
+	}
+	logLoaded(p)
+	return p, nil
+}
+
+// primarySerial return the SOA serial of the zone of c on its primary
+func primarySerial(ctx context.Context, c ZoneConfig) (uint32, error) {
+	var req = new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(c.Name), dns.TypeSOA)
+	req.RecursionDesired = false
+
+	var client = &dns.Client{Net: "tcp", Timeout: transferTimeout}
+	resp, _, err := client.ExchangeContext(ctx, req, c.Primary)
+	if err != nil {
+		return 0, err
+	}
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("no SOA, %s", dns.RcodeToString[resp.Rcode])
+}
+
+func logLoaded(p *policy) {
+	metrics.Set(metricTriggers+p.origin, int64(p.triggers))
+	log.Sugar.Infof("rpz %s serial %d triggers %d, %d unsupported skipped", p.origin, p.serial, p.triggers, p.skipped)
+}
+
+// Start reload the changed zone files and transfer the changed zones of the
+// primaries until ctx done, the zones of the primaries are transferred now
+func (r *RPZ) Start(ctx context.Context) {
+	if r == nil {
+		return
+	}
+
+	go func() {
+		r.reload(ctx)
+
+		var ticker = time.NewTicker(r.watch)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.reload(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// reload the zones changed, the old policy is kept when the reloading failed
+func (r *RPZ) reload(ctx context.Context) {
+	var policies = *r.policies.Load()
+	var changed []*policy
+	var update = func(i int, p *policy) {
+		if changed == nil {
+			changed = append([]*policy(nil), policies...)
+		}
+		changed[i] = p
+	}
+
+	for i, s := range r.sources {
+		var c = s.config
+		if len(c.Primary) == 0 {
+			info, err := os.Stat(c.File)
+			if err != nil {
+				log.Sugar.Warnf("rpz %s error=[%+v]", c.Name, err)
+				continue
+			}
+			if info.ModTime().Equal(s.info.ModTime()) && info.Size() == s.info.Size() {
+				continue
+			}
+
+			p, info, err := loadFile(c)
+			if err != nil {
+				metrics.Add(metricErrors+dns.CanonicalName(c.Name), 1)
+				log.Sugar.Errorf("%+v, the old policy is kept", err)
+				continue
+			}
+			s.info = info
+			update(i, p)
+			continue
+		}
+
+		if time.Now().Before(s.next) {
+			continue
+		}
+
+		p, err := r.check(ctx, c, policies[i])
+		s.next = time.Now().Add(interval(c, policies[i], p, err))
+		if err != nil {
+			metrics.Add(metricErrors+dns.CanonicalName(c.Name), 1)
+			log.Sugar.Errorf("%+v, the old policy is kept", err)
+			continue
+		}
+		if p != nil {
+			update(i, p)
+		}
+	}
+
+	if changed != nil {
+		r.policies.Store(&changed)
+	}
+}
+
+// check transfer the zone of the primary when its serial changed, return nil
+// when the zone is up to date
+func (r *RPZ) check(ctx context.Context, c ZoneConfig, old *policy) (*policy, error) {
+	if old != nil {
+		serial, err := primarySerial(ctx, c)
+		if err != nil {
+			return nil, fmt.Errorf("rpz %s serial from %s error=[%+v]", c.Name, c.Primary, err)
+		}
+		if serial == old.serial {
+			return nil, nil
+		}
+	}
+	return transfer(c)
+}
+
+// interval return the time until the next check of the primary, the configured
+// refresh, or the SOA refresh, or the SOA retry when failed
+func interval(c ZoneConfig, old, p *policy, err error) time.Duration {
+	if p == nil {
+		p = old
+	}
+
+	var seconds = uint32(c.Refresh)
+	switch {
+	case c.Refresh > 0:
+	case p == nil:
+		seconds = refreshDefault
+	case err != nil && p.retry > 0:
+		seconds = p.retry
+	case p.refresh > 0:
+		seconds = p.refresh
+	default:
+		seconds = refreshDefault
+	}
+	return time.Second * time.Duration(seconds)
+}
+
+// Query return the hit of the QNAME triggers of name, nil when not triggered
+func (r *RPZ) Query(name string) *Hit {
+	if r == nil {
+		return nil
+	}
+
+	name = dns.CanonicalName(name)
+	for _, p := range *r.policies.Load() {
+		if p == nil {
+			continue
+		}
+		if t := p.qname(name); t != nil {
+			return newHit(p, t, name)
+		}
+	}
+	return nil
+}
+
+// Response return the hit of the names of the CNAME chain by the QNAME triggers,
+// or the addresses of the answers by the response IP triggers, nil when not
+// triggered, the zones are checked in order
+func (r *RPZ) Response(resp *dns.Msg) *Hit {
+	if r == nil || resp == nil {
+		return nil
+	}
+
+	for _, p := range *r.policies.Load() {
+		if p == nil {
+			continue
+		}
+
+		// the QNAME triggers before the response IP triggers
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok {
+				var target = dns.CanonicalName(cname.Target)
+				if t := p.qname(target); t != nil {
+					return newHit(p, t, target)
+				}
+			}
+		}
+
+		for _, rr := range resp.Answer {
+			var ip = util.DNSSplitAnswer(rr)
+			if ip == nil {
+				continue
+			}
+			addr, ok := netip.AddrFromSlice(ip)
+			if !ok {
+				continue
+			}
+			if t := p.ip(addr.Unmap()); t != nil {
+				return newHit(p, t, addr.Unmap().String())
+			}
+		}
+	}
+	return nil
+}
+
+func newHit(p *policy, t *trigger, match string) *Hit {
+	metrics.Add(metricHits, 1)
+	return &Hit{Zone: p.origin, Trigger: t.name, Action: t.action, Match: match, data: t.data}
+}
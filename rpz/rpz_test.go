@@ -0,0 +1,230 @@
+package rpz
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+)
+
+func TestMain(m *testing.M) {
+	_ = log.Init(log.Config{STDOUT: true, Level: 1})
+	os.Exit(m.Run())
+}
+
+const testZone = `$TTL 300
+@                        SOA  ns hostmaster 1 3600 600 86400 60
+@                        NS   ns
+bad.example              CNAME .
+*.bad.example            CNAME .
+empty.example            CNAME *.
+ok.bad.example           CNAME rpz-passthru.
+drop.example             CNAME rpz-drop.
+garden.example           CNAME walled.garden.
+*.wild.example           CNAME *.garden.
+fixed.example            A    192.0.2.80
+fixed.example            TXT  "blocked"
+24.0.100.51.198.rpz-ip   CNAME .
+32.7.100.51.198.rpz-ip   CNAME rpz-passthru.
+128.1.zz.db8.2001.rpz-ip CNAME *.
+ns.example.rpz-nsdname   CNAME .
+tcp.example              CNAME rpz-tcp-only.
+`
+
+func newTestRPZ(t *testing.T) *RPZ {
+	var file = filepath.Join(t.TempDir(), "rpz.zone")
+	if err := os.WriteFile(file, []byte(testZone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(Config{Zones: []ZoneConfig{{Name: "rpz.local", File: file}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestParseIP(t *testing.T) {
+	var tests = []struct {
+		labels string
+		prefix string
+	}{
+		{"32.1.2.0.192", "192.0.2.1/32"},
+		{"24.0.2.0.192", "192.0.2.0/24"},
+		{"128.1.zz.db8.2001", "2001:db8::1/128"},
+		{"48.zz.db8.2001", "2001:db8::/48"},
+		{"128.1.zz", "::1/128"},
+	}
+
+	for _, test := range tests {
+		prefix, err := parseIP(strings.Split(test.labels, "."))
+		if err != nil || prefix.String() != test.prefix {
+			t.Errorf("parseIP(%s) = %s, %v, want %s", test.labels, prefix, err, test.prefix)
+		}
+	}
+
+	for _, labels := range []string{"32", "33.1.2.0.192", "x.1.2.0.192", "32.1.2.0"} {
+		if _, err := parseIP(strings.Split(labels, ".")); err == nil {
+			t.Errorf("parseIP(%s) succeeded, want error", labels)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	var r = newTestRPZ(t)
+
+	var tests = []struct {
+		name   string
+		action string
+	}{
+		{"bad.example.", ActionNXDomain},
+		{"x.y.bad.example.", ActionNXDomain},
+		{"ok.bad.example.", ActionPassthru},
+		{"empty.example.", ActionNoData},
+		{"drop.example.", ActionDrop},
+		{"Fixed.Example.", ActionLocalData},
+		{"tcp.example.", ""},
+		{"ns.example.", ""},
+		{"good.example.", ""},
+	}
+
+	for _, test := range tests {
+		var hit = r.Query(test.name)
+		switch {
+		case len(test.action) == 0 && hit != nil:
+			t.Errorf("Query(%s) = %s, want nil", test.name, hit)
+		case len(test.action) > 0 && (hit == nil || hit.Action != test.action):
+			t.Errorf("Query(%s) = %v, want %s", test.name, hit, test.action)
+		}
+	}
+
+	var req = new(dns.Msg)
+	req.SetQuestion("fixed.example.", dns.TypeA)
+	if resp := r.Query("fixed.example.").Reply(req); len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "fixed.example." {
+		t.Errorf("Reply() local data = %v, want the A", resp.Answer)
+	}
+
+	req.SetQuestion("bad.example.", dns.TypeA)
+	if resp := r.Query("bad.example.").Reply(req); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("Reply() = %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+	}
+
+	if alias := r.Query("garden.example.").Alias("garden.example."); len(alias) != 1 || alias[0].(*dns.CNAME).Target != "walled.garden." {
+		t.Errorf("Alias() = %v, want walled.garden.", alias)
+	}
+	if alias := r.Query("www.wild.example.").Alias("www.wild.example."); len(alias) != 1 || alias[0].(*dns.CNAME).Target != "www.wild.example.garden." {
+		t.Errorf("Alias() wildcard = %v, want www.wild.example.garden.", alias)
+	}
+}
+
+func TestResponse(t *testing.T) {
+	var r = newTestRPZ(t)
+
+	var tests = []struct {
+		answers []string
+		action  string
+	}{
+		{[]string{"a.example. 60 IN A 198.51.100.9"}, ActionNXDomain},
+		{[]string{"a.example. 60 IN A 198.51.100.7"}, ActionPassthru},
+		{[]string{"a.example. 60 IN AAAA 2001:db8::1"}, ActionNoData},
+		{[]string{"a.example. 60 IN CNAME bad.example.", "bad.example. 60 IN A 192.0.2.1"}, ActionNXDomain},
+		{[]string{"a.example. 60 IN A 192.0.2.1"}, ""},
+	}
+
+	for _, test := range tests {
+		var resp = new(dns.Msg)
+		resp.SetQuestion("a.example.", dns.TypeA)
+		for _, s := range test.answers {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Answer = append(resp.Answer, rr)
+		}
+
+		var hit = r.Response(resp)
+		switch {
+		case len(test.action) == 0 && hit != nil:
+			t.Errorf("Response(%v) = %s, want nil", test.answers, hit)
+		case len(test.action) > 0 && (hit == nil || hit.Action != test.action):
+			t.Errorf("Response(%v) = %v, want %s", test.answers, hit, test.action)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	var serial atomic.Uint32
+	serial.Store(1)
+	var records = func() []dns.RR {
+		var rrs []dns.RR
+		var parser = dns.NewZoneParser(strings.NewReader(testZone), "rpz.local.", "")
+		for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+			rrs = append(rrs, rr)
+		}
+		if err := parser.Err(); err != nil {
+			t.Error(err)
+		}
+		rrs[0].(*dns.SOA).Serial = serial.Load()
+		return rrs
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var transfers atomic.Uint32
+	var server = &dns.Server{Listener: listener, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		var rrs = records()
+		if req.Question[0].Qtype == dns.TypeSOA {
+			var resp = new(dns.Msg)
+			resp.SetReply(req)
+			resp.Answer = rrs[:1]
+			_ = w.WriteMsg(resp)
+			return
+		}
+
+		transfers.Add(1)
+		var envelopes = make(chan *dns.Envelope, 1)
+		envelopes <- &dns.Envelope{RR: append(rrs, rrs[0])}
+		close(envelopes)
+		_ = new(dns.Transfer).Out(w, req, envelopes)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	defer func() { _ = server.Shutdown() }()
+
+	r, err := New(Config{Zones: []ZoneConfig{{Name: "rpz.local", Primary: listener.Addr().String(), Refresh: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Query("bad.example.") != nil {
+		t.Fatal("Query() before transferred is not nil")
+	}
+
+	var ctx = context.Background()
+	r.reload(ctx)
+	if hit := r.Query("bad.example."); hit == nil || hit.Zone != "rpz.local." {
+		t.Fatalf("Query() after transferred = %v", hit)
+	}
+
+	// up to date, not transferred again
+	r.sources[0].next = time.Time{}
+	r.reload(ctx)
+	if transfers.Load() != 1 {
+		t.Errorf("transfers = %d, want 1", transfers.Load())
+	}
+
+	serial.Store(2)
+	r.sources[0].next = time.Time{}
+	r.reload(ctx)
+	if transfers.Load() != 2 || (*r.policies.Load())[0].serial != 2 {
+		t.Errorf("transfers = %d, want 2 after the serial changed", transfers.Load())
+	}
+}
@@ -2,13 +2,14 @@ package udp
 
 import (
 	"context"
+	"net/netip"
 	"time"
 
 	"github.com/miekg/dns"
 
 	"github.com/treemana/godot/cache"
 	"github.com/treemana/godot/log"
-	"github.com/treemana/godot/model"
+	"github.com/treemana/godot/util"
 )
 
 func (s *Server) cacheFresher(ctx context.Context, ttr time.Duration) {
@@ -28,15 +29,24 @@ func (s *Server) cacheFresher(ctx context.Context, ttr time.Duration) {
 			i++
 			log.Sugar.Infof("server cache refresh %d start", i)
 			s.reqWG.Add(1)
-			for name, qTypes := range cache.GetAllQuestion() {
+			for k, qTypes := range cache.GetAllQuestion() {
 				if !s.status.Load() {
 					log.Sugar.Info("server cache refresh after stopped")
 					break
 				}
 				for _, qType := range qTypes {
 					req := new(dns.Msg)
-					req.SetQuestion(name, qType)
-					s.reqChan <- &model.DT{SN: s.serial.Add(1), Request: req}
+					req.SetQuestion(k.Name, qType)
+					dt := s.newDT(s.serial.Add(1), req, nil)
+
+					// the scoped answers are refreshed with the client subnet and
+					// the client group of the scope
+					group, subnet := cache.SplitScope(k.Scope)
+					if prefix, err := netip.ParsePrefix(subnet); err == nil {
+						util.DNSSetSUBNET(req, util.DNSNewSubnetFromPrefix(prefix))
+					}
+					dt.Policy, dt.Scope = s.groups.Policy(group), k.Scope
+					s.reqChan <- dt
 				}
 			}
 			s.reqWG.Done()
@@ -8,7 +8,8 @@ import (
 
 	"github.com/treemana/godot/cache"
 	"github.com/treemana/godot/log"
-	"github.com/treemana/godot/model"
+	"github.com/treemana/godot/metrics"
+	"github.com/treemana/godot/rpz"
 	"github.com/treemana/godot/util"
 )
 
@@ -25,16 +26,61 @@ func (s *Server) produce(packet []byte, remote *net.UDPAddr, sn uint64) {
 		return
 	}
 
-	dt := &model.DT{
-		SN:         sn,
-		Request:    message,
-		RemoteAddr: remote,
-	}
+	// the client group policy is resolved from the remote address
+	dt := s.newDT(sn, message, remote)
 
 	log.Sugar.Infof("sn=%d, id=%d, query=[%s]", sn, message.MsgHdr.Id, message.Question[0].String())
 
+	// answered by the local records, or redirected to the target of the local CNAME
+	resp, alias := s.records.Answer(dt.Request)
+	if resp != nil {
+		log.Sugar.Infof("sn=%d, id=%d, local [%s]", sn, message.MsgHdr.Id, message.Question[0].Name)
+		dt.Response, dt.Local = resp, true
+		s.respChan <- dt
+		return
+	}
+	dt.Redirect(alias)
+
+	// answered by the authoritative zones
+	if dt.Response = s.zones.Answer(dt.Request); dt.Response != nil {
+		log.Sugar.Infof("sn=%d, id=%d, authoritative [%s]", sn, message.MsgHdr.Id, message.Question[0].Name)
+		dt.Local = true
+		s.respChan <- dt
+		return
+	}
+
+	// the response policy of the name asked, the local data CNAME is resolved as usual
+	if hit := s.rpz.Query(dt.Request.Question[0].Name); hit != nil {
+		log.Sugar.Warnf("sn=%d, id=%d, client=%s, rpz %s", sn, message.MsgHdr.Id, remote, hit)
+		switch alias := hit.Alias(dt.Request.Question[0].Name); {
+		case hit.Action == rpz.ActionPassthru:
+			dt.Passthru = true
+		case hit.Action == rpz.ActionDrop:
+			dt.Finish()
+			return
+		case alias != nil && dt.Request.Question[0].Qtype != dns.TypeCNAME:
+			// the answers of the target are still checked, the alias is not in them
+			dt.Redirect(alias)
+		default:
+			dt.Response, dt.Local = hit.Reply(dt.Request), true
+			s.respChan <- dt
+			return
+		}
+	}
+
+	// redirected by the rewrite rules, the target is filtered
+	s.rewrite.Request(dt)
+
+	// blocked by the filter
+	if dt.Response = s.filter.Answer(dt.Request, dt.Policy.FilterLists()); dt.Response != nil {
+		log.Sugar.Infof("sn=%d, id=%d, blocked [%s]", sn, message.MsgHdr.Id, message.Question[0].Name)
+		dt.Local = true
+		s.respChan <- dt
+		return
+	}
+
 	// local cache hit
-	if dt.Response = cache.Get(dt.Request); dt.Response != nil {
+	if dt.Response = cache.Get(dt.Request, dt.Scope); dt.Response != nil {
 		dt.Cached = true
 		s.respChan <- dt
 		return
@@ -74,8 +120,14 @@ func (s *Server) read() {
 		packet := make([]byte, n)
 		copy(packet, bytes)
 
+		// backpressure, wait until the pending request handed over
+		s.queue <- struct{}{}
+		metrics.Add(metricPending, 1)
+
 		go func() {
 			s.produce(packet, remoteAddr, s.serial.Add(1))
+			metrics.Add(metricPending, -1)
+			<-s.queue
 			s.reqWG.Done()
 		}()
 	}
@@ -9,18 +9,38 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/miekg/dns"
+
 	"github.com/treemana/godot/cache"
+	"github.com/treemana/godot/clients"
+	"github.com/treemana/godot/filter"
+	"github.com/treemana/godot/local"
 	"github.com/treemana/godot/log"
 	"github.com/treemana/godot/model"
+	"github.com/treemana/godot/rebind"
+	"github.com/treemana/godot/rewrite"
+	"github.com/treemana/godot/rpz"
+	"github.com/treemana/godot/zone"
 )
 
 const (
-	defaultTimeout = 10 * time.Second
+	defaultTimeout  = 10 * time.Second
+	defaultQueue    = 1024
+	defaultDeadline = 5 * time.Second
+
+	metricPending = "server_pending" // number of requests read but not handed over
 )
 
 type Configure struct {
 	Address string `json:"address"`
 	Port    int    `json:"port"`
+
+	// Queue the max number of requests read but not handed over to the cache
+	// or upstream, read will be blocked when the queue is full
+	Queue int `json:"queue"`
+
+	// Deadline the overall deadline of a query, millisecond
+	Deadline int `json:"deadline"`
 }
 
 type Server struct {
@@ -30,15 +50,47 @@ type Server struct {
 
 	reqWG   sync.WaitGroup
 	reqChan chan *model.DT // dns request
+	queue   chan struct{}  // pending request tokens
+
+	deadline time.Duration // the overall deadline of a query
 
 	respWG   sync.WaitGroup
 	respChan chan *model.DT // dns response
 
 	serial   atomic.Uint64
 	cancelFn context.CancelFunc
+
+	// scope return the cache scope of the client ip in the client group of policy,
+	// nil means all shared
+	scope func(ip net.IP, policy *model.Policy) string
+
+	// groups resolve the client group policy of the client address, nil means
+	// no group
+	groups *clients.Groups
+
+	// records answer the local names before the filter, nil means disabled
+	records *local.Records
+
+	// zones answer the authoritative zones after the local records, nil means disabled
+	zones *zone.Zones
+
+	// filter answer the blocked requests before the cache, nil means disabled
+	filter *filter.Filter
+
+	// rpz apply the response policy zones to the requests after the authoritative
+	// zones, and to the responses before written, nil means disabled
+	rpz *rpz.RPZ
+
+	// rewrite redirect the requests before the filter, and rewrite the upstream
+	// responses before the cache, nil means disabled
+	rewrite *rewrite.Engine
+
+	// rebind strip or block the upstream answers pointing inward before the
+	// rewrite, nil means disabled
+	rebind *rebind.Guard
 }
 
-func New(ip net.IP, port int, ttr time.Duration) (*Server, error) {
+func New(ip net.IP, port, queue int, deadline, ttr time.Duration) (*Server, error) {
 
 	if len(ip) == 0 {
 		return nil, errors.New("invalid ip")
@@ -48,9 +100,19 @@ func New(ip net.IP, port int, ttr time.Duration) (*Server, error) {
 		return nil, fmt.Errorf("invalid port=%d", port)
 	}
 
+	if queue <= 0 {
+		queue = defaultQueue
+	}
+
+	if deadline <= 0 {
+		deadline = defaultDeadline
+	}
+
 	s := Server{
 		address:  &net.UDPAddr{Port: port, IP: ip},
 		reqChan:  make(chan *model.DT),
+		queue:    make(chan struct{}, queue),
+		deadline: deadline,
 		respChan: make(chan *model.DT),
 	}
 
@@ -65,6 +127,64 @@ func New(ip net.IP, port int, ttr time.Duration) (*Server, error) {
 	return &s, nil
 }
 
+// newDT return a dt with the query deadline
+func (s *Server) newDT(sn uint64, request *dns.Msg, remote *net.UDPAddr) *model.DT {
+	dt := &model.DT{
+		SN:         sn,
+		Request:    request,
+		RemoteAddr: remote,
+	}
+	if remote != nil {
+		dt.Policy = s.groups.Match(remote.IP)
+	}
+	if s.scope != nil && remote != nil {
+		dt.Scope = s.scope(remote.IP, dt.Policy)
+	}
+	dt.Ctx, dt.Cancel = context.WithTimeout(context.Background(), s.deadline)
+	return dt
+}
+
+// SetScope set the cache scope function of the client address, it must be
+// called before Start
+func (s *Server) SetScope(scope func(ip net.IP, policy *model.Policy) string) {
+	s.scope = scope
+}
+
+// SetGroups set the client groups, it must be called before Start
+func (s *Server) SetGroups(g *clients.Groups) {
+	s.groups = g
+}
+
+// SetRecords set the local records, it must be called before Start
+func (s *Server) SetRecords(r *local.Records) {
+	s.records = r
+}
+
+// SetZones set the authoritative zones, it must be called before Start
+func (s *Server) SetZones(zs *zone.Zones) {
+	s.zones = zs
+}
+
+// SetFilter set the filter of the requests, it must be called before Start
+func (s *Server) SetFilter(f *filter.Filter) {
+	s.filter = f
+}
+
+// SetRPZ set the response policy zones, it must be called before Start
+func (s *Server) SetRPZ(r *rpz.RPZ) {
+	s.rpz = r
+}
+
+// SetRewrite set the rewrite rules, it must be called before Start
+func (s *Server) SetRewrite(e *rewrite.Engine) {
+	s.rewrite = e
+}
+
+// SetRebind set the DNS rebinding protection, it must be called before Start
+func (s *Server) SetRebind(g *rebind.Guard) {
+	s.rebind = g
+}
+
 func (s *Server) GetChan() (chan *model.DT, chan *model.DT) {
 	return s.reqChan, s.respChan
 }
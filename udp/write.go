@@ -7,12 +7,15 @@ import (
 
 	"github.com/treemana/godot/cache"
 	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/rpz"
 	"github.com/treemana/godot/util"
 )
 
 func (s *Server) write() {
 	s.respWG.Add(1)
 	for dt := range s.respChan {
+		// the query is done, release its context
+		dt.Finish()
 
 		if dt.SN == 0 {
 			log.Sugar.Warnf("sn=0 [%s]", dt.Request.Question[0].String())
@@ -28,9 +31,9 @@ func (s *Server) write() {
 			util.DNSSubnetRemove(dt.Response)
 		}
 
-		// update cache
-		if !dt.Cached {
-			cache.Update(dt.Response)
+		// update cache, the response without validation asked by CD is not cached
+		if !dt.Cached && !dt.Local && !dt.Provisional && !dt.Request.CheckingDisabled {
+			cache.Update(dt.Response, dt.Scope)
 		}
 
 		if dt.RemoteAddr == nil {
@@ -38,7 +41,31 @@ func (s *Server) write() {
 			continue
 		}
 
-		bytes, err := dt.Response.Pack()
+		// check and rewrite the answers by the name asked, the cache may be
+		// holding dt.Response, the cached response is kept as it is
+		if !dt.Local && (s.rebind != nil || s.rewrite.Rewrites()) {
+			dt.Response = dt.Response.Copy()
+			if inward := s.rebind.Check(dt); len(inward) > 0 {
+				log.Sugar.Warnf("sn=%d, id=%d, client=%s, rebinding [%s] to %v blocked", dt.SN, dt.Request.Id, dt.RemoteAddr, dt.Asked().Name, inward)
+			}
+			s.rewrite.Response(dt)
+		}
+
+		// the response policy of the answers, the cached response is kept as it is
+		if !dt.Local && !dt.Passthru {
+			if hit := s.rpz.Response(dt.Response); hit != nil {
+				log.Sugar.Warnf("sn=%d, id=%d, client=%s, rpz %s", dt.SN, dt.Request.Id, dt.RemoteAddr, hit)
+				if hit.Action == rpz.ActionDrop {
+					continue
+				}
+				if resp := hit.Reply(dt.Request); resp != nil {
+					dt.Response = resp
+				}
+			}
+		}
+
+		// the cache may be holding dt.Response, restore and remove on a copy
+		bytes, err := util.DNSRemoveDNSSEC(dt.Request, dt.Restored()).Pack()
 		if err != nil {
 			log.Sugar.Warnf("sn=%d, response pack error=[%+v]", dt.SN, err)
 			continue
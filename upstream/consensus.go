@@ -0,0 +1,222 @@
+package upstream
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/metrics"
+	"github.com/treemana/godot/model"
+	"github.com/treemana/godot/util"
+)
+
+// consensus modes
+const (
+	ConsensusOff    = "off"    // no verification
+	ConsensusLog    = "log"    // log the disagreements only
+	ConsensusReject = "reject" // drop the answers disagree with the majority, SERVFAIL without majority
+
+	defaultConsensusQuorum   = 0.5
+	defaultConsensusPrefixV4 = 24
+	defaultConsensusPrefixV6 = 48
+
+	metricConsensusMismatch = "upstream_consensus_mismatch"        // number of the disagreements
+	metricConsensusEvents   = "upstream_consensus_mismatch_events" // the latest disagreements
+	metricConsensusRejected = "upstream_consensus_rejected"        // number of the requests answered SERVFAIL without majority
+)
+
+// ConsensusConfig represents the upstream answer verification settings,
+// it works with the parallel-all strategy only, which waits for all the resolvers
+//
+// two responses agree when they have the same rcode, and their A/AAAA answers are
+// both empty or at least one address of them is in the same prefix, the ASN of
+// the addresses is not compared, there is no ASN database
+type ConsensusConfig struct {
+	// Mode of the verification, ConsensusOff when empty
+	Mode string `json:"mode"`
+
+	// Quorum the fraction (0, 1] of the valid responses the majority must contain, 0.5 when zero
+	Quorum float64 `json:"quorum"`
+
+	// PrefixV4 the IPv4 prefix length of the same network, 24 when zero
+	PrefixV4 int `json:"prefix_v4"`
+
+	// PrefixV6 the IPv6 prefix length of the same network, 48 when zero
+	PrefixV6 int `json:"prefix_v6"`
+}
+
+func (c *ConsensusConfig) init(strategy string) error {
+	switch c.Mode {
+	case "":
+		c.Mode = ConsensusOff
+	case ConsensusOff:
+	case ConsensusLog, ConsensusReject:
+		if strategy != StrategyParallelAll {
+			return fmt.Errorf("consensus %s needs strategy %s", c.Mode, StrategyParallelAll)
+		}
+	default:
+		return fmt.Errorf("unknown consensus mode %s", c.Mode)
+	}
+
+	if c.Quorum == 0 {
+		c.Quorum = defaultConsensusQuorum
+	} else if c.Quorum < 0 || c.Quorum > 1 {
+		return fmt.Errorf("invalid consensus quorum %f", c.Quorum)
+	}
+
+	if c.PrefixV4 == 0 {
+		c.PrefixV4 = defaultConsensusPrefixV4
+	} else if c.PrefixV4 < 0 || c.PrefixV4 > 32 {
+		return fmt.Errorf("invalid consensus prefix_v4 %d", c.PrefixV4)
+	}
+
+	if c.PrefixV6 == 0 {
+		c.PrefixV6 = defaultConsensusPrefixV6
+	} else if c.PrefixV6 < 0 || c.PrefixV6 > 128 {
+		return fmt.Errorf("invalid consensus prefix_v6 %d", c.PrefixV6)
+	}
+
+	return nil
+}
+
+// verify compare the valid responses of the resolvers, log the disagreements
+// return the responses to answer, false when there is no majority in reject mode
+// and the responses differ by more than the addresses, the failures are answered
+// only when there is no valid response, they never override a valid answer
+func (s *UpStream) verify(dt *model.DT, results []result) ([]result, bool) {
+	// the failures are not the disagreements
+	var valids = slices.DeleteFunc(slices.Clone(results), func(r result) bool { return !valid(r.msg) })
+	if len(valids) == 0 {
+		return results, true
+	}
+
+	var clusters = s.consensus.cluster(valids)
+	if len(clusters) == 1 {
+		return valids, true
+	}
+
+	var event = fmt.Sprintf("%s %s %s", dt.Request.Question[0].Name,
+		dns.TypeToString[dt.Request.Question[0].Qtype], describe(clusters))
+	log.Sugar.Warnf("sn=%d, id=%d, consensus mismatch %s", dt.SN, dt.Request.Id, event)
+	metrics.Add(metricConsensusMismatch, 1)
+	metrics.Record(metricConsensusEvents, event)
+
+	if s.consensus.Mode == ConsensusLog {
+		return valids, true
+	}
+
+	var quorum = int(math.Ceil(s.consensus.Quorum * float64(len(valids))))
+	if len(clusters[0]) >= quorum && len(clusters[0]) > len(clusters[1]) {
+		return clusters[0], true
+	}
+
+	// the addresses of a CDN differ by the location of the resolvers,
+	// they are answered as usual without majority
+	if scattered(valids) {
+		return valids, true
+	}
+
+	metrics.Add(metricConsensusRejected, 1)
+	return nil, false
+}
+
+// cluster group the agreed results, the first result of a cluster represents it
+// the clusters are sorted by size descending
+func (c *ConsensusConfig) cluster(results []result) [][]result {
+	var clusters [][]result
+	for _, r := range results {
+		var i = slices.IndexFunc(clusters, func(cluster []result) bool {
+			return c.agree(cluster[0].msg, r.msg)
+		})
+		if i < 0 {
+			clusters = append(clusters, []result{r})
+			continue
+		}
+		clusters[i] = append(clusters[i], r)
+	}
+
+	slices.SortStableFunc(clusters, func(a, b []result) int {
+		return len(b) - len(a)
+	})
+	return clusters
+}
+
+// agree report whether a and b have the same rcode and A/AAAA answers
+// in the same network
+func (c *ConsensusConfig) agree(a, b *dns.Msg) bool {
+	if a.Rcode != b.Rcode {
+		return false
+	}
+
+	var ipsA, ipsB = addresses(a), addresses(b)
+	if len(ipsA) == 0 || len(ipsB) == 0 {
+		return len(ipsA) == len(ipsB)
+	}
+
+	for _, x := range ipsA {
+		for _, y := range ipsB {
+			if c.samePrefix(x, y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *ConsensusConfig) samePrefix(x, y net.IP) bool {
+	var x4, y4 = x.To4(), y.To4()
+	switch {
+	case x4 != nil && y4 != nil:
+		var mask = net.CIDRMask(c.PrefixV4, 32)
+		return x4.Mask(mask).Equal(y4.Mask(mask))
+	case x4 == nil && y4 == nil:
+		var mask = net.CIDRMask(c.PrefixV6, 128)
+		return x.Mask(mask).Equal(y.Mask(mask))
+	default:
+		return false
+	}
+}
+
+// scattered report whether results have the same rcode and all of them have
+// A/AAAA answers, which disagree in the addresses only
+func scattered(results []result) bool {
+	return !slices.ContainsFunc(results, func(r result) bool {
+		return r.msg.Rcode != results[0].msg.Rcode || len(addresses(r.msg)) == 0
+	})
+}
+
+// addresses return the A/AAAA addresses of the answer section
+func addresses(msg *dns.Msg) []net.IP {
+	var ips []net.IP
+	for _, rr := range msg.Answer {
+		if ip := util.DNSSplitAnswer(rr); len(ip) > 0 {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// describe return the resolvers and answers of the clusters
+// e.g. [tls://1.1.1.1:853 tls://8.8.8.8:853]=NOERROR{1.2.3.4} [udp://10.0.0.1]=NXDOMAIN{}
+func describe(clusters [][]result) string {
+	var parts = make([]string, 0, len(clusters))
+	for _, cluster := range clusters {
+		var from = make([]string, 0, len(cluster))
+		for _, r := range cluster {
+			from = append(from, r.from)
+		}
+
+		var ips []string
+		for _, ip := range addresses(cluster[0].msg) {
+			ips = append(ips, ip.String())
+		}
+
+		parts = append(parts, fmt.Sprintf("%v=%s{%s}", from, dns.RcodeToString[cluster[0].msg.Rcode], strings.Join(ips, ",")))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,139 @@
+package upstream
+
+import (
+	"net"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/model"
+)
+
+func TestMain(m *testing.M) {
+	_ = log.Init(log.Config{STDOUT: true, Level: 1})
+	os.Exit(m.Run())
+}
+
+func newConsensusResult(from string, rcode int, ips ...string) result {
+	var msg = new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Rcode = rcode
+	for _, ip := range ips {
+		msg.Answer = append(msg.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		})
+	}
+	return result{from: from, msg: msg}
+}
+
+func TestConsensusAgree(t *testing.T) {
+	var c = ConsensusConfig{Mode: ConsensusLog}
+	if err := c.init(StrategyParallelAll); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		a, b result
+		want bool
+	}{
+		{newConsensusResult("a", dns.RcodeSuccess, "1.2.3.4"), newConsensusResult("b", dns.RcodeSuccess, "1.2.3.200"), true},
+		{newConsensusResult("a", dns.RcodeSuccess, "1.2.3.4", "5.6.7.8"), newConsensusResult("b", dns.RcodeSuccess, "5.6.7.9"), true},
+		{newConsensusResult("a", dns.RcodeSuccess, "1.2.3.4"), newConsensusResult("b", dns.RcodeSuccess, "1.2.4.4"), false},
+		{newConsensusResult("a", dns.RcodeSuccess, "2001:db8:1::1"), newConsensusResult("b", dns.RcodeSuccess, "2001:db8:1:ff::1"), true},
+		{newConsensusResult("a", dns.RcodeSuccess, "2001:db8:1::1"), newConsensusResult("b", dns.RcodeSuccess, "1.2.3.4"), false},
+		{newConsensusResult("a", dns.RcodeSuccess), newConsensusResult("b", dns.RcodeSuccess), true},
+		{newConsensusResult("a", dns.RcodeSuccess), newConsensusResult("b", dns.RcodeSuccess, "1.2.3.4"), false},
+		{newConsensusResult("a", dns.RcodeNameError), newConsensusResult("b", dns.RcodeSuccess, "1.2.3.4"), false},
+	}
+	for i, test := range tests {
+		if got := c.agree(test.a.msg, test.b.msg); got != test.want {
+			t.Errorf("%d agree() = %t, want %t", i, got, test.want)
+		}
+	}
+}
+
+func TestConsensusVerify(t *testing.T) {
+	var dt = &model.DT{Request: new(dns.Msg)}
+	dt.Request.SetQuestion("example.com.", dns.TypeA)
+
+	var results = []result{
+		newConsensusResult("a", dns.RcodeSuccess, "1.2.3.4"),
+		newConsensusResult("b", dns.RcodeSuccess, "6.6.6.6"),
+		newConsensusResult("c", dns.RcodeSuccess, "1.2.3.5"),
+		newConsensusResult("d", dns.RcodeServerFailure),
+	}
+
+	var tests = []struct {
+		config ConsensusConfig
+		want   []string
+		ok     bool
+	}{
+		{ConsensusConfig{Mode: ConsensusLog}, []string{"a", "b", "c"}, true},
+		{ConsensusConfig{Mode: ConsensusReject}, []string{"a", "c"}, true},
+		{ConsensusConfig{Mode: ConsensusReject, Quorum: 1}, []string{"a", "b", "c"}, true},
+	}
+	for i, test := range tests {
+		var s = &UpStream{consensus: test.config}
+		if err := s.consensus.init(StrategyParallelAll); err != nil {
+			t.Fatal(err)
+		}
+
+		got, ok := s.verify(dt, results)
+		var from []string
+		for _, r := range got {
+			from = append(from, r.from)
+		}
+		if ok != test.ok || len(from) != len(test.want) {
+			t.Errorf("%d verify() = %v %t, want %v %t", i, from, ok, test.want, test.ok)
+			continue
+		}
+		for j := range from {
+			if from[j] != test.want[j] {
+				t.Errorf("%d verify() = %v, want %v", i, from, test.want)
+				break
+			}
+		}
+	}
+
+	// the failures never override the verified answer
+	var s = &UpStream{consensus: ConsensusConfig{Mode: ConsensusReject}}
+	if err := s.consensus.init(StrategyParallelAll); err != nil {
+		t.Fatal(err)
+	}
+	for _, results := range [][]result{
+		{newConsensusResult("d", dns.RcodeServerFailure), newConsensusResult("a", dns.RcodeSuccess, "1.2.3.4"), newConsensusResult("c", dns.RcodeSuccess, "1.2.3.5")},
+		{newConsensusResult("d", dns.RcodeRefused), newConsensusResult("a", dns.RcodeSuccess, "1.2.3.4")},
+	} {
+		if got, ok := s.verify(dt, results); !ok || len(got) == 0 || got[0].from != "a" || slices.ContainsFunc(got, func(r result) bool { return !valid(r.msg) }) {
+			t.Errorf("verify() = %v %t, want the valid answers only", got, ok)
+		}
+	}
+	if got, ok := s.verify(dt, []result{newConsensusResult("d", dns.RcodeServerFailure)}); !ok || len(got) != 1 || got[0].from != "d" {
+		t.Errorf("verify() of the failures = %v %t, want the failures", got, ok)
+	}
+
+	// the disjoint addresses of a CDN are not rejected by default,
+	// the disagreement of the rcode without majority is
+	for _, test := range []struct {
+		results []result
+		ok      bool
+	}{
+		{[]result{newConsensusResult("a", dns.RcodeSuccess, "1.2.3.4"), newConsensusResult("b", dns.RcodeSuccess, "5.6.7.8"), newConsensusResult("c", dns.RcodeSuccess, "9.10.11.12")}, true},
+		{[]result{newConsensusResult("a", dns.RcodeSuccess, "1.2.3.4"), newConsensusResult("b", dns.RcodeSuccess, "1.2.99.4")}, true},
+		{[]result{newConsensusResult("a", dns.RcodeSuccess, "1.2.3.4"), newConsensusResult("b", dns.RcodeNameError)}, false},
+		{[]result{newConsensusResult("a", dns.RcodeSuccess, "1.2.3.4"), newConsensusResult("b", dns.RcodeSuccess)}, false},
+	} {
+		if got, ok := s.verify(dt, test.results); ok != test.ok || ok && len(got) != len(test.results) {
+			t.Errorf("verify() = %v %t, want %t", got, ok, test.ok)
+		}
+	}
+
+	s = &UpStream{consensus: ConsensusConfig{Mode: ConsensusReject}}
+	if err := s.consensus.init(StrategyHedged); err == nil {
+		t.Error("init() with hedged strategy, want error")
+	}
+}
@@ -0,0 +1,73 @@
+package upstream
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/dnssec"
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/metrics"
+	"github.com/treemana/godot/model"
+	"github.com/treemana/godot/util"
+)
+
+const metricDNSSECBogus = "upstream_dnssec_bogus" // number of the bogus responses dropped
+
+// validate drop the bogus results, dt.Secure is set when all the rest are secure
+// dt.Response is SERVFAIL with the extended error when all the results are bogus
+func (s *UpStream) validate(ctx context.Context, dt *model.DT, results []result) []result {
+	var rest = make([]result, 0, len(results))
+	var ede *dns.EDNS0_EDE
+	var secure = true
+	for _, r := range results {
+		security, reason := s.validator.Validate(ctx, r.msg)
+		switch security {
+		case dnssec.Bogus:
+			log.Sugar.Warnf("sn=%d, id=%d, dnssec bogus from %s, %s %s", dt.SN, dt.Request.Id,
+				r.from, dns.ExtendedErrorCodeToString[reason.InfoCode], reason.ExtraText)
+			metrics.Add(metricDNSSECBogus, 1)
+			ede = reason
+			continue
+		case dnssec.Insecure:
+			secure = false
+		}
+		rest = append(rest, r)
+	}
+
+	if len(rest) == 0 && ede != nil {
+		dt.Response = util.DNSNewServFail(dt.Request)
+		if dt.Request.IsEdns0() != nil {
+			util.DNSSetEDE(dt.Response, ede)
+		}
+		return nil
+	}
+
+	dt.Secure = secure && len(rest) > 0
+	return rest
+}
+
+// Query send req to the resolvers of its route, return the first valid response
+// return the last response when none of them is valid
+func (s *UpStream) Query(ctx context.Context, req *dns.Msg) *dns.Msg {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c, n := s.exchange(ctx, s.route(req.Question[0].Name, nil), req)
+
+	var last *dns.Msg
+	for ; n > 0; n-- {
+		select {
+		case r := <-c:
+			if valid(r.msg) {
+				return r.msg
+			}
+			if r.msg != nil {
+				last = r.msg
+			}
+		case <-ctx.Done():
+			return last
+		}
+	}
+	return last
+}
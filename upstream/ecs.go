@@ -0,0 +1,162 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/cache"
+	"github.com/treemana/godot/model"
+	"github.com/treemana/godot/util"
+)
+
+// ECS modes
+const (
+	ECSStatic = "static" // the subnet of godot's public address or the configured one
+	ECSClient = "client" // the subnet of the client's public address, static for the others
+	ECSOff    = "off"    // no subnet, for the client groups only
+)
+
+// ECSConfig represents the EDNS client subnet settings
+type ECSConfig struct {
+	// Mode of the client subnet, ECSStatic when empty
+	Mode string `json:"mode"`
+
+	// IPV4 and IPV6 the static subnet address, godot's public address when empty
+	IPV4 string `json:"ip_v4"`
+	IPV6 string `json:"ip_v6"`
+
+	// MaskBitsV4 and MaskBitsV6 the source prefix length of the subnets, 24 and 56 when zero,
+	// the client address is truncated to them
+	MaskBitsV4 uint8 `json:"mask_bits_v4"`
+	MaskBitsV6 uint8 `json:"mask_bits_v6"`
+
+	// Refresh the interval(minute) of detecting the public address again for the
+	// static subnet which address is empty, 0 disables
+	Refresh int `json:"refresh"`
+
+	// Clients the subnet overrides, map[client CIDR]subnet CIDR, the longest matched
+	// client CIDR wins, the empty subnet asks the upstream not to use the client address
+	Clients map[string]string `json:"clients"`
+}
+
+// ecs the client subnet selector
+type ecs struct {
+	mode           string
+	maskV4, maskV6 uint8
+	overrides      []override // sorted by the client prefix length descending
+}
+
+// override the subnet of the clients
+type override struct {
+	clients netip.Prefix
+	subnet  *dns.EDNS0_SUBNET
+}
+
+// newECS return nil when config is nil
+func newECS(config *ECSConfig) (*ecs, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	var e = &ecs{mode: config.Mode, maskV4: config.MaskBitsV4, maskV6: config.MaskBitsV6}
+	switch e.mode {
+	case "":
+		e.mode = ECSStatic
+	case ECSStatic, ECSClient:
+	default:
+		return nil, fmt.Errorf("unknown ecs mode %s", e.mode)
+	}
+
+	for rawClients, rawSubnet := range config.Clients {
+		clients, err := netip.ParsePrefix(rawClients)
+		if err != nil {
+			return nil, fmt.Errorf("ecs client %s error=[%+v]", rawClients, err)
+		}
+
+		var subnet = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		if len(rawSubnet) > 0 {
+			if subnet, err = netip.ParsePrefix(rawSubnet); err != nil {
+				return nil, fmt.Errorf("ecs subnet %s of %s error=[%+v]", rawSubnet, rawClients, err)
+			}
+		}
+
+		e.overrides = append(e.overrides, override{clients: clients.Masked(), subnet: util.DNSNewSubnetFromPrefix(subnet)})
+	}
+
+	slices.SortFunc(e.overrides, func(a, b override) int {
+		return b.clients.Bits() - a.clients.Bits()
+	})
+
+	return e, nil
+}
+
+// client return the subnet of the client ip by the overrides or the client mode,
+// mode is the one of the client group, the configured one when empty
+// return false when the static subnet should be used
+func (e *ecs) client(ip net.IP, mode string) (*dns.EDNS0_SUBNET, bool) {
+	if ip == nil || mode == ECSOff {
+		return nil, false
+	}
+
+	if e == nil {
+		if mode != ECSClient {
+			return nil, false
+		}
+		// the client group asks for the client subnet without the ECS settings
+		e = &ecs{mode: ECSClient}
+	}
+	if len(mode) == 0 {
+		mode = e.mode
+	}
+
+	if addr, ok := netip.AddrFromSlice(ip); ok {
+		addr = addr.Unmap()
+		for _, o := range e.overrides {
+			if o.clients.Contains(addr) {
+				return o.subnet, true
+			}
+		}
+	}
+
+	if mode != ECSClient || !util.IPIsPublic(ip) {
+		return nil, false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return util.DNSNewSubnetFromIP(ip4, min(e.maskV4, util.IPV4MaskBitsDefault)), true
+	}
+	return util.DNSNewSubnetFromIP(ip, min(e.maskV6, util.IPV6MaskBitsDefault)), true
+}
+
+// Scope return the cache scope of the client ip in the client group of policy,
+// the answers of the different client subnets are cached apart, empty for the
+// static subnet, the answers of the client group with its own upstream group or
+// without the subnet are cached apart too
+func (s *UpStream) Scope(ip net.IP, policy *model.Policy) string {
+	var mode, scope string
+	if policy != nil {
+		mode = policy.ECS
+	}
+	if subnet, ok := s.ecs.client(ip, mode); ok {
+		scope = util.DNSSubnetPrefix(subnet).String()
+	}
+
+	if policy != nil && (len(policy.Upstream) > 0 || policy.ECS == ECSOff) {
+		scope = cache.GroupScope(policy.Group, scope)
+	}
+	return scope
+}
+
+// ValidECS report whether mode is a client subnet mode of the client groups
+func ValidECS(mode string) bool {
+	switch mode {
+	case "", ECSStatic, ECSClient, ECSOff:
+		return true
+	default:
+		return false
+	}
+}
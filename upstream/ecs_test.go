@@ -0,0 +1,119 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/model"
+	"github.com/treemana/godot/util"
+)
+
+func TestECSClient(t *testing.T) {
+	e, err := newECS(&ECSConfig{
+		Mode: ECSClient,
+		Clients: map[string]string{
+			"10.8.0.0/16": "203.0.113.7/24",
+			"10.8.1.0/24": "",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		ip     string
+		subnet string
+		ok     bool
+	}{
+		{"8.8.4.4", "8.8.4.0/24", true},
+		{"2001:4860:4860::8844", "2001:4860:4860::/56", true},
+		{"192.168.1.2", "", false},
+		{"100.64.1.2", "", false},
+		{"::1", "", false},
+		{"10.8.2.3", "203.0.113.0/24", true},
+		{"10.8.1.3", "0.0.0.0/0", true},
+	}
+	for _, test := range tests {
+		subnet, ok := e.client(net.ParseIP(test.ip), "")
+		if ok != test.ok {
+			t.Errorf("client(%s) = %t, want %t", test.ip, ok, test.ok)
+			continue
+		}
+		if got := util.DNSSubnetPrefix(subnet); ok && got.String() != test.subnet {
+			t.Errorf("client(%s) = %s, want %s", test.ip, got, test.subnet)
+		}
+	}
+
+	// the static mode uses the overrides only
+	if e, err = newECS(&ECSConfig{Mode: ECSStatic}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e.client(net.ParseIP("8.8.4.4"), ""); ok {
+		t.Error("static client(8.8.4.4) = true, want false")
+	}
+
+	// the client groups override the mode
+	if _, ok := e.client(net.ParseIP("8.8.4.4"), ECSClient); !ok {
+		t.Error("static client(8.8.4.4, client) = false, want true")
+	}
+
+	// ECS disabled
+	if _, ok := (*ecs)(nil).client(net.ParseIP("8.8.4.4"), ""); ok {
+		t.Error("nil client(8.8.4.4) = true, want false")
+	}
+	if _, ok := (*ecs)(nil).client(net.ParseIP("8.8.4.4"), ECSClient); !ok {
+		t.Error("nil client(8.8.4.4, client) = false, want true")
+	}
+}
+
+func TestScope(t *testing.T) {
+	var s = new(UpStream)
+	var ip = net.ParseIP("8.8.4.4")
+
+	var tests = []struct {
+		policy *model.Policy
+		scope  string
+	}{
+		{nil, ""},
+		{&model.Policy{Group: "kids"}, ""},
+		{&model.Policy{Group: "kids", ECS: ECSClient}, "8.8.4.0/24"},
+		{&model.Policy{Group: "kids", Upstream: "family", ECS: ECSClient}, "kids|8.8.4.0/24"},
+		{&model.Policy{Group: "guests", ECS: ECSOff}, "guests|"},
+	}
+	for _, test := range tests {
+		if got := s.Scope(ip, test.policy); got != test.scope {
+			t.Errorf("Scope(%+v) = %s, want %s", test.policy, got, test.scope)
+		}
+	}
+}
+
+func TestSetSubnets(t *testing.T) {
+	var s = new(UpStream)
+	var v4 = util.DNSNewSubnetFromIP(net.ParseIP("203.0.113.7"), 24)
+	var v6 = util.DNSNewSubnetFromIP(net.ParseIP("2001:db8::7"), 56)
+
+	s.SetSubnets([]*dns.EDNS0_SUBNET{v4, v6})
+	if s.subnetV4.Load() != v4 || s.subnetV6.Load() != v6 {
+		t.Fatalf("SetSubnets() v4 = %v, v6 = %v", s.subnetV4.Load(), s.subnetV6.Load())
+	}
+
+	var req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	s.setSubnet(req, nil, nil)
+	if got := util.DNSSubnetPrefix(req.IsEdns0().Option[0].(*dns.EDNS0_SUBNET)).String(); got != "203.0.113.0/24" {
+		t.Errorf("setSubnet() = %s, want 203.0.113.0/24", got)
+	}
+
+	req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if s.setSubnet(req, nil, &model.Policy{ECS: ECSOff}); util.DNSSubnetExist(req) {
+		t.Error("setSubnet() without the subnet added one")
+	}
+
+	s.SetSubnets([]*dns.EDNS0_SUBNET{nil, v6})
+	if s.subnetV4.Load() != nil {
+		t.Errorf("SetSubnets() v4 = %v, want nil", s.subnetV4.Load())
+	}
+}
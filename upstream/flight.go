@@ -0,0 +1,76 @@
+package upstream
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/model"
+)
+
+// flightKey return the coalescing key of req in the cache scope
+// identical requests have the same name, type, class, ECS, CD bit and scope,
+// the client groups resolving by their own upstream are scoped apart
+func flightKey(req *dns.Msg, scope string) string {
+	var q = req.Question[0]
+	var subnet string
+	if opt := req.IsEdns0(); opt != nil {
+		for _, edns0 := range opt.Option {
+			if edns0.Option() == dns.EDNS0SUBNET {
+				subnet = edns0.String()
+				break
+			}
+		}
+	}
+	return fmt.Sprintf("%s|%d|%d|%s|%t|%s", dns.CanonicalName(q.Name), q.Qtype, q.Qclass, subnet, req.CheckingDisabled, scope)
+}
+
+// join add dt to the waiters of the in-flight request which has the same key
+// return false when no such request, dt will be the leader of a new flight
+func (s *UpStream) join(dt *model.DT) bool {
+	s.flightMutex.Lock()
+	defer s.flightMutex.Unlock()
+
+	if waiters, ok := s.flights[dt.Key]; ok {
+		s.flights[dt.Key] = append(waiters, dt)
+		log.Sugar.Debugf("sn=%d, id=%d, coalesced [%s]", dt.SN, dt.Request.Id, dt.Key)
+		return true
+	}
+
+	s.flights[dt.Key] = nil
+	return false
+}
+
+// reply send dt to the response channel, and answer all the waiters of dt
+// with a copy of dt.Response
+func (s *UpStream) reply(dt *model.DT) {
+	var waiters []*model.DT
+	if len(dt.Key) > 0 {
+		s.flightMutex.Lock()
+		waiters = s.flights[dt.Key]
+		delete(s.flights, dt.Key)
+		s.flightMutex.Unlock()
+	}
+
+	// the AD bit is decided by the validator only when it is enabled
+	if s.validator != nil && dt.Response != nil {
+		dt.Response.AuthenticatedData = dt.Secure
+	}
+
+	// copy before sending, dt.Response may be changed after sent
+	for _, waiter := range waiters {
+		if dt.Response != nil {
+			waiter.Response = dt.Response.Copy()
+			waiter.Response.Id = waiter.Request.Id
+		}
+		waiter.Provisional = dt.Provisional
+		waiter.Secure = dt.Secure
+	}
+
+	s.doc <- dt
+
+	for _, waiter := range waiters {
+		s.doc <- waiter
+	}
+}
@@ -0,0 +1,56 @@
+package upstream
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/cache"
+	"github.com/treemana/godot/model"
+	"github.com/treemana/godot/resolver"
+)
+
+func TestFlightGroups(t *testing.T) {
+	var def, family = newFakeResolver(1, 50*time.Millisecond, dns.RcodeSuccess, ""), newFakeResolver(2, 50*time.Millisecond, dns.RcodeSuccess, "")
+	var s, _ = newTestUpStream(t, "")
+	s.fastest.Policy = PolicyFirst
+	s.group = newGroup(defaultGroup, []resolver.Resolver{def})
+	s.groups = map[string]*group{defaultGroup: s.group, "family": newGroup("family", []resolver.Resolver{family})}
+	s.flights = make(map[string][]*model.DT)
+	s.doc = make(chan *model.DT, 3)
+
+	var kids = &model.Policy{Group: "kids", Upstream: "family"}
+	var dts = []*model.DT{
+		{SN: 1, Policy: nil},
+		{SN: 2, Policy: kids, Scope: cache.GroupScope(kids.Group, "")},
+		{SN: 3, Policy: nil},
+	}
+
+	var wg sync.WaitGroup
+	for _, dt := range dts {
+		dt.Request = new(dns.Msg)
+		dt.Request.SetQuestion("example.com.", dns.TypeA)
+
+		wg.Add(1)
+		go func(dt *model.DT) {
+			defer wg.Done()
+			s.resolve(dt)
+		}(dt)
+	}
+	wg.Wait()
+
+	var want = map[uint64]string{1: "10.0.0.1", 2: "10.0.0.2", 3: "10.0.0.1"}
+	for range dts {
+		var dt = <-s.doc
+		if dt.Response == nil || len(dt.Response.Answer) == 0 || dt.Response.Answer[0].(*dns.A).A.String() != want[dt.SN] {
+			t.Errorf("sn=%d response = %v, want %s", dt.SN, dt.Response, want[dt.SN])
+		}
+	}
+
+	// the requests of the default group are coalesced, the kids one is not
+	if def.calls.Load() != 1 || family.calls.Load() != 1 {
+		t.Errorf("resolver calls = %d, %d, want 1, 1", def.calls.Load(), family.calls.Load())
+	}
+}
@@ -0,0 +1,125 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/resolver"
+)
+
+const (
+	ewmaAlpha      = 0.3             // weight of the latest latency sample
+	latencyPenalty = 2 * time.Second // latency sample of the failed request
+	latencySamples = 64              // number of the latest latency samples kept for percentile
+)
+
+// member the resolver of a group with its weight and observed latency
+type member struct {
+	resolver.Resolver
+
+	// weight of the weighted random strategy, by url query "weight", 1 by default
+	weight int
+
+	mutex   sync.Mutex
+	ewma    time.Duration // exponentially weighted moving average latency, 0 before the first sample
+	samples []time.Duration
+	index   int // the next index of samples to write
+}
+
+func newMember(r resolver.Resolver) *member {
+	var m = &member{Resolver: r, weight: 1}
+	if w, err := strconv.Atoi(r.URL().Query().Get("weight")); err == nil && w >= 0 {
+		m.weight = w
+	}
+	return m
+}
+
+// resolve req by the resolver and observe the latency
+// the elapsed time of the request canceled by ctx is the lower bound of its
+// latency, it never lowers the estimate, the hedged losers are canceled as soon
+// as the winner replied
+func (m *member) resolve(ctx context.Context, req *dns.Msg) *dns.Msg {
+	start := time.Now()
+	resp := m.Resolve(ctx, req)
+	elapse := time.Since(start)
+
+	switch {
+	case resp != nil:
+		m.observe(elapse)
+	case errors.Is(ctx.Err(), context.Canceled):
+		m.observe(max(elapse, m.latency()))
+	default:
+		m.observe(max(elapse, latencyPenalty))
+	}
+
+	return resp
+}
+
+func (m *member) observe(latency time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.samples) < latencySamples {
+		m.samples = append(m.samples, latency)
+	} else {
+		m.samples[m.index] = latency
+	}
+	m.index = (m.index + 1) % latencySamples
+
+	if m.ewma == 0 {
+		m.ewma = latency
+		return
+	}
+	m.ewma = time.Duration(ewmaAlpha*float64(latency) + (1-ewmaAlpha)*float64(m.ewma))
+}
+
+// percentile return the p(0, 100] percentile of the latest latency samples
+// return false when no sample
+func (m *member) percentile(p float64) (time.Duration, bool) {
+	m.mutex.Lock()
+	var samples = slices.Clone(m.samples)
+	m.mutex.Unlock()
+
+	if len(samples) == 0 {
+		return 0, false
+	}
+
+	slices.Sort(samples)
+	var i = int(math.Ceil(p/100*float64(len(samples)))) - 1
+	return samples[min(max(i, 0), len(samples)-1)], true
+}
+
+func (m *member) latency() time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.ewma
+}
+
+func (m *member) String() string {
+	var u = m.URL()
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+}
+
+// group the resolvers which a request is dispatched to
+type group struct {
+	name    string
+	members []*member
+	next    atomic.Uint64 // round-robin counter
+}
+
+func newGroup(name string, resolvers []resolver.Resolver) *group {
+	var g = &group{name: name, members: make([]*member, 0, len(resolvers))}
+	for _, r := range resolvers {
+		g.members = append(g.members, newMember(r))
+	}
+	return g
+}
@@ -0,0 +1,64 @@
+package upstream
+
+import (
+	"fmt"
+
+	"github.com/treemana/godot/util"
+)
+
+// A/AAAA answer policies
+const (
+	PolicyFastest     = "fastest"     // the fastest address only
+	PolicyRanked      = "ranked"      // all reachable addresses, ordered by latency
+	PolicyPassthrough = "passthrough" // all upstream addresses, as they are
+	PolicyFirst       = "first"       // the first resolver response wins
+)
+
+// PolicyRule select the policy for the domains matched the rule
+// rule syntax see util.DomainRule
+type PolicyRule struct {
+	Domain string `json:"domain"`
+	Policy string `json:"policy"`
+}
+
+type policyRule struct {
+	rule   *util.DomainRule
+	policy string
+}
+
+func validPolicy(policy string) bool {
+	switch policy {
+	case PolicyFastest, PolicyRanked, PolicyPassthrough, PolicyFirst:
+		return true
+	default:
+		return false
+	}
+}
+
+func newPolicyRules(rules []PolicyRule) ([]policyRule, error) {
+	var prs = make([]policyRule, 0, len(rules))
+	for _, r := range rules {
+		if !validPolicy(r.Policy) {
+			return nil, fmt.Errorf("domain %s unknown policy %s", r.Domain, r.Policy)
+		}
+
+		dr, err := util.NewDomainRule(r.Domain)
+		if err != nil {
+			return nil, err
+		}
+
+		prs = append(prs, policyRule{rule: dr, policy: r.Policy})
+	}
+	return prs, nil
+}
+
+// policy return the policy of the first rule matched name
+// return the default policy when nothing matched
+func (s *UpStream) policy(name string) string {
+	for _, pr := range s.policyRules {
+		if pr.rule.Match(name) {
+			return pr.policy
+		}
+	}
+	return s.fastest.Policy
+}
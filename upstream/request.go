@@ -7,104 +7,216 @@ import (
 	"github.com/miekg/dns"
 
 	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/metrics"
+	"github.com/treemana/godot/model"
 	"github.com/treemana/godot/util"
 )
 
+// request resolve dt from s.dic until it closed
+// there are s.concurrency request goroutines running at the same time
 func (s *UpStream) request() {
-	var resolversChan = make(chan *dns.Msg, len(s.resolvers))
 	for dt := range s.dic {
-		if len(dt.Request.Question) != 1 {
-			log.Sugar.Warnf("sn=%d, id=%d, question=%d ", dt.SN, dt.Request.Id, len(dt.Request.Question))
-			continue
-		}
+		metrics.Add(metricResolving, 1)
+		s.resolve(dt)
+		metrics.Add(metricResolving, -1)
+	}
+}
 
-		if len(dt.Request.Answer) > 0 {
-			log.Sugar.Warnf("sn=%d, id=%d, answer=%d", dt.SN, dt.Request.Id, len(dt.Request.Answer))
-			continue
+func (s *UpStream) resolve(dt *model.DT) {
+	if len(dt.Request.Question) != 1 {
+		log.Sugar.Warnf("sn=%d, id=%d, question=%d ", dt.SN, dt.Request.Id, len(dt.Request.Question))
+		return
+	}
+
+	if len(dt.Request.Answer) > 0 {
+		log.Sugar.Warnf("sn=%d, id=%d, answer=%d", dt.SN, dt.Request.Id, len(dt.Request.Answer))
+		return
+	}
+
+	if dt.Response != nil {
+		log.Sugar.Warnf("sn=%d, id=%d, response not nil", dt.SN, dt.Request.Id)
+		return
+	}
+
+	req := dt.Request.Copy()
+
+	// the cache refreshing request has no remote address
+	var ip net.IP
+	if dt.RemoteAddr != nil {
+		ip = dt.RemoteAddr.IP
+	}
+	s.setSubnet(req, ip, dt.Policy)
+
+	// identical request is resolving, wait for its response
+	if dt.Key = flightKey(req, dt.Scope); s.join(dt) {
+		return
+	}
+
+	// the requester with CD asks for the data without validation, RFC 4035 Section 3.2.2
+	var validate = s.validator != nil && !dt.Request.CheckingDisabled
+	if validate {
+		util.DNSSetDO(req)
+		req.CheckingDisabled = true
+	}
+
+	// cancel the slow resolvers when resolve returned,
+	// resolversChan is buffered, the late responses will not block
+	ctx, cancel := context.WithCancel(dt.Context())
+	defer cancel()
+
+	resolversChan, replies := s.exchange(ctx, s.route(req.Question[0].Name, dt.Policy), req)
+
+	var policy = PolicyFirst
+	switch req.Question[0].Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		policy = s.policy(req.Question[0].Name)
+	}
+
+	var results = s.wait(ctx, dt, resolversChan, replies, policy)
+	if s.consensus.Mode != ConsensusOff {
+		var ok bool
+		if results, ok = s.verify(dt, results); !ok {
+			dt.Response = util.DNSNewServFail(dt.Request)
 		}
+	}
 
+	if validate && dt.Response == nil {
+		results = s.validate(ctx, dt, results)
+	}
+
+	var answerMap = make(map[string]struct{})
+	for _, r := range results {
 		if dt.Response != nil {
-			log.Sugar.Warnf("sn=%d, id=%d, response not nil", dt.SN, dt.Request.Id)
+			break
+		}
+
+		var response = r.msg
+		if response.Rcode != dns.RcodeSuccess {
+			// something unusual happen
+			log.Sugar.Warnf("sn=%d, id=%d, response code [%s] from %s", dt.SN, dt.Request.Id, dns.RcodeToString[response.Rcode], r.from)
+			dt.Response = response
 			continue
 		}
 
-		req := dt.Request.Copy()
+		switch policy {
+		case PolicyFastest, PolicyRanked, PolicyPassthrough:
+			for _, rr := range response.Answer {
+				ip := util.DNSSplitAnswer(rr)
+				if len(ip) == 0 {
+					continue
+				}
 
-		s.setSubnet(req, dt.RemoteAddr.IP)
+				k := ip.String()
+				if _, ok := answerMap[k]; ok {
+					continue
+				}
 
-		for index := range s.resolvers {
-			go func(i int) {
-				resolversChan <- s.resolvers[i].Resolve(context.TODO(), req)
-			}(index)
+				answerMap[k] = struct{}{}
+				dt.Answers = append(dt.Answers, rr)
+			}
+		default:
+			// if query type is not A or AAAA or the policy is PolicyFirst,
+			// the first response by resolver will be return
+			dt.Response = response
 		}
+	}
 
-		var answerMap = make(map[string]struct{})
-		for n := len(s.resolvers); n > 0; n-- {
-			response := <-resolversChan
-			if dt.Response != nil || response == nil {
-				continue
-			}
+	// response should add to cache and s.doc
+	if dt.Response != nil {
+		s.reply(dt)
+		return
+	}
 
-			if response.Rcode != dns.RcodeSuccess {
-				// something unusual happen
-				log.Sugar.Warnf("sn=%d, id=%d, response code [%s]", dt.SN, dt.Request.Id, dns.RcodeToString[response.Rcode])
-				dt.Response = response
-				// do not break or return
-				// the channel element filled by other resolvers need clean up
-				continue
-			}
+	// deadline exceeded before any answer
+	if len(dt.Answers) == 0 && ctx.Err() != nil {
+		dt.Response = util.DNSNewServFail(dt.Request)
+		s.reply(dt)
+		return
+	}
 
-			switch req.Question[0].Qtype {
-			case dns.TypeA, dns.TypeAAAA:
-				for _, rr := range response.Answer {
-					ip := util.DNSSplitAnswer(rr)
-					if len(ip) == 0 {
-						continue
-					}
-
-					k := ip.String()
-					if _, ok := answerMap[k]; ok {
-						continue
-					}
-
-					answerMap[k] = struct{}{}
-					dt.Answers = append(dt.Answers, rr)
-				}
-			default:
-				// if query type is not A or AAAA, the first response by resolver will be return
-				dt.Response = response
-			}
+	// the upstream answers without latency selection
+	if policy == PolicyPassthrough {
+		if dt.Response = util.DNSNewResponseByAnswer(dt.Request, dt.Answers); dt.Response == nil {
+			dt.Response = util.DNSNewNXDomain(dt.Request)
 		}
+		s.reply(dt)
+		return
+	}
 
-		// response should add to cache and s.doc
-		if dt.Response != nil {
-			s.doc <- dt
+	// answer immediately, the fastest one will be found in background
+	if s.fastest.Async && len(dt.Answers) > 0 {
+		s.asyncResponse(dt)
+		return
+	}
+
+	// query type A or AAAA need find the fastest one
+	s.fastestChan <- dt
+}
+
+// wait receive the replies results from c until ctx done, return the succeeded ones
+// without consensus verification, the first valid response which is not success
+// or the first valid response of PolicyFirst is enough, the failures are returned
+// only when no valid response received
+func (s *UpStream) wait(ctx context.Context, dt *model.DT, c chan result, replies int, policy string) []result {
+	var results, failures = make([]result, 0, replies), make([]result, 0, replies)
+loop:
+	for n := replies; n > 0; n-- {
+		var r result
+		select {
+		case r = <-c:
+		case <-ctx.Done():
+			log.Sugar.Warnf("sn=%d, id=%d, %s, %d resolvers not replied", dt.SN, dt.Request.Id, ctx.Err(), n)
+			break loop
+		}
+
+		if r.msg == nil {
+			continue
+		}
+		if s.consensus.Mode == ConsensusOff && !valid(r.msg) {
+			failures = append(failures, r)
 			continue
 		}
+		results = append(results, r)
 
-		// query type A or AAAA need find the fastest one
-		s.fastestChan <- dt
+		if s.consensus.Mode == ConsensusOff && (r.msg.Rcode != dns.RcodeSuccess || policy == PolicyFirst) {
+			break
+		}
+	}
+
+	if len(results) == 0 {
+		return failures
 	}
+	return results
 }
 
-// setSubnet set system subnet to dns.Msg EDNS0
-// do nothing when req had a subnet already
-func (s *UpStream) setSubnet(req *dns.Msg, ip net.IP) {
-	if util.DNSSubnetExist(req) {
+// setSubnet set the subnet of the client ip to dns.Msg EDNS0,
+// the static subnet when the client has none
+// do nothing when req had a subnet already or the client group has no subnet
+func (s *UpStream) setSubnet(req *dns.Msg, ip net.IP, policy *model.Policy) {
+	var mode string
+	if policy != nil {
+		mode = policy.ECS
+	}
+	if util.DNSSubnetExist(req) || mode == ECSOff {
+		return
+	}
+
+	if subnet, ok := s.ecs.client(ip, mode); ok {
+		util.DNSSetSUBNET(req, subnet)
 		return
 	}
 
 	var subnet *dns.EDNS0_SUBNET
 	switch req.Question[0].Qtype {
 	case dns.TypeA:
-		subnet = s.subnetV4
+		subnet = s.subnetV4.Load()
 	case dns.TypeAAAA:
-		subnet = s.subnetV6
+		subnet = s.subnetV6.Load()
 	default:
 		if v4 := ip.To4(); v4 != nil {
-			subnet = s.subnetV4
+			subnet = s.subnetV4.Load()
 		} else {
-			subnet = s.subnetV6
+			subnet = s.subnetV6.Load()
 		}
 	}
 
@@ -2,11 +2,14 @@ package upstream
 
 import (
 	"math"
+	"sort"
 	"sync"
 
 	"github.com/miekg/dns"
 
 	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/metrics"
+	"github.com/treemana/godot/model"
 	"github.com/treemana/godot/util"
 )
 
@@ -17,42 +20,101 @@ func (s *UpStream) response() {
 	for dt := range s.fastestChan {
 		log.Sugar.Infof("sn=%d, id=%d, len(dt.Answers)=%d", dt.SN, dt.Request.MsgHdr.Id, len(dt.Answers))
 
-		if len(dt.Answers) == 0 {
-			dt.Response = util.DNSNewNXDomain(dt.Request)
+		response := s.fastestResponse(dt)
+
+		// the client had been answered, only the cache need the fastest one,
+		// the background dt without the remote address is not written
+		if dt.Background {
+			log.Sugar.Debugf("sn=%d, id=%d, background fastest updated", dt.SN, dt.Request.MsgHdr.Id)
+			dt.Response = response
 			s.doc <- dt
 			continue
 		}
 
-		var latencies = make([]uint32, len(dt.Answers))
+		dt.Response = response
+		s.reply(dt)
+	}
+}
 
-		var wg sync.WaitGroup
-		wg.Add(len(dt.Answers))
-		for i := range dt.Answers {
-			go func(index int) {
-				latencies[index] = util.Ping(util.DNSSplitAnswer(dt.Answers[index]).String())
-				wg.Done()
-			}(i)
-		}
-		wg.Wait()
+// fastestResponse return the response with the fastest answer of dt.Answers,
+// or all the reachable answers ordered by latency when the policy is PolicyRanked
+// return DNS failed reply when all answers can't establish connection
+func (s *UpStream) fastestResponse(dt *model.DT) *dns.Msg {
+	if len(dt.Answers) == 0 {
+		return util.DNSNewNXDomain(dt.Request)
+	}
 
-		var fastest int
-		for i, latency := range latencies {
-			if latency < latencies[fastest] {
-				fastest = i
-			}
-		}
+	var latencies = make([]uint32, len(dt.Answers))
 
-		if latencies[fastest] == math.MaxUint32 {
-			dt.Response = util.DNSNewNXDomain(dt.Request)
-			s.doc <- dt
-			continue
+	var wg sync.WaitGroup
+	wg.Add(len(dt.Answers))
+	for i := range dt.Answers {
+		go func(index int) {
+			latencies[index] = util.PingContext(dt.Context(), util.DNSSplitAnswer(dt.Answers[index]).String())
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	var indexes = make([]int, 0, len(latencies))
+	for i, latency := range latencies {
+		if latency < math.MaxUint32 {
+			indexes = append(indexes, i)
 		}
+	}
 
-		dt.Answers[fastest].Header().Ttl = ttl
+	if len(indexes) == 0 {
+		return util.DNSNewNXDomain(dt.Request)
+	}
+
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return latencies[indexes[i]] < latencies[indexes[j]]
+	})
+
+	if s.policy(dt.Request.Question[0].Name) != PolicyRanked {
+		indexes = indexes[:1]
+	}
+
+	var answers = make([]dns.RR, 0, len(indexes))
+	for _, i := range indexes {
+		dt.Answers[i].Header().Ttl = ttl
+		answers = append(answers, dt.Answers[i])
+	}
+
+	var response = util.DNSNewResponseByAnswer(dt.Request, answers)
+	response.AuthenticatedData = dt.Secure
+	return response
+}
+
+// asyncResponse answer dt immediately with all the upstream answers and a short ttl,
+// the fastest answer will be selected by a background dt and updated to the cache
+func (s *UpStream) asyncResponse(dt *model.DT) {
+	var answers = make([]dns.RR, 0, len(dt.Answers))
+	for _, rr := range dt.Answers {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = s.fastest.AsyncTTL
+		answers = append(answers, rr)
+	}
+
+	var background = &model.DT{
+		SN:         dt.SN,
+		Request:    dt.Request,
+		Answers:    dt.Answers,
+		Secure:     dt.Secure,
+		Scope:      dt.Scope,
+		Background: true,
+	}
 
-		dt.Response = util.DNSNewResponseByAnswer(dt.Request, []dns.RR{dt.Answers[fastest]})
+	dt.Response = util.DNSNewResponseByAnswer(dt.Request, answers)
+	dt.Provisional = true
+	s.reply(dt)
 
-		// resolve
-		s.doc <- dt
+	// the client is answered, the fastest selection is skipped when the ping
+	// workers are busy, the provisional answer expires in the short ttl
+	select {
+	case s.fastestChan <- background:
+	default:
+		metrics.Add(metricFastestDropped, 1)
+		log.Sugar.Warnf("sn=%d, id=%d, fastest workers busy, background selection dropped", dt.SN, dt.Request.Id)
 	}
 }
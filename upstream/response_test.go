@@ -0,0 +1,44 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/model"
+)
+
+func TestAsyncResponse(t *testing.T) {
+	// no ping worker is receiving, the client should be answered anyway
+	var s = &UpStream{
+		fastest:     FastestConfig{AsyncTTL: 10},
+		doc:         make(chan *model.DT, 1),
+		fastestChan: make(chan *model.DT),
+	}
+
+	var req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	rr, err := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dt = &model.DT{SN: 1, Request: req, Answers: []dns.RR{rr}}
+
+	var done = make(chan struct{})
+	go func() {
+		s.asyncResponse(dt)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("asyncResponse() blocked by the busy ping workers")
+	}
+
+	var got = <-s.doc
+	if !got.Provisional || len(got.Response.Answer) != 1 || got.Response.Answer[0].Header().Ttl != 10 {
+		t.Errorf("asyncResponse() = %v, want the provisional answer", got.Response)
+	}
+}
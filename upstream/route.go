@@ -0,0 +1,94 @@
+package upstream
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/model"
+	"github.com/treemana/godot/resolver"
+	"github.com/treemana/godot/util"
+)
+
+const (
+	defaultGroup = "default" // the group of Config.Resolvers
+)
+
+// newRoutes return the domain suffix routing table of the named groups
+// the suffix "corp.example", ".corp.example" and "*.corp.example" are the same
+func newRoutes(groups map[string]*group, routes map[string]string) (map[string]*group, error) {
+	var table = make(map[string]*group, len(routes))
+	for suffix, name := range routes {
+		g, ok := groups[name]
+		if !ok {
+			return nil, fmt.Errorf("route %s unknown upstream group %s", suffix, name)
+		}
+
+		suffix = util.DomainNormalize(strings.TrimLeft(suffix, "*."))
+		table[suffix] = g
+		log.Sugar.Infof("upstream route %s => %s", suffix, name)
+	}
+	return table, nil
+}
+
+// newGroups return the named groups with the fastest resolver of each url group
+func newGroups(named map[string][][]string) (map[string]*group, error) {
+	var groups = make(map[string]*group, len(named))
+	for name, rawURLGroups := range named {
+		if name == defaultGroup {
+			return nil, fmt.Errorf("upstream group name %s is reserved", name)
+		}
+
+		g := newGroup(name, resolver.GetFastFromURLGroups(rawURLGroups))
+		if len(g.members) == 0 {
+			return nil, fmt.Errorf("upstream group %s has no available resolver", name)
+		}
+		groups[name] = g
+	}
+	return groups, nil
+}
+
+// route return the group of the longest matched suffix of name
+// return the upstream group of the client group policy, or the root route, or
+// the default group when nothing matched
+func (s *UpStream) route(name string, policy *model.Policy) *group {
+	var fallback = s.group
+	if policy != nil && len(policy.Upstream) > 0 {
+		if g, ok := s.groups[policy.Upstream]; ok {
+			fallback = g
+		}
+	}
+
+	if len(s.routes) == 0 {
+		return fallback
+	}
+
+	name = util.DomainNormalize(name)
+	for {
+		if g, ok := s.routes[name]; ok {
+			return g
+		}
+
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+
+	// the root route, after the upstream group of the client group
+	if fallback != s.group {
+		return fallback
+	}
+	if g, ok := s.routes[""]; ok {
+		return g
+	}
+
+	return fallback
+}
+
+// HasGroup report whether the upstream group name exists
+func (s *UpStream) HasGroup(name string) bool {
+	_, ok := s.groups[name]
+	return ok
+}
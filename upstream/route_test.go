@@ -0,0 +1,50 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/treemana/godot/model"
+)
+
+func TestRoute(t *testing.T) {
+	var def, corp, dev, ptr = &group{name: "default"}, &group{name: "corp"}, &group{name: "dev"}, &group{name: "ptr"}
+	var family = &group{name: "family"}
+	var s = &UpStream{
+		group:  def,
+		groups: map[string]*group{"default": def, "family": family},
+		routes: map[string]*group{
+			"corp.example":     corp,
+			"dev.corp.example": dev,
+			"10.in-addr.arpa":  ptr,
+		},
+	}
+
+	tests := []struct {
+		name string
+		want *group
+	}{
+		{name: "corp.example.", want: corp},
+		{name: "www.Corp.Example.", want: corp},
+		{name: "a.dev.corp.example.", want: dev},
+		{name: "devcorp.example.", want: def},
+		{name: "1.0.0.10.in-addr.arpa.", want: ptr},
+		{name: "1.0.0.11.in-addr.arpa.", want: def},
+		{name: "example.com.", want: def},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.route(tt.name, nil); got != tt.want {
+				t.Errorf("route() = %s, want %s", got.name, tt.want.name)
+			}
+		})
+	}
+
+	// the client group resolves the names not routed by its upstream group
+	var kids = &model.Policy{Group: "kids", Upstream: "family"}
+	if got := s.route("example.com.", kids); got != family {
+		t.Errorf("route() kids = %s, want family", got.name)
+	}
+	if got := s.route("www.corp.example.", kids); got != corp {
+		t.Errorf("route() kids = %s, want corp", got.name)
+	}
+}
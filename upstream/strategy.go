@@ -0,0 +1,271 @@
+package upstream
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upstream dispatch strategies
+const (
+	StrategyParallelAll    = "parallel-all"    // send to all the resolvers and wait for all of them
+	StrategyParallelFirst  = "parallel-first"  // send to all the resolvers, the first valid response wins
+	StrategySequential     = "sequential"      // try the resolvers one by one in the configured order
+	StrategyRoundRobin     = "round-robin"     // try the resolvers one by one, start from the next one
+	StrategyWeightedRandom = "weighted-random" // try the resolvers one by one, ordered by weighted random
+	StrategyLowestLatency  = "lowest-latency"  // try the resolvers one by one, ordered by ewma latency
+	StrategyHedged         = "hedged"          // send to the next resolver when the previous one is slow
+
+	defaultAttemptTimeout = 2 * time.Second
+	defaultHedgeDelay     = 100 * time.Millisecond
+)
+
+// StrategyConfig represents the upstream dispatch strategy settings
+type StrategyConfig struct {
+	// Name of the strategy, StrategyParallelAll when empty
+	Name string `json:"name"`
+
+	// Timeout of every attempt of the one by one strategies, millisecond, 2000 when zero
+	Timeout int `json:"timeout"`
+
+	// HedgeDelay the hedged strategy sends to the next resolver when no valid
+	// response within the delay, millisecond, 100 when zero
+	HedgeDelay int `json:"hedge_delay"`
+
+	// HedgePercentile the delay is the percentile(0, 100] of the resolver's observed
+	// latency instead of HedgeDelay, HedgeDelay is used before the resolver observed
+	HedgePercentile float64 `json:"hedge_percentile"`
+}
+
+func (c *StrategyConfig) init() error {
+	switch c.Name {
+	case "":
+		c.Name = StrategyParallelAll
+	case StrategyParallelAll, StrategyParallelFirst, StrategySequential, StrategyRoundRobin,
+		StrategyWeightedRandom, StrategyLowestLatency, StrategyHedged:
+	default:
+		return fmt.Errorf("unknown strategy %s", c.Name)
+	}
+
+	if c.Timeout <= 0 {
+		c.Timeout = int(defaultAttemptTimeout / time.Millisecond)
+	}
+
+	if c.HedgeDelay <= 0 {
+		c.HedgeDelay = int(defaultHedgeDelay / time.Millisecond)
+	}
+
+	if c.HedgePercentile < 0 || c.HedgePercentile > 100 {
+		return fmt.Errorf("invalid hedge percentile %f", c.HedgePercentile)
+	}
+
+	return nil
+}
+
+// valid report whether resp is an acceptable answer
+// the failure of one resolver should not be the answer when others are available
+func valid(resp *dns.Msg) bool {
+	return resp != nil && resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused
+}
+
+// result the response of exchange, msg is nil when failed
+type result struct {
+	from string // the resolver url, the group name when the strategy picks one of the resolvers
+	msg  *dns.Msg
+}
+
+// exchange dispatch req to the resolvers of g by the strategy
+// return the result channel and the number of results will be sent to it,
+// the channel is buffered, the late results will not block
+func (s *UpStream) exchange(ctx context.Context, g *group, req *dns.Msg) (chan result, int) {
+	if s.strategy.Name == StrategyParallelAll {
+		var c = make(chan result, len(g.members))
+		for _, m := range g.members {
+			go func(m *member) {
+				c <- result{from: m.URL().String(), msg: m.resolve(ctx, req)}
+			}(m)
+		}
+		return c, len(g.members)
+	}
+
+	var c = make(chan result, 1)
+	go func() {
+		var r = result{from: g.name}
+		switch s.strategy.Name {
+		case StrategyParallelFirst:
+			r.msg = parallelFirst(ctx, g.members, req)
+		case StrategyHedged:
+			r.msg = s.hedged(ctx, s.order(g), req)
+		default:
+			r.msg = s.failover(ctx, s.order(g), req)
+		}
+		c <- r
+	}()
+	return c, 1
+}
+
+// parallelFirst send req to all the members, return the first valid response
+// return the last response when none of them is valid
+func parallelFirst(ctx context.Context, members []*member, req *dns.Msg) *dns.Msg {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var c = make(chan *dns.Msg, len(members))
+	for _, m := range members {
+		go func(m *member) {
+			c <- m.resolve(ctx, req)
+		}(m)
+	}
+
+	var last *dns.Msg
+	for range members {
+		select {
+		case resp := <-c:
+			if valid(resp) {
+				return resp
+			}
+			if resp != nil {
+				last = resp
+			}
+		case <-ctx.Done():
+			return last
+		}
+	}
+	return last
+}
+
+// failover send req to the members one by one, return the first valid response
+// return the last response when none of them is valid
+func (s *UpStream) failover(ctx context.Context, members []*member, req *dns.Msg) *dns.Msg {
+	var timeout = time.Duration(s.strategy.Timeout) * time.Millisecond
+	var last *dns.Msg
+	for _, m := range members {
+		if ctx.Err() != nil {
+			break
+		}
+
+		attempt, cancel := context.WithTimeout(ctx, timeout)
+		resp := m.resolve(attempt, req)
+		cancel()
+
+		if valid(resp) {
+			return resp
+		}
+		if resp != nil {
+			last = resp
+		}
+	}
+	return last
+}
+
+// hedged send req to the best member first, the next member is sent when no valid
+// response within the hedge delay of the previous one or the previous one failed,
+// return the first valid response and cancel the rest
+// return the last response when none of them is valid
+func (s *UpStream) hedged(ctx context.Context, members []*member, req *dns.Msg) *dns.Msg {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var c = make(chan *dns.Msg, len(members))
+	var timer = time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	var sent int
+	var send = func() {
+		var m = members[sent]
+		sent++
+		go func() {
+			c <- m.resolve(ctx, req)
+		}()
+		timer.Reset(s.hedgeDelay(m))
+	}
+
+	var last *dns.Msg
+	send()
+	for received := 0; received < sent; {
+		var hedge <-chan time.Time
+		if sent < len(members) {
+			hedge = timer.C
+		}
+
+		select {
+		case resp := <-c:
+			received++
+			if valid(resp) {
+				return resp
+			}
+			if resp != nil {
+				last = resp
+			}
+			// the failed one needs no delay
+			if sent < len(members) {
+				send()
+			}
+		case <-hedge:
+			send()
+		case <-ctx.Done():
+			return last
+		}
+	}
+	return last
+}
+
+// hedgeDelay return the delay before hedging the request sent to m
+func (s *UpStream) hedgeDelay(m *member) time.Duration {
+	if s.strategy.HedgePercentile > 0 {
+		if delay, ok := m.percentile(s.strategy.HedgePercentile); ok {
+			return delay
+		}
+	}
+	return time.Duration(s.strategy.HedgeDelay) * time.Millisecond
+}
+
+// order return the members of g in the order of trying
+func (s *UpStream) order(g *group) []*member {
+	var members = slices.Clone(g.members)
+	if len(members) < 2 {
+		return members
+	}
+
+	switch s.strategy.Name {
+	case StrategyRoundRobin:
+		var start = int((g.next.Add(1) - 1) % uint64(len(members)))
+		members = append(members[start:], members[:start]...)
+	case StrategyWeightedRandom:
+		weightedShuffle(members)
+	case StrategyLowestLatency, StrategyHedged:
+		slices.SortStableFunc(members, func(a, b *member) int {
+			return cmp.Compare(a.latency(), b.latency())
+		})
+	}
+
+	return members
+}
+
+// weightedShuffle order members by weighted random sampling without replacement,
+// the member with 0 weight will be the last
+func weightedShuffle(members []*member) {
+	for i := range members {
+		var total int
+		for _, m := range members[i:] {
+			total += m.weight
+		}
+		if total <= 0 {
+			return
+		}
+
+		var n = rand.IntN(total)
+		for j := i; j < len(members); j++ {
+			if n < members[j].weight {
+				members[i], members[j] = members[j], members[i]
+				break
+			}
+			n -= members[j].weight
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/model"
+	"github.com/treemana/godot/resolver"
+)
+
+// fakeResolver answer A record with its ip after delay
+type fakeResolver struct {
+	u     *url.URL
+	ip    net.IP
+	delay time.Duration
+	rcode int
+	calls atomic.Int32
+}
+
+func newFakeResolver(i int, delay time.Duration, rcode int, query string) *fakeResolver {
+	return &fakeResolver{
+		u:     &url.URL{Scheme: "fake", Host: fmt.Sprintf("10.0.0.%d:53", i), RawQuery: query},
+		ip:    net.IPv4(10, 0, 0, byte(i)),
+		delay: delay,
+		rcode: rcode,
+	}
+}
+
+func (r *fakeResolver) Resolve(ctx context.Context, req *dns.Msg) *dns.Msg {
+	r.calls.Add(1)
+	select {
+	case <-time.After(r.delay):
+	case <-ctx.Done():
+		return nil
+	}
+
+	var resp = new(dns.Msg)
+	resp.SetRcode(req, r.rcode)
+	if r.rcode == dns.RcodeSuccess {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   r.ip,
+		})
+	}
+	return resp
+}
+
+func (r *fakeResolver) Probe(context.Context) (time.Duration, error) { return r.delay, nil }
+
+func (r *fakeResolver) URL() *url.URL { return r.u }
+
+func newTestUpStream(t *testing.T, strategy string, fakes ...*fakeResolver) (*UpStream, *group) {
+	var s = &UpStream{strategy: StrategyConfig{Name: strategy, Timeout: 200}, consensus: ConsensusConfig{Mode: ConsensusOff}}
+	if err := s.strategy.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var resolvers = make([]resolver.Resolver, 0, len(fakes))
+	for _, f := range fakes {
+		resolvers = append(resolvers, f)
+	}
+	return s, newGroup("test", resolvers)
+}
+
+// answer exchange a query and return the ip of the every response
+func answer(s *UpStream, g *group) []string {
+	var req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	c, n := s.exchange(context.Background(), g, req)
+
+	var ips = make([]string, 0, n)
+	for ; n > 0; n-- {
+		resp := (<-c).msg
+		if resp == nil || len(resp.Answer) == 0 {
+			ips = append(ips, "")
+			continue
+		}
+		ips = append(ips, resp.Answer[0].(*dns.A).A.String())
+	}
+	return ips
+}
+
+func TestStrategyParallelAll(t *testing.T) {
+	s, g := newTestUpStream(t, "",
+		newFakeResolver(1, 0, dns.RcodeSuccess, ""),
+		newFakeResolver(2, 20*time.Millisecond, dns.RcodeSuccess, ""),
+		newFakeResolver(3, 10*time.Millisecond, dns.RcodeSuccess, ""))
+
+	if got := answer(s, g); len(got) != 3 || got[0] != "10.0.0.1" || got[1] != "10.0.0.3" || got[2] != "10.0.0.2" {
+		t.Errorf("answer() = %v", got)
+	}
+}
+
+func TestStrategyParallelFirst(t *testing.T) {
+	slow := newFakeResolver(1, 50*time.Millisecond, dns.RcodeSuccess, "")
+	fail := newFakeResolver(2, 0, dns.RcodeServerFailure, "")
+	fast := newFakeResolver(3, 10*time.Millisecond, dns.RcodeSuccess, "")
+	s, g := newTestUpStream(t, StrategyParallelFirst, slow, fail, fast)
+
+	if got := answer(s, g); len(got) != 1 || got[0] != "10.0.0.3" {
+		t.Errorf("answer() = %v, want [10.0.0.3]", got)
+	}
+}
+
+func TestStrategyParallelAllFailure(t *testing.T) {
+	fail := newFakeResolver(1, 0, dns.RcodeServerFailure, "")
+	slow := newFakeResolver(2, 20*time.Millisecond, dns.RcodeSuccess, "")
+	s, g := newTestUpStream(t, "", fail, slow)
+	s.fastest.Policy = PolicyFirst
+	s.group, s.groups = g, map[string]*group{defaultGroup: g}
+	s.flights = make(map[string][]*model.DT)
+	s.doc = make(chan *model.DT, 1)
+
+	var dt = &model.DT{SN: 1, Request: new(dns.Msg)}
+	dt.Request.SetQuestion("example.com.", dns.TypeA)
+	s.resolve(dt)
+
+	// the fast failure is not the answer while the other one is valid
+	if dt = <-s.doc; dt.Response == nil || dt.Response.Rcode != dns.RcodeSuccess || len(dt.Response.Answer) == 0 || dt.Response.Answer[0].(*dns.A).A.String() != "10.0.0.2" {
+		t.Errorf("resolve() = %v, want the answer of 10.0.0.2", dt.Response)
+	}
+
+	// all failed, the failure is answered
+	slow.rcode = dns.RcodeServerFailure
+	dt = &model.DT{SN: 2, Request: new(dns.Msg)}
+	dt.Request.SetQuestion("example.org.", dns.TypeA)
+	s.resolve(dt)
+
+	if dt = <-s.doc; dt.Response == nil || dt.Response.Rcode != dns.RcodeServerFailure {
+		t.Errorf("resolve() = %v, want SERVFAIL", dt.Response)
+	}
+}
+
+func TestStrategySequential(t *testing.T) {
+	fail := newFakeResolver(1, 0, dns.RcodeServerFailure, "")
+	timeout := newFakeResolver(2, time.Second, dns.RcodeSuccess, "")
+	ok := newFakeResolver(3, 0, dns.RcodeSuccess, "")
+	unused := newFakeResolver(4, 0, dns.RcodeSuccess, "")
+	s, g := newTestUpStream(t, StrategySequential, fail, timeout, ok, unused)
+
+	if got := answer(s, g); len(got) != 1 || got[0] != "10.0.0.3" {
+		t.Errorf("answer() = %v, want [10.0.0.3]", got)
+	}
+
+	for i, f := range []*fakeResolver{fail, timeout, ok, unused} {
+		if want := int32(1 - i/3); f.calls.Load() != want {
+			t.Errorf("resolver %d calls = %d, want %d", i, f.calls.Load(), want)
+		}
+	}
+}
+
+func TestStrategyRoundRobin(t *testing.T) {
+	s, g := newTestUpStream(t, StrategyRoundRobin,
+		newFakeResolver(1, 0, dns.RcodeSuccess, ""),
+		newFakeResolver(2, 0, dns.RcodeSuccess, ""),
+		newFakeResolver(3, 0, dns.RcodeSuccess, ""))
+
+	for i, want := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"} {
+		if got := answer(s, g); len(got) != 1 || got[0] != want {
+			t.Errorf("round %d answer() = %v, want %s", i, got, want)
+		}
+	}
+}
+
+func TestStrategyWeightedRandom(t *testing.T) {
+	light := newFakeResolver(1, 0, dns.RcodeSuccess, "weight=1")
+	heavy := newFakeResolver(2, 0, dns.RcodeSuccess, "weight=9")
+	never := newFakeResolver(3, 0, dns.RcodeSuccess, "weight=0")
+	s, g := newTestUpStream(t, StrategyWeightedRandom, light, heavy, never)
+
+	for range 1000 {
+		answer(s, g)
+	}
+
+	if never.calls.Load() != 0 {
+		t.Errorf("weight 0 resolver calls = %d, want 0", never.calls.Load())
+	}
+	if light.calls.Load()+heavy.calls.Load() != 1000 || heavy.calls.Load() < 800 {
+		t.Errorf("weighted calls light = %d, heavy = %d", light.calls.Load(), heavy.calls.Load())
+	}
+}
+
+func TestStrategyLowestLatency(t *testing.T) {
+	slow := newFakeResolver(1, 30*time.Millisecond, dns.RcodeSuccess, "")
+	fast := newFakeResolver(2, 0, dns.RcodeSuccess, "")
+	s, g := newTestUpStream(t, StrategyLowestLatency, slow, fast)
+
+	// every resolver is tried once before it has a latency sample
+	answer(s, g)
+	answer(s, g)
+
+	for i := range 5 {
+		if got := answer(s, g); len(got) != 1 || got[0] != "10.0.0.2" {
+			t.Errorf("round %d answer() = %v, want [10.0.0.2]", i, got)
+		}
+	}
+
+	if slow.calls.Load() != 1 {
+		t.Errorf("slow resolver calls = %d, want 1", slow.calls.Load())
+	}
+}
+
+func TestStrategyHedged(t *testing.T) {
+	slow := newFakeResolver(1, 200*time.Millisecond, dns.RcodeSuccess, "")
+	fast := newFakeResolver(2, 0, dns.RcodeSuccess, "")
+	unused := newFakeResolver(3, 0, dns.RcodeSuccess, "")
+	s, g := newTestUpStream(t, StrategyHedged, slow, fast, unused)
+	s.strategy.HedgeDelay = 20
+
+	// the slow one is hedged by the next one after the delay
+	start := time.Now()
+	if got := answer(s, g); len(got) != 1 || got[0] != "10.0.0.2" {
+		t.Errorf("answer() = %v, want [10.0.0.2]", got)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond || elapsed > 150*time.Millisecond {
+		t.Errorf("hedged elapsed %s", elapsed)
+	}
+	if slow.calls.Load() != 1 || fast.calls.Load() != 1 || unused.calls.Load() != 0 {
+		t.Errorf("calls = %d %d %d, want 1 1 0", slow.calls.Load(), fast.calls.Load(), unused.calls.Load())
+	}
+
+	// wait for the canceled slow one observed
+	time.Sleep(10 * time.Millisecond)
+
+	// the best one replied within the delay, no hedging
+	if got := answer(s, g); len(got) != 1 || got[0] != "10.0.0.3" {
+		t.Errorf("answer() = %v, want [10.0.0.3]", got)
+	}
+	if slow.calls.Load() != 1 || fast.calls.Load() != 1 || unused.calls.Load() != 1 {
+		t.Errorf("calls = %d %d %d, want 1 1 1", slow.calls.Load(), fast.calls.Load(), unused.calls.Load())
+	}
+}
+
+func TestMemberPercentile(t *testing.T) {
+	var m = newMember(newFakeResolver(1, 0, dns.RcodeSuccess, ""))
+	if _, ok := m.percentile(95); ok {
+		t.Error("percentile() of no sample ok")
+	}
+
+	for i := 1; i <= 100; i++ {
+		m.observe(time.Duration(i) * time.Millisecond)
+	}
+
+	// only the latest 64 samples, 37ms ~ 100ms
+	if got, _ := m.percentile(50); got != 68*time.Millisecond {
+		t.Errorf("percentile(50) = %s", got)
+	}
+	if got, _ := m.percentile(100); got != 100*time.Millisecond {
+		t.Errorf("percentile(100) = %s", got)
+	}
+}
+
+func TestMemberCanceled(t *testing.T) {
+	var m = newMember(newFakeResolver(1, 200*time.Millisecond, dns.RcodeSuccess, ""))
+	m.observe(200 * time.Millisecond)
+
+	var req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	// canceled as a hedged loser soon after started
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		cancel()
+	}()
+	if resp := m.resolve(ctx, req); resp != nil {
+		t.Fatalf("resolve() canceled = %v", resp)
+	}
+
+	if got := m.latency(); got != 200*time.Millisecond {
+		t.Errorf("latency() after canceled = %s, want 200ms", got)
+	}
+	if got, _ := m.percentile(1); got != 200*time.Millisecond {
+		t.Errorf("percentile(1) after canceled = %s, want 200ms", got)
+	}
+}
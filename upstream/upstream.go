@@ -2,65 +2,206 @@ package upstream
 
 import (
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/miekg/dns"
 
+	"github.com/treemana/godot/cache"
+	"github.com/treemana/godot/dnssec"
 	"github.com/treemana/godot/log"
 	"github.com/treemana/godot/model"
 	"github.com/treemana/godot/resolver"
+	"github.com/treemana/godot/util"
 )
 
 const (
 	ttl uint32 = 3600 // one hour equals 3600 seconds
+
+	defaultConcurrency = 64
+
+	metricResolving      = "upstream_resolving"       // number of requests resolving by upstream
+	metricFastestDropped = "upstream_fastest_dropped" // number of the async background selections dropped
 )
 
+// Config represents the upstream settings
+type Config struct {
+	// Resolvers upstream DNS resolver groups, the fastest one of each group is used
+	Resolvers [][]string
+
+	// Fastest A/AAAA fastest address selection settings
+	Fastest FastestConfig
+
+	// Concurrency the max number of requests resolving at the same time,
+	// defaultConcurrency when zero
+	Concurrency int
+
+	// Strategy the dispatch strategy of the resolvers
+	Strategy StrategyConfig
+
+	// Groups the named upstream resolver groups, map[name]resolvers
+	Groups map[string][][]string
+
+	// Routes the domain suffix routing table, map[suffix]group name
+	// the longest matched suffix wins, others go to Resolvers
+	Routes map[string]string
+
+	// Consensus the answer verification across the resolvers
+	Consensus ConsensusConfig
+
+	// DNSSEC the validation of the upstream answers
+	DNSSEC dnssec.Config
+
+	// ECS the client subnet settings, the subnets of New are the static ones
+	// ECS is disabled when nil
+	ECS *ECSConfig
+}
+
+// FastestConfig represents the A/AAAA fastest address selection settings
+type FastestConfig struct {
+	// Async answers the cache miss query immediately with all upstream
+	// answers, the fastest answer will be selected in background and
+	// updated to the cache for later queries
+	Async bool `json:"async"`
+
+	// AsyncTTL the ttl(second) of the immediate answer, 10 when zero
+	AsyncTTL uint32 `json:"async_ttl"`
+
+	// Policy the default policy, PolicyFastest when empty
+	Policy string `json:"policy"`
+
+	// Rules select policy by domain, the first matched rule wins
+	Rules []PolicyRule `json:"rules"`
+}
+
 type UpStream struct {
-	subnetV4  *dns.EDNS0_SUBNET
-	subnetV6  *dns.EDNS0_SUBNET
-	resolvers []*resolver.Resolver
+	subnetV4 atomic.Pointer[dns.EDNS0_SUBNET] // the static subnets
+	subnetV6 atomic.Pointer[dns.EDNS0_SUBNET]
+	ecs      *ecs              // nil when ECS is disabled
+	group    *group            // the default resolvers
+	routes   map[string]*group // map[domain suffix]group
+	groups   map[string]*group // map[name]group, the default group included
+	fastest  FastestConfig
+	strategy StrategyConfig
+
+	consensus ConsensusConfig
+	validator *dnssec.Validator // nil when the validation is disabled
+
+	policyRules []policyRule
 
 	// dt in/out channel
 	dic chan *model.DT
 	doc chan *model.DT
 
+	// in-flight requests, map[key][]waiters
+	flights     map[string][]*model.DT
+	flightMutex sync.Mutex
+
+	reqNum      int
 	reqWG       sync.WaitGroup
 	respNum     int
 	respWG      sync.WaitGroup
 	fastestChan chan *model.DT
 }
 
-func New(rawURLGroups [][]string, subnets []*dns.EDNS0_SUBNET, reqChan, respChan chan *model.DT) (*UpStream, error) {
-	if len(rawURLGroups) == 0 {
+func New(config Config, subnets []*dns.EDNS0_SUBNET, reqChan, respChan chan *model.DT) (*UpStream, error) {
+	if len(config.Resolvers) == 0 {
 		return nil, errors.New("empty rawURLGroups")
 	}
 
-	us := &UpStream{
-		resolvers: resolver.GetFastFromURLGroups(rawURLGroups),
-		dic:       reqChan,
-		doc:       respChan,
-		respNum:   2,
+	var fastest = config.Fastest
+	if fastest.AsyncTTL == 0 {
+		fastest.AsyncTTL = 10
+	}
+
+	if len(fastest.Policy) == 0 {
+		fastest.Policy = PolicyFastest
+	} else if !validPolicy(fastest.Policy) {
+		return nil, fmt.Errorf("unknown policy %s", fastest.Policy)
+	}
+
+	policyRules, err := newPolicyRules(fastest.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = config.Strategy.init(); err != nil {
+		return nil, err
+	}
+
+	if err = config.Consensus.init(config.Strategy.Name); err != nil {
+		return nil, err
 	}
 
-	if len(us.resolvers) == 0 {
+	if config.Concurrency <= 0 {
+		config.Concurrency = defaultConcurrency
+	}
+
+	us := &UpStream{
+		group:       newGroup("default", resolver.GetFastFromURLGroups(config.Resolvers)),
+		fastest:     fastest,
+		strategy:    config.Strategy,
+		consensus:   config.Consensus,
+		policyRules: policyRules,
+		flights:     make(map[string][]*model.DT),
+		dic:         reqChan,
+		doc:         respChan,
+		reqNum:      config.Concurrency,
+		respNum:     config.Concurrency,
+	}
+	if len(us.group.members) == 0 {
 		return nil, errors.New("empty UpStreams")
 	}
 
+	var groups map[string]*group
+	if groups, err = newGroups(config.Groups); err != nil {
+		return nil, err
+	}
+	groups[defaultGroup] = us.group
+	us.groups = groups
+
+	if us.routes, err = newRoutes(groups, config.Routes); err != nil {
+		return nil, err
+	}
+
+	if us.validator, err = dnssec.New(config.DNSSEC, us.Query); err != nil {
+		return nil, err
+	}
+
+	if us.ecs, err = newECS(config.ECS); err != nil {
+		return nil, err
+	}
+
+	us.SetSubnets(subnets)
+
+	return us, nil
+}
+
+// SetSubnets replace the static subnets, the cached answers resolved with the
+// static subnets are flushed when any of them changed
+func (s *UpStream) SetSubnets(subnets []*dns.EDNS0_SUBNET) {
+	var v4, v6 *dns.EDNS0_SUBNET
 	for _, subnet := range subnets {
 		if subnet == nil {
 			continue
 		}
 
-		log.Sugar.Infof("upstream subnet %s", subnet.String())
-
-		if v6 := subnet.Address.To16(); v6 != nil {
-			us.subnetV6 = subnet
+		if subnet.Family == 2 {
+			v6 = subnet
 			continue
 		}
-		us.subnetV4 = subnet
+		v4 = subnet
 	}
 
-	return us, nil
+	var old4, old6 = util.DNSSubnetPrefix(s.subnetV4.Swap(v4)), util.DNSSubnetPrefix(s.subnetV6.Swap(v6))
+	var new4, new6 = util.DNSSubnetPrefix(v4), util.DNSSubnetPrefix(v6)
+	if old4 == new4 && old6 == new6 {
+		return
+	}
+
+	log.Sugar.Infof("upstream subnet v4 [%s] v6 [%s]", new4, new6)
+	cache.Flush("")
 }
 
 func (s *UpStream) Start() {
@@ -73,12 +214,14 @@ func (s *UpStream) Start() {
 		}()
 	}
 
-	s.reqWG.Add(1)
-	go func() {
-		s.request()
-		s.reqWG.Done()
-	}()
-	log.Sugar.Info("upstream is running ...")
+	s.reqWG.Add(s.reqNum)
+	for i := 0; i < s.reqNum; i++ {
+		go func() {
+			s.request()
+			s.reqWG.Done()
+		}()
+	}
+	log.Sugar.Infof("upstream is running, concurrency %d, strategy %s ...", s.reqNum, s.strategy.Name)
 }
 
 func (s *UpStream) Stop() {
@@ -2,6 +2,8 @@ package util
 
 import (
 	"net"
+	"net/netip"
+	"slices"
 
 	"github.com/miekg/dns"
 	"golang.org/x/net/ipv4"
@@ -23,6 +25,8 @@ const (
 	ipv6Flags = ipv6.FlagDst | ipv6.FlagInterface
 )
 
+// DNSNewSubnetFromIP return the subnet of ip, the address is truncated to maskBits
+// RFC 7871 Section 6
 func DNSNewSubnetFromIP(ip net.IP, maskBits uint8) *dns.EDNS0_SUBNET {
 
 	if len(ip) == 0 {
@@ -43,7 +47,7 @@ func DNSNewSubnetFromIP(ip net.IP, maskBits uint8) *dns.EDNS0_SUBNET {
 			subnet.SourceNetmask = maskBits
 		}
 		subnet.Family = 1
-		subnet.Address = ip4
+		subnet.Address = ip4.Mask(net.CIDRMask(int(subnet.SourceNetmask), IPV4MaskBitsMax))
 		return subnet
 	}
 
@@ -56,11 +60,53 @@ func DNSNewSubnetFromIP(ip net.IP, maskBits uint8) *dns.EDNS0_SUBNET {
 		subnet.SourceNetmask = maskBits
 	}
 	subnet.Family = 2
-	subnet.Address = ip
+	subnet.Address = ip.To16().Mask(net.CIDRMask(int(subnet.SourceNetmask), IPV6MaskBitsMax))
 
 	return subnet
 }
 
+// DNSNewSubnetFromPrefix return the subnet of prefix, the prefix length 0 asks
+// the upstream not to use the client address, RFC 7871 Section 7.1.2
+func DNSNewSubnetFromPrefix(prefix netip.Prefix) *dns.EDNS0_SUBNET {
+	if !prefix.IsValid() {
+		return nil
+	}
+
+	prefix = prefix.Masked()
+	var subnet = &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(prefix.Bits()),
+		Address:       prefix.Addr().AsSlice(),
+	}
+	if prefix.Addr().Is4() {
+		subnet.Family = 1
+	} else {
+		subnet.Family = 2
+	}
+	return subnet
+}
+
+// DNSSubnetPrefix return the prefix of subnet, RFC 7871 Section 6
+func DNSSubnetPrefix(subnet *dns.EDNS0_SUBNET) netip.Prefix {
+	if subnet == nil {
+		return netip.Prefix{}
+	}
+
+	addr, ok := netip.AddrFromSlice(subnet.Address)
+	if !ok {
+		return netip.Prefix{}
+	}
+	if subnet.Family == 1 {
+		addr = addr.Unmap()
+	}
+
+	prefix, err := addr.Prefix(int(subnet.SourceNetmask))
+	if err != nil {
+		return netip.Prefix{}
+	}
+	return prefix
+}
+
 func DNSNewNXDomain(source *dns.Msg) *dns.Msg {
 	if source == nil {
 		return nil
@@ -73,6 +119,18 @@ func DNSNewNXDomain(source *dns.Msg) *dns.Msg {
 	return target
 }
 
+func DNSNewServFail(source *dns.Msg) *dns.Msg {
+	if source == nil {
+		return nil
+	}
+
+	var target = new(dns.Msg)
+	target.SetRcode(source, dns.RcodeServerFailure)
+	target.RecursionAvailable = true
+
+	return target
+}
+
 func DNSSplitAnswer(rr dns.RR) net.IP {
 	switch rr := rr.(type) {
 	case *dns.A:
@@ -179,3 +237,79 @@ func DNSSubnetExist(m *dns.Msg) bool {
 
 	return false
 }
+
+// DNSSetDO set the DNSSEC OK bit, RFC 3225
+func DNSSetDO(m *dns.Msg) {
+	if m == nil {
+		return
+	}
+
+	var opt = m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, true)
+		return
+	}
+	opt.SetDo()
+}
+
+func DNSDoExist(m *dns.Msg) bool {
+	if m == nil {
+		return false
+	}
+
+	var opt = m.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// DNSSetEDE set the extended DNS error option, RFC 8914
+func DNSSetEDE(m *dns.Msg, ede *dns.EDNS0_EDE) {
+	if m == nil || ede == nil {
+		return
+	}
+
+	var opt = m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, ede)
+}
+
+// DNSRemoveDNSSEC return the response to the requester which does not ask for DNSSEC,
+// without the DNSSEC records unless they are queried, and without AD unless AD
+// is set in req, RFC 3225 Section 3 and RFC 6840 Section 5.8
+// return resp itself when nothing to remove
+func DNSRemoveDNSSEC(req, resp *dns.Msg) *dns.Msg {
+	if req == nil || resp == nil || DNSDoExist(req) {
+		return resp
+	}
+
+	var qtype uint16
+	if len(req.Question) > 0 {
+		qtype = req.Question[0].Qtype
+	}
+
+	var dnssec = func(rr dns.RR) bool {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			return t != qtype
+		default:
+			return false
+		}
+	}
+
+	var removable = resp.AuthenticatedData && !req.AuthenticatedData
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		removable = removable || slices.ContainsFunc(section, dnssec)
+	}
+	if !removable {
+		return resp
+	}
+
+	var target = resp.Copy()
+	target.AuthenticatedData = resp.AuthenticatedData && req.AuthenticatedData
+	target.Answer = slices.DeleteFunc(target.Answer, dnssec)
+	target.Ns = slices.DeleteFunc(target.Ns, dnssec)
+	target.Extra = slices.DeleteFunc(target.Extra, dnssec)
+	return target
+}
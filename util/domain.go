@@ -0,0 +1,91 @@
+package util
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	domainExact    = "exact"
+	domainSuffix   = "suffix"
+	domainWildcard = "wildcard"
+	domainRegex    = "regex"
+)
+
+// DomainRule matches domain name by the pattern
+//
+//	example.com   exact, example.com only
+//	.example.com  suffix, example.com and all of its subdomains
+//	*.example.com wildcard, '*' and '?' see path.Match
+//	/^ad\d+\./    regex, the expression between slashes
+//
+// names are compared case-insensitively without the trailing dot
+type DomainRule struct {
+	kind    string
+	pattern string
+	re      *regexp.Regexp
+}
+
+func NewDomainRule(raw string) (*DomainRule, error) {
+	raw = strings.TrimSpace(raw)
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("empty domain rule")
+	}
+
+	if len(raw) > 2 && strings.HasPrefix(raw, "/") && strings.HasSuffix(raw, "/") {
+		re, err := regexp.Compile(raw[1 : len(raw)-1])
+		if err != nil {
+			return nil, fmt.Errorf("domain rule %s error=[%+v]", raw, err)
+		}
+		return &DomainRule{kind: domainRegex, pattern: raw, re: re}, nil
+	}
+
+	var pattern = DomainNormalize(raw)
+	switch {
+	case strings.ContainsAny(pattern, "*?["):
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("domain rule %s error=[%+v]", raw, err)
+		}
+		return &DomainRule{kind: domainWildcard, pattern: pattern}, nil
+	case strings.HasPrefix(pattern, "."):
+		return &DomainRule{kind: domainSuffix, pattern: pattern[1:]}, nil
+	default:
+		return &DomainRule{kind: domainExact, pattern: pattern}, nil
+	}
+}
+
+// Match report whether name matched the rule
+func (r *DomainRule) Match(name string) bool {
+	name = DomainNormalize(name)
+	switch r.kind {
+	case domainExact:
+		return name == r.pattern
+	case domainSuffix:
+		return DomainIsSubdomain(name, r.pattern)
+	case domainWildcard:
+		ok, _ := path.Match(r.pattern, name)
+		return ok
+	case domainRegex:
+		return r.re.MatchString(name)
+	default:
+		return false
+	}
+}
+
+func (r *DomainRule) String() string { return r.pattern }
+
+// DomainNormalize return the lower case name without the trailing dot
+func DomainNormalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// DomainIsSubdomain report whether child equals parent or is a subdomain of parent
+// both of them should be normalized
+func DomainIsSubdomain(child, parent string) bool {
+	if len(parent) == 0 {
+		return true
+	}
+	return child == parent || strings.HasSuffix(child, "."+parent)
+}
@@ -0,0 +1,33 @@
+package util
+
+import "testing"
+
+func TestDomainRule(t *testing.T) {
+	tests := []struct {
+		rule  string
+		name  string
+		match bool
+	}{
+		{rule: "example.com", name: "example.com.", match: true},
+		{rule: "example.com", name: "www.example.com.", match: false},
+		{rule: ".example.com", name: "example.com.", match: true},
+		{rule: ".example.com", name: "a.b.Example.com.", match: true},
+		{rule: ".example.com", name: "badexample.com.", match: false},
+		{rule: "*.example.com", name: "www.example.com.", match: true},
+		{rule: "*.example.com", name: "example.com.", match: false},
+		{rule: "google.*", name: "google.co.uk.", match: true},
+		{rule: `/^ad\d+\./`, name: "ad12.example.com.", match: true},
+		{rule: `/^ad\d+\./`, name: "add.example.com.", match: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule+" "+tt.name, func(t *testing.T) {
+			r, err := NewDomainRule(tt.rule)
+			if err != nil {
+				t.Fatalf("NewDomainRule() error = %v", err)
+			}
+			if got := r.Match(tt.name); got != tt.match {
+				t.Errorf("Match() = %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
@@ -1,52 +1,46 @@
 package util
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"math"
 	"net"
-	"net/http"
 	"time"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 )
 
-const (
-	// ipify https://www.ipify.org/
-	ipify4 = "https://api4.ipify.org/"
-	ipify6 = "https://api6.ipify.org/"
-)
-
 var (
 	// oobSize int
 
 	pingNetwork = "tcp"
 	pingPorts   = []string{"80", "443"}
 	pingTimeout = time.Second
+
+	// nonPublic the special-purpose prefixes not checked by net.IP methods
+	nonPublic = []*net.IPNet{
+		{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}, // shared address space, RFC 6598
+		{IP: net.IPv4(198, 18, 0, 0), Mask: net.CIDRMask(15, 32)}, // benchmarking, RFC 2544
+	}
 )
 
 func init() {
 	// oobSize = getOOBSize()
 }
 
-func GetPublicIPV4() (net.IP, error) { return getPublicIP(ipify4) }
-func GetPublicIPV6() (net.IP, error) { return getPublicIP(ipify6) }
-func getPublicIP(url string) (net.IP, error) {
-
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
+// IPIsPublic report whether ip is a global unicast address,
+// the private, loopback, link-local and shared addresses are not
+func IPIsPublic(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
 	}
-
-	defer func() { _ = resp.Body.Close() }()
-
-	var raw []byte
-	if raw, err = io.ReadAll(resp.Body); err != nil {
-		return nil, err
+	for _, n := range nonPublic {
+		if n.Contains(ip) {
+			return false
+		}
 	}
-
-	return net.ParseIP(string(raw)), nil
+	return true
 }
 
 func Read(c *net.UDPConn, buf []byte) (n int, remoteAddr *net.UDPAddr, err error) {
@@ -104,7 +98,10 @@ func GetOOBWithSrc(ip net.IP) []byte {
 // Ping return the minimum latency in millisecond
 // host : (net.IP).String()
 // when dial error or timeout, return math.MaxUint32
-func Ping(host string) uint32 {
+func Ping(host string) uint32 { return PingContext(context.Background(), host) }
+
+// PingContext same as Ping, return math.MaxUint32 when ctx is done before connected
+func PingContext(ctx context.Context, host string) uint32 {
 
 	if len(host) == 0 {
 		return math.MaxUint32
@@ -114,7 +111,7 @@ func Ping(host string) uint32 {
 	defer close(c)
 	for _, port := range pingPorts {
 		addr := net.JoinHostPort(host, port)
-		go ping(addr, c)
+		go ping(ctx, addr, c)
 	}
 
 	var min uint32 = math.MaxUint32
@@ -128,11 +125,11 @@ func Ping(host string) uint32 {
 	return min
 }
 
-func ping(addr string, c chan uint32) string {
+func ping(ctx context.Context, addr string, c chan uint32) string {
 	var dialer = net.Dialer{Timeout: pingTimeout}
 
 	start := time.Now()
-	conn, err := dialer.Dial(pingNetwork, addr)
+	conn, err := dialer.DialContext(ctx, pingNetwork, addr)
 	if err != nil {
 		c <- math.MaxUint32
 		return fmt.Sprintf("dial %s error=[%+v]", addr, err)
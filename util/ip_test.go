@@ -3,7 +3,6 @@ package util
 import (
 	"fmt"
 	"math"
-	"net"
 	"testing"
 )
 
@@ -38,16 +37,3 @@ func TestPing(t *testing.T) {
 		})
 	}
 }
-
-func TestGetPublicIP(t *testing.T) {
-	got, err := getPublicIP(ipify4)
-	if err != nil {
-		t.Errorf("getPublicIP() error = %v", err)
-		return
-	}
-	if got == nil {
-		t.Error("getPublicIP() got = nil")
-	}
-
-	fmt.Println(net.IPv6zero.String())
-}
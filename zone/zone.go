@@ -0,0 +1,261 @@
+package zone
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/util"
+)
+
+// zone an authoritative zone loaded from a master file
+type zone struct {
+	origin   string
+	soa      *dns.SOA
+	records  []dns.RR            // all the records in the file order, for the transfers
+	names    map[string][]dns.RR // the records by the canonical owner name
+	exists   map[string]bool     // the owner names and the empty non-terminals
+	transfer []netip.Prefix      // the clients allowed to transfer the zone
+}
+
+// parse return the zone of the master file, the first record must be the SOA
+// of origin, all the records must be in the zone
+func parse(r io.Reader, origin, file string) (*zone, error) {
+	var z = &zone{
+		origin: dns.CanonicalName(origin),
+		names:  make(map[string][]dns.RR),
+		exists: make(map[string]bool),
+	}
+
+	var parser = dns.NewZoneParser(r, z.origin, file)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		var hdr = rr.Header()
+		hdr.Name = dns.CanonicalName(hdr.Name)
+		if !dns.IsSubDomain(z.origin, hdr.Name) {
+			return nil, fmt.Errorf("%s out of zone %s", hdr.Name, z.origin)
+		}
+
+		if soa, ok := rr.(*dns.SOA); ok {
+			if z.soa != nil || hdr.Name != z.origin {
+				return nil, fmt.Errorf("unexpected SOA %s", soa)
+			}
+			z.soa = soa
+		} else if z.soa == nil {
+			return nil, errors.New("the first record is not SOA")
+		}
+
+		z.records = append(z.records, rr)
+		z.names[hdr.Name] = append(z.names[hdr.Name], rr)
+		for name := hdr.Name; !z.exists[name] && name != z.origin; {
+			z.exists[name] = true
+			i, _ := dns.NextLabel(name, 0)
+			name = name[i:]
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+
+	if z.soa == nil {
+		return nil, errors.New("no SOA")
+	}
+	z.exists[z.origin] = true
+
+	return z, nil
+}
+
+// answer the question of name in the zone, name should be canonical
+// return the referral when name is delegated, or the response of the delegated
+// name servers when recursion is desired, nil when they have no glue, the
+// request should be resolved as usual
+func (z *zone) answer(req *dns.Msg, name string, qtype uint16) *dns.Msg {
+	if ns := z.delegation(name, qtype); ns != nil {
+		if req.RecursionDesired {
+			return z.forward(req, ns)
+		}
+
+		var resp = reply(req)
+		resp.Ns = ns
+		resp.Extra = z.glue(ns)
+		return resp
+	}
+
+	var resp = reply(req)
+	resp.Authoritative = true
+
+	for hops := 0; hops < maxChain; hops++ {
+		rrs, ok := z.lookup(name)
+		if !ok {
+			// the rcode of the last name of the CNAME chain, RFC 6604
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = []dns.RR{z.negative()}
+			return resp
+		}
+
+		var answer = owned(rrs, name, qtype)
+		if len(answer) > 0 {
+			resp.Answer = append(resp.Answer, answer...)
+			return resp
+		}
+
+		var cname = owned(rrs, name, dns.TypeCNAME)
+		if len(cname) == 0 {
+			// NODATA
+			resp.Ns = []dns.RR{z.negative()}
+			return resp
+		}
+
+		resp.Answer = append(resp.Answer, cname[0])
+		name = dns.CanonicalName(cname[0].(*dns.CNAME).Target)
+		if !dns.IsSubDomain(z.origin, name) {
+			// the target out of the zone is resolved by the requester
+			return resp
+		}
+		if z.delegation(name, qtype) != nil {
+			return resp
+		}
+	}
+	return resp
+}
+
+// delegation return the NS records of the cut above name, or at name unless DS
+// is asked, which is answered by the parent, nil when not delegated
+func (z *zone) delegation(name string, qtype uint16) []dns.RR {
+	// from the child of origin down to name
+	var top, labels = dns.CountLabel(z.origin), dns.CountLabel(name)
+	for n := top + 1; n <= labels; n++ {
+		var i, _ = dns.PrevLabel(name, n)
+		var cut = name[i:]
+		if cut == name && qtype == dns.TypeDS {
+			break
+		}
+
+		var ns []dns.RR
+		for _, rr := range z.names[cut] {
+			if rr.Header().Rrtype == dns.TypeNS {
+				ns = append(ns, rr)
+			}
+		}
+		if len(ns) > 0 {
+			return ns
+		}
+	}
+	return nil
+}
+
+// glue return the A and AAAA records of the name servers in the zone
+func (z *zone) glue(ns []dns.RR) []dns.RR {
+	var glue []dns.RR
+	for _, rr := range ns {
+		var target = dns.CanonicalName(rr.(*dns.NS).Ns)
+		for _, x := range z.names[target] {
+			if t := x.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				glue = append(glue, x)
+			}
+		}
+	}
+	return glue
+}
+
+// forward resolve req by the glue addresses of the name servers ns in turn,
+// return nil when there is no glue, SERVFAIL when none of them answered
+func (z *zone) forward(req *dns.Msg, ns []dns.RR) *dns.Msg {
+	var glue = z.glue(ns)
+	if len(glue) == 0 {
+		return nil
+	}
+
+	for _, rr := range glue {
+		var ip = util.DNSSplitAnswer(rr)
+		var address = net.JoinHostPort(ip.String(), delegatedPort)
+
+		resp, err := exchange("udp", req, address)
+		if err == nil && resp.Truncated {
+			resp, err = exchange("tcp", req, address)
+		}
+		if err != nil {
+			log.Sugar.Warnf("zone %s delegated %s error=[%+v]", z.origin, address, err)
+			continue
+		}
+
+		resp.RecursionAvailable = true
+		return resp
+	}
+
+	var resp = new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeServerFailure)
+	resp.RecursionAvailable = true
+	return resp
+}
+
+// exchange send req to the name server of address by network
+func exchange(network string, req *dns.Msg, address string) (*dns.Msg, error) {
+	var client = &dns.Client{Net: network, Timeout: delegatedTimeout}
+	resp, _, err := client.Exchange(req, address)
+	return resp, err
+}
+
+// lookup return the records of name, or the wildcard of its closest encloser,
+// false when name does not exist, the empty non-terminal exists without records
+func (z *zone) lookup(name string) ([]dns.RR, bool) {
+	if z.exists[name] {
+		return z.names[name], true
+	}
+
+	// the closest encloser, RFC 4592 Section 3.3.1
+	for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+		var encloser = name[i:]
+		if !z.exists[encloser] {
+			continue
+		}
+		rrs, ok := z.names["*."+encloser]
+		return rrs, ok
+	}
+	return nil, false
+}
+
+// negative return the SOA of the negative answer, its ttl is the minimum of
+// the SOA ttl and the SOA minimum, RFC 2308 Section 3
+func (z *zone) negative() dns.RR {
+	var soa = dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	return soa
+}
+
+// allowed report whether addr is allowed to transfer the zone
+func (z *zone) allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range z.transfer {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// owned return the copies of the records of qtype owned by name, all of them
+// except the DNSSEC records for ANY
+func owned(rrs []dns.RR, name string, qtype uint16) []dns.RR {
+	var answer []dns.RR
+	for _, rr := range rrs {
+		var t = rr.Header().Rrtype
+		if t == qtype || (qtype == dns.TypeANY && t != dns.TypeRRSIG && t != dns.TypeNSEC && t != dns.TypeNSEC3) {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			answer = append(answer, rr)
+		}
+	}
+	return answer
+}
+
+func reply(req *dns.Msg) *dns.Msg {
+	var resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	return resp
+}
@@ -0,0 +1,229 @@
+package zone
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+)
+
+func TestMain(m *testing.M) {
+	_ = log.Init(log.Config{STDOUT: true, Level: 1})
+	os.Exit(m.Run())
+}
+
+const testZone = `$TTL 3600
+@        IN SOA ns1 hostmaster 2024010101 3600 600 86400 300
+@        IN NS  ns1
+ns1      IN A   192.0.2.53
+www      IN A   192.0.2.1
+www      IN AAAA 2001:db8::1
+alias    IN CNAME www
+outside  IN CNAME www.example.com.
+*.apps   IN A   192.0.2.2
+a.b.ent  IN TXT "deep"
+sub      IN NS  ns.sub
+sub      IN DS  12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF
+ns.sub   IN A   127.0.0.1
+ext      IN NS  ns.example.net.
+`
+
+func newTestZones(t *testing.T, config ZoneConfig) *Zones {
+	var file = filepath.Join(t.TempDir(), "corp.zone")
+	if err := os.WriteFile(file, []byte(testZone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Name, config.File = "corp.example", file
+	zs, err := New(Config{Zones: []ZoneConfig{config}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zs
+}
+
+func TestAnswer(t *testing.T) {
+	var zs = newTestZones(t, ZoneConfig{})
+
+	var tests = []struct {
+		name   string
+		qtype  uint16
+		rd     bool
+		rcode  int
+		aa     bool
+		answer int
+		ns     uint16 // the type of the authority records
+	}{
+		{"www.corp.example.", dns.TypeA, true, dns.RcodeSuccess, true, 1, 0},
+		{"WWW.Corp.Example.", dns.TypeAAAA, true, dns.RcodeSuccess, true, 1, 0},
+		{"www.corp.example.", dns.TypeMX, true, dns.RcodeSuccess, true, 0, dns.TypeSOA},
+		{"nope.corp.example.", dns.TypeA, true, dns.RcodeNameError, true, 0, dns.TypeSOA},
+		{"alias.corp.example.", dns.TypeA, true, dns.RcodeSuccess, true, 2, 0},
+		{"outside.corp.example.", dns.TypeA, true, dns.RcodeSuccess, true, 1, 0},
+		{"x.apps.corp.example.", dns.TypeA, true, dns.RcodeSuccess, true, 1, 0},
+		{"ent.corp.example.", dns.TypeA, true, dns.RcodeSuccess, true, 0, dns.TypeSOA},
+		{"x.ent.corp.example.", dns.TypeA, true, dns.RcodeNameError, true, 0, dns.TypeSOA},
+		{"sub.corp.example.", dns.TypeDS, true, dns.RcodeSuccess, true, 1, 0},
+		{"www.sub.corp.example.", dns.TypeA, false, dns.RcodeSuccess, false, 0, dns.TypeNS},
+		{"corp.example.", dns.TypeNS, true, dns.RcodeSuccess, true, 1, 0},
+	}
+
+	for _, test := range tests {
+		var req = new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+		req.RecursionDesired = test.rd
+
+		var resp = zs.Answer(req)
+		if resp == nil {
+			t.Errorf("%s %s: Answer() = nil", test.name, dns.TypeToString[test.qtype])
+			continue
+		}
+		if resp.Rcode != test.rcode || resp.Authoritative != test.aa || len(resp.Answer) != test.answer {
+			t.Errorf("%s %s: Answer() = %s aa=%t answer %d, want %s aa=%t answer %d", test.name, dns.TypeToString[test.qtype],
+				dns.RcodeToString[resp.Rcode], resp.Authoritative, len(resp.Answer), dns.RcodeToString[test.rcode], test.aa, test.answer)
+		}
+		if test.ns != 0 && (len(resp.Ns) == 0 || resp.Ns[0].Header().Rrtype != test.ns) {
+			t.Errorf("%s %s: Answer() authority = %v, want %s", test.name, dns.TypeToString[test.qtype], resp.Ns, dns.TypeToString[test.ns])
+		}
+	}
+
+	// the negative answer ttl is the SOA minimum
+	var req = new(dns.Msg)
+	req.SetQuestion("nope.corp.example.", dns.TypeA)
+	if resp := zs.Answer(req); resp.Ns[0].Header().Ttl != 300 {
+		t.Errorf("Answer() negative ttl = %d, want 300", resp.Ns[0].Header().Ttl)
+	}
+
+	// the delegation without glue is resolved as usual when recursion desired
+	req.SetQuestion("www.ext.corp.example.", dns.TypeA)
+	if resp := zs.Answer(req); resp != nil {
+		t.Errorf("Answer() delegated without glue = %v, want nil", resp)
+	}
+
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	if resp := zs.Answer(req); resp != nil {
+		t.Errorf("Answer() out of zone = %v, want nil", resp)
+	}
+}
+
+func TestAnswerDelegated(t *testing.T) {
+	var zs = newTestZones(t, ZoneConfig{})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server = &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		var resp = new(dns.Msg)
+		resp.SetReply(req)
+		resp.Authoritative = true
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(10, 0, 0, 1),
+		})
+		_ = w.WriteMsg(resp)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+
+	var port = delegatedPort
+	t.Cleanup(func() { delegatedPort = port })
+	_, delegatedPort, _ = net.SplitHostPort(conn.LocalAddr().String())
+
+	// resolved by the delegated name server when recursion desired
+	var req = new(dns.Msg)
+	req.SetQuestion("www.sub.corp.example.", dns.TypeA)
+	var resp = zs.Answer(req)
+	if resp == nil || resp.Rcode != dns.RcodeSuccess || !resp.RecursionAvailable || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("Answer() delegated with recursion = %v, want 10.0.0.1", resp)
+	}
+
+	// none of the name servers answered
+	_ = server.Shutdown()
+	if resp = zs.Answer(req); resp == nil || resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Answer() delegated unreachable = %v, want SERVFAIL", resp)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	var zs = newTestZones(t, ZoneConfig{Transfer: []string{"127.0.0.0/8"}})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server = &dns.Server{Listener: listener, Handler: dns.HandlerFunc(zs.serve)}
+	go func() { _ = server.ActivateAndServe() }()
+	defer func() { _ = server.Shutdown() }()
+
+	var transfer = func(qtype uint16, serial uint32) ([]dns.RR, error) {
+		var req = new(dns.Msg)
+		req.SetQuestion("corp.example.", qtype)
+		if qtype == dns.TypeIXFR {
+			req.SetIxfr("corp.example.", serial, ".", ".")
+		}
+
+		c, err := new(dns.Transfer).In(req, listener.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+
+		var rrs []dns.RR
+		for envelope := range c {
+			if envelope.Error != nil {
+				return nil, envelope.Error
+			}
+			rrs = append(rrs, envelope.RR...)
+		}
+		return rrs, nil
+	}
+
+	rrs, err := transfer(dns.TypeAXFR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 14 || rrs[0].Header().Rrtype != dns.TypeSOA || rrs[13].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("AXFR = %d records, want 14 from SOA to SOA", len(rrs))
+	}
+
+	if rrs, err = transfer(dns.TypeIXFR, 2024010101); err != nil || len(rrs) != 1 {
+		t.Errorf("IXFR up to date = %d records, %v, want the SOA only", len(rrs), err)
+	}
+	if rrs, err = transfer(dns.TypeIXFR, 2023010101); err != nil || len(rrs) != 14 {
+		t.Errorf("IXFR outdated = %d records, %v, want 14", len(rrs), err)
+	}
+
+	// refused out of the allowed CIDRs
+	(*zs.zones.Load())["corp.example."].transfer = nil
+	if _, err = transfer(dns.TypeAXFR, 0); err == nil {
+		t.Error("AXFR out of the allowed CIDRs succeeded")
+	}
+}
+
+func TestReload(t *testing.T) {
+	var zs = newTestZones(t, ZoneConfig{})
+	zs.watch = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go zs.reload(ctx)
+
+	var file = zs.configs[0].File
+	if err := os.WriteFile(file, []byte(testZone+"new IN A 192.0.2.3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var req = new(dns.Msg)
+	req.SetQuestion("new.corp.example.", dns.TypeA)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if resp := zs.Answer(req); resp != nil && len(resp.Answer) == 1 {
+			return
+		}
+	}
+	t.Error("the zone file is not reloaded")
+}
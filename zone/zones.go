@@ -0,0 +1,327 @@
+package zone
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/treemana/godot/log"
+	"github.com/treemana/godot/metrics"
+)
+
+const (
+	watchDefault = 5 * time.Second
+	maxChain     = 8   // the max length of the CNAME chain in a zone
+	transferSize = 100 // the records of a transfer message
+
+	delegatedTimeout = 2 * time.Second // the timeout of a query to the delegated name server
+
+	metricAnswered  = "zone_answered"  // number of the requests answered authoritatively
+	metricTransfers = "zone_transfers" // number of the zone transfers
+)
+
+// delegatedPort the port of the delegated name servers
+var delegatedPort = "53"
+
+// ZoneConfig represents an authoritative zone
+type ZoneConfig struct {
+	// Name the origin of the zone
+	Name string `json:"name"`
+
+	// File the path of the RFC 1035 master file
+	File string `json:"file"`
+
+	// Transfer the CIDRs of the secondaries allowed to transfer the zone by AXFR and IXFR
+	Transfer []string `json:"transfer"`
+}
+
+// Config represents the authoritative zones settings
+type Config struct {
+	// Zones the authoritative zones, disabled when empty
+	Zones []ZoneConfig `json:"zones"`
+
+	// Transfer the TCP address serving the zone transfers, "0.0.0.0:53", disabled when empty
+	Transfer string `json:"transfer"`
+
+	// Watch the interval(second) of checking the zone files changes, 5 when zero
+	Watch int `json:"watch"`
+}
+
+// Zones answer the requests of the authoritative zones
+type Zones struct {
+	configs  []ZoneConfig
+	transfer string
+	watch    time.Duration
+
+	// zones by the canonical origin, swapped when a zone reloaded
+	zones atomic.Pointer[map[string]*zone]
+	files map[string]os.FileInfo // the zone files loaded, by origin
+}
+
+// New return nil when there is no zone
+func New(config Config) (*Zones, error) {
+	if len(config.Zones) == 0 {
+		return nil, nil
+	}
+
+	var zs = &Zones{
+		configs:  config.Zones,
+		transfer: config.Transfer,
+		watch:    time.Second * time.Duration(config.Watch),
+		files:    make(map[string]os.FileInfo),
+	}
+	if zs.watch <= 0 {
+		zs.watch = watchDefault
+	}
+
+	var zones = make(map[string]*zone, len(config.Zones))
+	for _, c := range config.Zones {
+		z, info, err := load(c)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := zones[z.origin]; ok {
+			return nil, fmt.Errorf("zone %s duplicated", z.origin)
+		}
+		zones[z.origin], zs.files[z.origin] = z, info
+	}
+	zs.zones.Store(&zones)
+
+	return zs, nil
+}
+
+// load the zone of c, return the file info loaded
+func load(c ZoneConfig) (*zone, os.FileInfo, error) {
+	f, err := os.Open(c.File)
+	if err != nil {
+		return nil, nil, fmt.Errorf("zone %s error=[%+v]", c.Name, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("zone %s error=[%+v]", c.Name, err)
+	}
+
+	z, err := parse(f, c.Name, c.File)
+	if err != nil {
+		return nil, nil, fmt.Errorf("zone %s file %s error=[%+v]", c.Name, c.File, err)
+	}
+
+	for _, raw := range c.Transfer {
+		prefix, err := netip.ParsePrefix(raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("zone %s transfer %s error=[%+v]", c.Name, raw, err)
+		}
+		z.transfer = append(z.transfer, prefix.Masked())
+	}
+
+	log.Sugar.Infof("zone %s serial %d records %d", z.origin, z.soa.Serial, len(z.records))
+	return z, info, nil
+}
+
+// Start reload the changed zone files, and serve the zone transfers until ctx done
+func (zs *Zones) Start(ctx context.Context) error {
+	if zs == nil {
+		return nil
+	}
+
+	go zs.reload(ctx)
+
+	if len(zs.transfer) == 0 {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", zs.transfer)
+	if err != nil {
+		return fmt.Errorf("zone transfer listen %s error=[%+v]", zs.transfer, err)
+	}
+
+	var server = &dns.Server{Listener: listener, Handler: dns.HandlerFunc(zs.serve)}
+	go func() {
+		if err := server.ActivateAndServe(); err != nil {
+			log.Sugar.Errorf("zone transfer serve error=[%+v]", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown()
+	}()
+
+	log.Sugar.Infof("zone transfer listening %s", listener.Addr())
+	return nil
+}
+
+// reload the zone files changed every watch interval until ctx done,
+// the old zone is kept when the reloading failed
+func (zs *Zones) reload(ctx context.Context) {
+	var ticker = time.NewTicker(zs.watch)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		var zones = *zs.zones.Load()
+		var changed map[string]*zone
+		for _, c := range zs.configs {
+			var origin = dns.CanonicalName(c.Name)
+			info, err := os.Stat(c.File)
+			if err != nil {
+				log.Sugar.Warnf("zone %s error=[%+v]", origin, err)
+				continue
+			}
+			if old := zs.files[origin]; info.ModTime().Equal(old.ModTime()) && info.Size() == old.Size() {
+				continue
+			}
+
+			z, info, err := load(c)
+			if err != nil {
+				log.Sugar.Errorf("%+v, the old zone is kept", err)
+				continue
+			}
+			zs.files[origin] = info
+
+			if changed == nil {
+				changed = make(map[string]*zone, len(zones))
+				for k, v := range zones {
+					changed[k] = v
+				}
+			}
+			changed[origin] = z
+		}
+
+		if changed != nil {
+			zs.zones.Store(&changed)
+		}
+	}
+}
+
+// find return the zone of the longest origin matched name, nil when no zone
+func (zs *Zones) find(name string) *zone {
+	var zones = *zs.zones.Load()
+	for i, end := 0, false; !end; i, end = dns.NextLabel(name, i) {
+		if z, ok := zones[name[i:]]; ok {
+			return z
+		}
+	}
+	return nil
+}
+
+// Answer return the authoritative response of req when its name is in a zone,
+// otherwise nil, the delegated name is resolved as usual when recursion desired
+func (zs *Zones) Answer(req *dns.Msg) *dns.Msg {
+	if zs == nil || len(req.Question) == 0 || req.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+
+	var q = req.Question[0]
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		return nil
+	}
+
+	var name = dns.CanonicalName(q.Name)
+	var z = zs.find(name)
+	if z == nil {
+		return nil
+	}
+
+	var resp = z.answer(req, name, q.Qtype)
+	if resp != nil {
+		metrics.Add(metricAnswered, 1)
+	}
+	return resp
+}
+
+// serve the TCP requests, the zone transfers and the authoritative queries,
+// REFUSED for the others
+func (zs *Zones) serve(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) == 0 {
+		return
+	}
+
+	var q = req.Question[0]
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		zs.transferOut(w, req)
+		return
+	}
+
+	var resp = zs.Answer(req)
+	if resp == nil {
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeRefused)
+	}
+	_ = w.WriteMsg(resp)
+}
+
+// transferOut send the zone to the allowed secondary, the whole zone for AXFR,
+// and for IXFR unless the secondary is up to date, RFC 1995 Section 4
+func (zs *Zones) transferOut(w dns.ResponseWriter, req *dns.Msg) {
+	var q = req.Question[0]
+	var z, ok = (*zs.zones.Load())[dns.CanonicalName(q.Name)]
+
+	var addr netip.Addr
+	if tcp, isTCP := w.RemoteAddr().(*net.TCPAddr); isTCP {
+		addr = tcp.AddrPort().Addr()
+	}
+
+	if !ok || !z.allowed(addr) {
+		log.Sugar.Warnf("zone transfer %s %s from %s refused", dns.TypeToString[q.Qtype], q.Name, w.RemoteAddr())
+		var resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeRefused)
+		_ = w.WriteMsg(resp)
+		return
+	}
+
+	var envelopes = make(chan *dns.Envelope)
+	var done = make(chan struct{})
+	go func() {
+		if err := new(dns.Transfer).Out(w, req, envelopes); err != nil {
+			log.Sugar.Errorf("zone transfer %s to %s error=[%+v]", z.origin, w.RemoteAddr(), err)
+		}
+		close(done)
+	}()
+
+	// the zone starts and ends with the SOA
+	var records = append(slices.Clip(z.records), z.soa)
+	if q.Qtype == dns.TypeIXFR && upToDate(req, z.soa.Serial) {
+		records = []dns.RR{z.soa}
+	}
+
+	for len(records) > 0 {
+		var n = min(len(records), transferSize)
+		select {
+		case envelopes <- &dns.Envelope{RR: records[:n]}:
+			records = records[n:]
+		case <-done:
+			// the writing failed
+			return
+		}
+	}
+	close(envelopes)
+	<-done
+
+	metrics.Add(metricTransfers, 1)
+	log.Sugar.Infof("zone transfer %s %s serial %d to %s", dns.TypeToString[q.Qtype], z.origin, z.soa.Serial, w.RemoteAddr())
+}
+
+// upToDate report whether the serial of the IXFR request is not older than serial,
+// by the serial number arithmetic, RFC 1982
+func upToDate(req *dns.Msg, serial uint32) bool {
+	for _, rr := range req.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return int32(serial-soa.Serial) <= 0
+		}
+	}
+	return false
+}